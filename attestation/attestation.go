@@ -0,0 +1,181 @@
+// Package attestation verifies Confidential Space attestation tokens, and
+// evaluates their claims against the policy a deployment is expected to satisfy.
+//
+// Tokens are OIDC tokens signed with RS256 by Confidential Space, whose keys
+// are published as a JSON Web Key Set.
+package attestation
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// Issuer of Confidential Space tokens.
+	Issuer = "https://confidentialcomputing.googleapis.com"
+	// JWKS with the keys that sign Confidential Space tokens.
+	JWKSURL = "https://www.googleapis.com/service_accounts/v1/metadata/jwk/signer@confidentialspace-sign.iam.gserviceaccount.com"
+
+	// Tolerated clock difference when checking the validity of a token.
+	leeway = time.Minute
+)
+
+// Claims are the claims of a Confidential Space token that policies cover.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  Strings  `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expiry    int64    `json:"exp"`
+	Nonces    Strings  `json:"eat_nonce"`
+	SWName    string   `json:"swname"`
+	DebugStat string   `json:"dbgstat"`
+	Accounts  []string `json:"google_service_accounts"`
+	Submods   Submods  `json:"submods"`
+}
+
+type Submods struct {
+	Container struct {
+		ImageReference string            `json:"image_reference"`
+		ImageDigest    string            `json:"image_digest"`
+		Env            map[string]string `json:"env"`
+	} `json:"container"`
+	GCE struct {
+		ProjectID    string `json:"project_id"`
+		Zone         string `json:"zone"`
+		InstanceName string `json:"instance_name"`
+	} `json:"gce"`
+	ConfidentialSpace struct {
+		SupportAttributes []string `json:"support_attributes"`
+	} `json:"confidential_space"`
+}
+
+// Strings is a claim that is either a single string or an array of strings.
+type Strings []string
+
+func (s *Strings) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = Strings{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("claim is neither a string nor an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// KeySet is the set of keys that tokens are verified against, by key ID.
+type KeySet map[string]*rsa.PublicKey
+
+// ParseJWKS parses the RSA keys in a JSON Web Key Set.
+func ParseJWKS(data []byte) (KeySet, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(KeySet, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent for key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no RSA keys")
+	}
+	return keys, nil
+}
+
+// Verify checks the signature of token against keys, and that it is valid at
+// now, and returns its claims. The claims are not checked against any policy.
+func Verify(token string, keys KeySet, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims Claims
+	if err := decodePart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(leeway)) {
+		return nil, fmt.Errorf("token expired at %s", time.Unix(claims.Expiry, 0).UTC())
+	}
+	if now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token is not valid before %s", time.Unix(claims.NotBefore, 0).UTC())
+	}
+	return &claims, nil
+}
+
+// VKeyNonce returns the nonce that binds a token to a witness verifier key,
+// as the hex encoded SHA-256 hash of the key. This keeps it within the size
+// limit the launcher imposes on nonces.
+func VKeyNonce(vkey string) string {
+	h := sha256.Sum256([]byte(vkey))
+	return hex.EncodeToString(h[:])
+}
+
+/// Helper functions
+
+func decodePart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
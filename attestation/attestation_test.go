@@ -0,0 +1,233 @@
+package attestation
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A locally generated signing key, standing in for the one of Confidential Space.
+type testSigner struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, kid: kid}
+}
+
+func (s *testSigner) JWKS() []byte {
+	jwks, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "ignored"},
+			{
+				"kty": "RSA",
+				"kid": s.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+			},
+		},
+	})
+	return jwks
+}
+
+func (s *testSigner) Sign(t *testing.T, alg string, claims any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	signer := newTestSigner(t, "key")
+	keys, err := ParseJWKS(signer.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	claims := func(nbf, exp time.Time) map[string]any {
+		return map[string]any{
+			"iss":       Issuer,
+			"aud":       "confidential-witness",
+			"nbf":       nbf.Unix(),
+			"exp":       exp.Unix(),
+			"eat_nonce": "0123456789",
+		}
+	}
+	valid := signer.Sign(t, "RS256", claims(now.Add(-time.Minute), now.Add(time.Hour)))
+	parts := strings.Split(valid, ".")
+	other := newTestSigner(t, "key")
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired within leeway", signer.Sign(t, "RS256", claims(now.Add(-time.Hour), now.Add(-30*time.Second))), true},
+		{"expired", signer.Sign(t, "RS256", claims(now.Add(-time.Hour), now.Add(-2*time.Minute))), false},
+		{"without expiry", signer.Sign(t, "RS256", map[string]any{"iss": Issuer}), false},
+		{"not yet valid", signer.Sign(t, "RS256", claims(now.Add(2*time.Minute), now.Add(time.Hour))), false},
+		{"signed by another key", other.Sign(t, "RS256", claims(now, now.Add(time.Hour))), false},
+		{"unknown key ID", newTestSigner(t, "other").Sign(t, "RS256", claims(now, now.Add(time.Hour))), false},
+		{"other algorithm", signer.Sign(t, "RS512", claims(now, now.Add(time.Hour))), false},
+		{"unsigned", parts[0] + "." + parts[1] + ".", false},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+Issuer+`","exp":9999999999}`)) + "." + parts[2], false},
+		{"not a JWT", "token", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := Verify(tc.token, keys, now)
+			if (err == nil) != tc.ok {
+				t.Fatalf("Verify() = %v", err)
+			}
+			if tc.ok && (c.Audience[0] != "confidential-witness" || c.Nonces[0] != "0123456789") {
+				t.Errorf("Verify() = %+v", c)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	for _, jwks := range []string{
+		`{"keys":[]}`,
+		`{"keys":[{"kty":"EC","kid":"a"}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"AQAB","e":""}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"!","e":"AQAB"}]}`,
+		`not json`,
+	} {
+		if _, err := ParseJWKS([]byte(jwks)); err == nil {
+			t.Errorf("ParseJWKS(%s) succeeded", jwks)
+		}
+	}
+}
+
+const testVKey = "example.com/witness+12345678+AQ=="
+
+func testPolicy() *Policy {
+	return &Policy{
+		Audience:       "confidential-witness",
+		ImageDigest:    "sha256:aaaa",
+		ImageReference: "ghcr.io/example/witness@sha256:aaaa",
+		RequireStable:  true,
+		SWName:         "CONFIDENTIAL_SPACE",
+		ProjectID:      "project",
+		ServiceAccount: "witness@project.iam.gserviceaccount.com",
+		Env: map[string]string{
+			"WITNESS_KEY":  "key",
+			"WITNESS_NAME": "name",
+		},
+		Nonces: []string{"0123456789", VKeyNonce(testVKey)},
+	}
+}
+
+// Returns the claims of a token that satisfies testPolicy.
+func testClaims(t *testing.T) *Claims {
+	t.Helper()
+	var c Claims
+	raw := `{
+		"iss": "https://confidentialcomputing.googleapis.com",
+		"aud": "confidential-witness",
+		"eat_nonce": ["0123456789", "` + VKeyNonce(testVKey) + `"],
+		"swname": "CONFIDENTIAL_SPACE",
+		"dbgstat": "disabled-since-boot",
+		"google_service_accounts": ["witness@project.iam.gserviceaccount.com"],
+		"submods": {
+			"container": {
+				"image_reference": "ghcr.io/example/witness@sha256:aaaa",
+				"image_digest": "sha256:aaaa",
+				"env": {"WITNESS_KEY": "key", "WITNESS_NAME": "name", "HOSTNAME": "vm"}
+			},
+			"gce": {"project_id": "project"},
+			"confidential_space": {"support_attributes": ["LATEST", "STABLE", "USABLE"]}
+		}
+	}`
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	if r := testPolicy().Evaluate(testClaims(t)); !r.Passed() {
+		t.Fatalf("Evaluate() of matching claims failed:\n%s", r)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// The check that fails.
+		check  string
+		claims func(c *Claims)
+		policy func(p *Policy)
+	}{
+		{name: "issuer", check: "issuer", claims: func(c *Claims) { c.Issuer = "https://accounts.google.com" }},
+		{name: "wrong audience", check: "audience", claims: func(c *Claims) { c.Audience = Strings{"//iam.googleapis.com/provider"} }},
+		{name: "nonce mismatch", check: "nonce", claims: func(c *Claims) { c.Nonces = Strings{"9876543210", VKeyNonce(testVKey)} }},
+		{name: "other witness key", check: "nonce", claims: func(c *Claims) { c.Nonces = Strings{"0123456789", VKeyNonce("other")} }},
+		{name: "image digest", check: "image_digest", claims: func(c *Claims) { c.Submods.Container.ImageDigest = "sha256:bbbb" }},
+		{name: "image reference", check: "image_reference", claims: func(c *Claims) { c.Submods.Container.ImageReference = "ghcr.io/example/witness:latest" }},
+		{name: "image not pinned", check: "image", policy: func(p *Policy) { p.ImageDigest, p.ImageReference = "", "" }},
+		{name: "not stable", check: "support_attributes", claims: func(c *Claims) { c.Submods.ConfidentialSpace.SupportAttributes = []string{"LATEST"} }},
+		{name: "debug image", check: "dbgstat", claims: func(c *Claims) { c.DebugStat = "enabled" }},
+		{name: "swname", check: "swname", claims: func(c *Claims) { c.SWName = "GCE" }},
+		{name: "project", check: "project_id", claims: func(c *Claims) { c.Submods.GCE.ProjectID = "other" }},
+		{name: "service account", check: "service_account", claims: func(c *Claims) { c.Accounts = []string{"other@project.iam.gserviceaccount.com"} }},
+		{name: "env value", check: "env.WITNESS_KEY", claims: func(c *Claims) { c.Submods.Container.Env["WITNESS_KEY"] = "other" }},
+		{name: "env missing", check: "env.WITNESS_NAME", claims: func(c *Claims) { delete(c.Submods.Container.Env, "WITNESS_NAME") }},
+		{name: "env unexpected", check: "env.WITNESS_PEERS", claims: func(c *Claims) { c.Submods.Container.Env["WITNESS_PEERS"] = "http://peer" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, p := testClaims(t), testPolicy()
+			if tc.claims != nil {
+				tc.claims(c)
+			}
+			if tc.policy != nil {
+				tc.policy(p)
+			}
+			r := p.Evaluate(c)
+			if r.Passed() {
+				t.Fatalf("Evaluate() passed:\n%s", r)
+			}
+			failed := false
+			for _, check := range r {
+				if check.Name == tc.check {
+					failed = failed || !check.Pass
+				} else if !check.Pass {
+					t.Errorf("check %s failed: %s", check.Name, check.Detail)
+				}
+			}
+			if !failed {
+				t.Errorf("check %s passed:\n%s", tc.check, r)
+			}
+		})
+	}
+
+	// Debug images are allowed when the policy does not require a stable one.
+	c, p := testClaims(t), testPolicy()
+	c.DebugStat = "enabled"
+	c.Submods.ConfidentialSpace.SupportAttributes = nil
+	p.RequireStable = false
+	if r := p.Evaluate(c); !r.Passed() {
+		t.Errorf("Evaluate() without require_stable failed:\n%s", r)
+	}
+}
@@ -0,0 +1,155 @@
+// Evaluates the claims of a token against the expected policy of a deployment.
+
+package attestation
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// Prefix of the environment variables of the witness, all of which a policy must cover.
+	envPrefix = "WITNESS_"
+	// dbgstat of production images, which the debug image does not carry.
+	debugDisabled = "disabled-since-boot"
+)
+
+// Policy is what the claims of a token are expected to be. Empty fields are
+// not checked, apart from Env, which covers every WITNESS_* variable.
+type Policy struct {
+	Audience string `json:"audience,omitempty"`
+	// The image is pinned by digest, by reference, or both.
+	ImageDigest    string `json:"image_digest,omitempty"`
+	ImageReference string `json:"image_reference,omitempty"`
+	// Whether the image must be a STABLE, production Confidential Space image,
+	// which has debugging disabled since boot.
+	RequireStable  bool              `json:"require_stable"`
+	SWName         string            `json:"swname,omitempty"`
+	ProjectID      string            `json:"project_id,omitempty"`
+	ServiceAccount string            `json:"service_account,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	// Nonces that the token must carry, such as the one chosen by the
+	// client and the binding to the witness key from VKeyNonce.
+	Nonces []string `json:"nonces,omitempty"`
+}
+
+// Check is the result of evaluating one part of a policy.
+type Check struct {
+	Name   string
+	Pass   bool
+	Detail string
+}
+
+type Report []Check
+
+// Passed reports whether every check passed.
+func (r Report) Passed() bool {
+	for _, c := range r {
+		if !c.Pass {
+			return false
+		}
+	}
+	return len(r) > 0
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	for _, c := range r {
+		result := "PASS"
+		if !c.Pass {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s  %-24s %s\n", result, c.Name, c.Detail)
+	}
+	return b.String()
+}
+
+// Evaluate checks claims against every part of the policy that is set.
+func (p *Policy) Evaluate(c *Claims) Report {
+	var r Report
+	r = append(r, equal("issuer", Issuer, c.Issuer))
+	if p.Audience != "" {
+		r = append(r, contains("audience", c.Audience, p.Audience))
+	}
+	if p.ImageDigest != "" {
+		r = append(r, equal("image_digest", p.ImageDigest, c.Submods.Container.ImageDigest))
+	}
+	if p.ImageReference != "" {
+		r = append(r, equal("image_reference", p.ImageReference, c.Submods.Container.ImageReference))
+	}
+	if p.ImageDigest == "" && p.ImageReference == "" {
+		r = append(r, Check{Name: "image", Detail: "policy pins neither image_digest nor image_reference"})
+	}
+	if p.RequireStable {
+		r = append(r, contains("support_attributes", c.Submods.ConfidentialSpace.SupportAttributes, "STABLE"))
+		r = append(r, equal("dbgstat", debugDisabled, c.DebugStat))
+	}
+	if p.SWName != "" {
+		r = append(r, equal("swname", p.SWName, c.SWName))
+	}
+	if p.ProjectID != "" {
+		r = append(r, equal("project_id", p.ProjectID, c.Submods.GCE.ProjectID))
+	}
+	if p.ServiceAccount != "" {
+		r = append(r, contains("service_account", c.Accounts, p.ServiceAccount))
+	}
+	for _, n := range p.Nonces {
+		r = append(r, contains("nonce", c.Nonces, n))
+	}
+	r = append(r, p.evaluateEnv(c.Submods.Container.Env)...)
+	return r
+}
+
+// Helper methods
+
+// Every WITNESS_* variable in the policy must be set to its value, and no
+// other WITNESS_* variable may be set at all.
+func (p *Policy) evaluateEnv(env map[string]string) Report {
+	names := make(map[string]bool)
+	for k := range p.Env {
+		names[k] = true
+	}
+	for k := range env {
+		if strings.HasPrefix(k, envPrefix) {
+			names[k] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var r Report
+	for _, k := range sorted {
+		want, expected := p.Env[k]
+		got, set := env[k]
+		switch {
+		case !expected:
+			r = append(r, Check{Name: "env." + k, Detail: fmt.Sprintf("unexpected variable set to %q", got)})
+		case !set:
+			r = append(r, Check{Name: "env." + k, Detail: fmt.Sprintf("not set, want %q", want)})
+		default:
+			r = append(r, equal("env."+k, want, got))
+		}
+	}
+	return r
+}
+
+/// Helper functions
+
+func equal(name, want, got string) Check {
+	if want != got {
+		return Check{Name: name, Detail: fmt.Sprintf("got %q, want %q", got, want)}
+	}
+	return Check{Name: name, Pass: true, Detail: got}
+}
+
+func contains(name string, got []string, want string) Check {
+	if !slices.Contains(got, want) {
+		return Check{Name: name, Detail: fmt.Sprintf("%q not in %q", want, got)}
+	}
+	return Check{Name: name, Pass: true, Detail: want}
+}
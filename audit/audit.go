@@ -0,0 +1,137 @@
+// Package audit checks that a sealed witness deployment is still configured
+// as it was sealed, from snapshots of its IAM policies, attestation identity
+// pool provider and admin activity log, as output by gcloud in JSON.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the files in a snapshot directory.
+const (
+	ProviderFile   = "provider.json"
+	KeyringIAMFile = "keyring-iam.json"
+	ProjectIAMFile = "project-iam.json"
+	ActivityFile   = "activity.json"
+)
+
+// Policy is an IAM policy, as output by get-iam-policy.
+type Policy struct {
+	Bindings []Binding `json:"bindings"`
+	Etag     string    `json:"etag,omitempty"`
+	Version  int       `json:"version,omitempty"`
+}
+
+type Binding struct {
+	Role      string   `json:"role"`
+	Members   []string `json:"members"`
+	Condition *struct {
+		Expression string `json:"expression"`
+		Title      string `json:"title,omitempty"`
+	} `json:"condition,omitempty"`
+}
+
+// Provider is a workload identity pool provider, as output by
+// gcloud iam workload-identity-pools providers describe.
+type Provider struct {
+	Name               string            `json:"name"`
+	State              string            `json:"state"`
+	Disabled           bool              `json:"disabled,omitempty"`
+	AttributeCondition string            `json:"attributeCondition"`
+	AttributeMapping   map[string]string `json:"attributeMapping"`
+	OIDC               struct {
+		IssuerURI        string   `json:"issuerUri"`
+		AllowedAudiences []string `json:"allowedAudiences"`
+	} `json:"oidc"`
+}
+
+// LogEntry is an admin activity audit log entry, as output by gcloud logging read.
+type LogEntry struct {
+	InsertID  string    `json:"insertId"`
+	Timestamp time.Time `json:"timestamp"`
+	Resource  struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"resource"`
+	ProtoPayload struct {
+		ServiceName        string `json:"serviceName"`
+		MethodName         string `json:"methodName"`
+		ResourceName       string `json:"resourceName"`
+		AuthenticationInfo struct {
+			PrincipalEmail string `json:"principalEmail"`
+		} `json:"authenticationInfo"`
+	} `json:"protoPayload"`
+}
+
+func (e LogEntry) String() string {
+	p := e.ProtoPayload
+	return fmt.Sprintf("%s %s %s on %s by %s", e.Timestamp.UTC().Format(time.RFC3339), p.ServiceName, p.MethodName, p.ResourceName, p.AuthenticationInfo.PrincipalEmail)
+}
+
+// Snapshot is the state of a deployment at one point in time.
+type Snapshot struct {
+	Provider   *Provider
+	KeyringIAM *Policy
+	ProjectIAM *Policy
+	Activity   []LogEntry
+}
+
+// LoadSnapshot reads a snapshot from the files in dir.
+func LoadSnapshot(dir string) (*Snapshot, error) {
+	var s Snapshot
+	for name, v := range map[string]any{
+		ProviderFile:   &s.Provider,
+		KeyringIAMFile: &s.KeyringIAM,
+		ProjectIAMFile: &s.ProjectIAM,
+		ActivityFile:   &s.Activity,
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+	}
+	if s.Provider == nil || s.KeyringIAM == nil || s.ProjectIAM == nil {
+		return nil, errors.New("snapshot is missing the provider or an IAM policy")
+	}
+	return &s, nil
+}
+
+// Check is the result of one part of an audit.
+type Check struct {
+	Name   string `json:"name"`
+	Pass   bool   `json:"pass"`
+	Detail string `json:"detail"`
+}
+
+type Report []Check
+
+// Passed reports whether every check passed.
+func (r Report) Passed() bool {
+	for _, c := range r {
+		if !c.Pass {
+			return false
+		}
+	}
+	return len(r) > 0
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	for _, c := range r {
+		result := "PASS"
+		if !c.Pass {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s  %-24s %s\n", result, c.Name, c.Detail)
+	}
+	return b.String()
+}
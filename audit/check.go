@@ -0,0 +1,359 @@
+// Checks a snapshot against the configuration that terraform seals a
+// deployment with, as described in terraform/main.tf and terraform/deployment.
+
+package audit
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The bootloader image that the deployment pins by default.
+	DefaultBootloader = "ghcr.io/aditsachde/confidential-witness@sha256:b634433ac01a0f43c05bbeb257044b990fee51a3128a5a5310192a5bddc9bc2d"
+
+	trustedPool   = "trusted-workload-pool"
+	githubPool    = "github-actions-pool"
+	providerID    = "attestation-verifier"
+	issuerURI     = "https://confidentialcomputing.googleapis.com/"
+	stsAudience   = "https://sts.googleapis.com"
+	signerRole    = "roles/cloudkms.signerVerifier"
+	providerState = "ACTIVE"
+)
+
+// OptionalEnv lists the variables that the bootloader allows to be set besides
+// WITNESS_KEY, WITNESS_NAME, WITNESS_AUDIENCE and WITNESS_VKEY. Each of them
+// changes what the witness trusts, so the condition pins it or requires it to be unset.
+var OptionalEnv = []string{
+	"WITNESS_STATE_DIR",
+	"WITNESS_STATE_BUCKET",
+	"WITNESS_COSIGNATURE_LOG_DIR",
+	"WITNESS_BOOTSTRAP_DISTRIBUTORS",
+	"WITNESS_BOOTSTRAP_WITNESSES",
+	"WITNESS_BOOTSTRAP_QUORUM",
+	"WITNESS_BOOTSTRAP_TIMEOUT",
+	"WITNESS_PEERS",
+	"WITNESS_ROUGHTIME_SERVERS",
+	"WITNESS_ROUGHTIME_THRESHOLD",
+	"WITNESS_ROUGHTIME_INTERVAL",
+	"WITNESS_ALERT_SINKS",
+	"WITNESS_ATTESTATION_AUDIENCE",
+}
+
+// Deployment identifies a sealed deployment, from which everything it is
+// expected to be configured with is derived.
+type Deployment struct {
+	ProjectID     string
+	ProjectNumber string
+	Region        string
+	Bootloader    string
+	// The verifier key of the witness, if it has been pinned.
+	VKey string
+	// The value of each variable in OptionalEnv that is set. The others must be unset.
+	Env map[string]string
+}
+
+func (d *Deployment) ServiceAccount() string {
+	return "witness-compute-engine@" + d.ProjectID + ".iam.gserviceaccount.com"
+}
+
+// ProviderName is the full name of the attestation identity pool provider.
+func (d *Deployment) ProviderName() string {
+	return d.poolName(trustedPool) + "/providers/" + providerID
+}
+
+func (d *Deployment) WitnessKey() string {
+	return fmt.Sprintf("projects/%s/locations/%s/keyRings/witness-keyring/cryptoKeys/witness-key/cryptoKeyVersions/1", d.ProjectID, d.Region)
+}
+
+// StateBucket is the name of the bucket that holds the sealed state.
+func (d *Deployment) StateBucket() string {
+	return d.ProjectID + "-witness-state"
+}
+
+func (d *Deployment) WitnessName() string {
+	return "ConfidentialWitness-" + d.ProjectID
+}
+
+func (d *Deployment) WitnessAudience() string {
+	return "//iam.googleapis.com/" + d.ProviderName()
+}
+
+// Condition returns the clauses of the attribute condition of the provider.
+func (d *Deployment) Condition() []string {
+	clauses := []string{
+		"'STABLE' in assertion.submods.confidential_space.support_attributes",
+		"assertion.swname=='CONFIDENTIAL_SPACE'",
+		"assertion.submods.container.image_reference=='" + d.Bootloader + "'",
+		"assertion.submods.gce.project_id=='" + d.ProjectID + "'",
+		"assertion.submods.container.env.WITNESS_KEY=='" + d.WitnessKey() + "'",
+		"assertion.submods.container.env.WITNESS_NAME=='" + d.WitnessName() + "'",
+		"assertion.submods.container.env.WITNESS_AUDIENCE=='" + d.WitnessAudience() + "'",
+	}
+	if d.VKey != "" {
+		clauses = append(clauses, "assertion.submods.container.env.WITNESS_VKEY=='"+d.VKey+"'")
+	}
+	for _, name := range OptionalEnv {
+		if value, ok := d.Env[name]; ok {
+			clauses = append(clauses, "assertion.submods.container.env."+name+"=='"+value+"'")
+		} else {
+			clauses = append(clauses, "!('"+name+"' in assertion.submods.container.env)")
+		}
+	}
+	return append(clauses, "'"+d.ServiceAccount()+"' in assertion.google_service_accounts")
+}
+
+// AttributeMapping returns the attribute mapping of the provider.
+func (d *Deployment) AttributeMapping() map[string]string {
+	return map[string]string{
+		"google.subject":         "assertion.sub",
+		"attribute.image_digest": "assertion.submods.container.image_digest",
+	}
+}
+
+// KeyringBindings returns the members of each role on the keyring.
+func (d *Deployment) KeyringBindings() map[string][]string {
+	return map[string][]string{
+		signerRole: {d.principalSet(trustedPool)},
+	}
+}
+
+// BucketBindings returns the members of each role on the state bucket.
+func (d *Deployment) BucketBindings() map[string][]string {
+	trusted := []string{d.principalSet(trustedPool)}
+	return map[string][]string{
+		"roles/storage.legacyBucketReader": trusted,
+		"roles/storage.objectUser":         trusted,
+	}
+}
+
+// ProjectBindings returns the members of each role on the project.
+func (d *Deployment) ProjectBindings() map[string][]string {
+	github := []string{d.principalSet(githubPool)}
+	return map[string][]string{
+		"roles/confidentialcomputing.workloadUser":       {"serviceAccount:" + d.ServiceAccount()},
+		"roles/compute.instanceGroupManagerServiceAgent": {"serviceAccount:" + d.ProjectNumber + "@cloudservices.gserviceaccount.com"},
+		"roles/cloudkms.publicKeyViewer":                 github,
+		"roles/logging.privateLogViewer":                 github,
+		"roles/iam.securityReviewer":                     github,
+		"roles/iam.workloadIdentityPoolViewer":           github,
+	}
+}
+
+// Check audits every part of a snapshot, ignoring activity before since.
+func (d *Deployment) Check(s *Snapshot, since time.Time) Report {
+	var r Report
+	r = append(r, d.CheckProvider(s.Provider)...)
+	r = append(r, d.CheckKeyringIAM(s.KeyringIAM)...)
+	r = append(r, d.CheckProjectIAM(s.ProjectIAM)...)
+	r = append(r, CheckActivity(s.Activity, since)...)
+	return r
+}
+
+// CheckProvider checks that the provider only accepts tokens of the pinned
+// workload, and that it is still in use.
+func (d *Deployment) CheckProvider(p *Provider) Report {
+	var r Report
+	r = append(r, equal("provider.name", d.ProviderName(), p.Name))
+	if p.Disabled {
+		r = append(r, Check{Name: "provider.state", Detail: "provider is disabled"})
+	} else {
+		r = append(r, equal("provider.state", providerState, p.State))
+	}
+	r = append(r, equal("provider.issuer", issuerURI, p.OIDC.IssuerURI))
+	r = append(r, equal("provider.audiences", stsAudience, strings.Join(p.OIDC.AllowedAudiences, ",")))
+	if want := d.AttributeMapping(); maps.Equal(want, p.AttributeMapping) {
+		r = append(r, Check{Name: "provider.mapping", Pass: true, Detail: fmt.Sprintf("%d attributes", len(want))})
+	} else {
+		r = append(r, Check{Name: "provider.mapping", Detail: fmt.Sprintf("got %v, want %v", p.AttributeMapping, want)})
+	}
+
+	missing, unexpected := diffSets(d.Condition(), SplitCondition(p.AttributeCondition))
+	for _, c := range missing {
+		r = append(r, Check{Name: "provider.condition", Detail: "missing " + c})
+	}
+	for _, c := range unexpected {
+		r = append(r, Check{Name: "provider.condition", Detail: "unexpected " + c})
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		r = append(r, Check{Name: "provider.condition", Pass: true, Detail: fmt.Sprintf("%d clauses", len(d.Condition()))})
+	}
+	return r
+}
+
+// CheckKeyringIAM checks that only the attested workload may sign with the key.
+func (d *Deployment) CheckKeyringIAM(p *Policy) Report {
+	return checkPolicy("keyring", p, d.KeyringBindings(), nil)
+}
+
+// CheckBucketIAM checks that only the attested workload may access the sealed state.
+func (d *Deployment) CheckBucketIAM(p *Policy) Report {
+	return checkPolicy("bucket", p, d.BucketBindings(), nil)
+}
+
+// CheckProjectIAM checks that the project has no roles beyond the minimal set,
+// apart from the service agents that Google grants itself when a service is enabled.
+func (d *Deployment) CheckProjectIAM(p *Policy) Report {
+	return checkPolicy("project", p, d.ProjectBindings(), d.isServiceAgent)
+}
+
+// CheckActivity flags every entry since the given time that touches IAM, KMS,
+// instance templates or the identity pools.
+func CheckActivity(entries []LogEntry, since time.Time) Report {
+	var r Report
+	checked := 0
+	for _, e := range entries {
+		if e.Timestamp.Before(since) {
+			continue
+		}
+		checked++
+		if what := e.Touches(); what != "" {
+			r = append(r, Check{Name: "activity", Detail: what + ": " + e.String()})
+		}
+	}
+	if len(r) == 0 {
+		r = append(r, Check{Name: "activity", Pass: true, Detail: fmt.Sprintf("%d entries, none sensitive", checked)})
+	}
+	return r
+}
+
+// Touches returns what sensitive part of the deployment the entry touches,
+// or the empty string if it touches none of them.
+func (e LogEntry) Touches() string {
+	p := e.ProtoPayload
+	method := strings.ToLower(p.MethodName)
+	switch {
+	case strings.Contains(method, "workloadidentitypool") || strings.Contains(strings.ToLower(p.ResourceName), "workloadidentitypools"):
+		return "identity pool"
+	case p.ServiceName == "cloudkms.googleapis.com":
+		return "KMS"
+	case strings.Contains(method, "instancetemplates"):
+		return "instance template"
+	case p.ServiceName == "iam.googleapis.com" || strings.Contains(method, "setiampolicy"):
+		return "IAM"
+	}
+	return ""
+}
+
+// SplitCondition splits a condition into its clauses joined by &&, with
+// whitespace normalized. A clause containing || is left whole, so that it
+// never matches an expected clause.
+func SplitCondition(condition string) []string {
+	var clauses []string
+	for _, c := range strings.Split(condition, "&&") {
+		if c = strings.Join(strings.Fields(c), " "); c != "" {
+			clauses = append(clauses, c)
+		}
+	}
+	return clauses
+}
+
+// Helper methods
+
+func (d *Deployment) poolName(pool string) string {
+	return "projects/" + d.ProjectNumber + "/locations/global/workloadIdentityPools/" + pool
+}
+
+func (d *Deployment) principalSet(pool string) string {
+	return "principalSet://iam.googleapis.com/" + d.poolName(pool) + "/*"
+}
+
+// Google-managed service agents of the project, which are granted a
+// serviceAgent role of their service whenever it is enabled.
+func (d *Deployment) isServiceAgent(role, member string) bool {
+	return (strings.HasSuffix(role, ".serviceAgent") || strings.HasSuffix(role, "ServiceAgent")) &&
+		strings.HasPrefix(member, "serviceAccount:service-"+d.ProjectNumber+"@") &&
+		strings.HasSuffix(member, ".iam.gserviceaccount.com")
+}
+
+/// Helper functions
+
+// Checks that the members of each role in a policy are exactly those in want,
+// other than members that allowed accepts. Conditional bindings are never expected.
+func checkPolicy(name string, p *Policy, want map[string][]string, allowed func(role, member string) bool) Report {
+	var r Report
+	got := BindingsByRole(p)
+	for _, b := range p.Bindings {
+		if b.Condition != nil {
+			r = append(r, Check{Name: name + ".condition", Detail: fmt.Sprintf("%s is conditional: %s", b.Role, b.Condition.Expression)})
+		}
+	}
+
+	for _, role := range sortedKeys(want, got) {
+		var extra []string
+		missing, unexpected := diffSets(want[role], got[role])
+		for _, m := range unexpected {
+			if allowed != nil && allowed(role, m) {
+				r = append(r, Check{Name: name + "." + role, Pass: true, Detail: m + " is a service agent"})
+			} else {
+				extra = append(extra, m)
+			}
+		}
+		switch {
+		case len(missing) > 0 || len(extra) > 0:
+			var detail []string
+			if len(missing) > 0 {
+				detail = append(detail, "missing "+strings.Join(missing, ", "))
+			}
+			if len(extra) > 0 {
+				detail = append(detail, "unexpected "+strings.Join(extra, ", "))
+			}
+			r = append(r, Check{Name: name + "." + role, Detail: strings.Join(detail, "; ")})
+		case len(want[role]) > 0:
+			r = append(r, Check{Name: name + "." + role, Pass: true, Detail: strings.Join(want[role], ", ")})
+		}
+	}
+	return r
+}
+
+// BindingsByRole returns the sorted members of each role in a policy.
+func BindingsByRole(p *Policy) map[string][]string {
+	roles := make(map[string][]string)
+	for _, b := range p.Bindings {
+		roles[b.Role] = append(roles[b.Role], b.Members...)
+	}
+	for role, members := range roles {
+		slices.Sort(members)
+		roles[role] = slices.Compact(members)
+	}
+	return roles
+}
+
+// Returns the elements of want that are not in got, and those of got that are not in want.
+func diffSets(want, got []string) (missing, unexpected []string) {
+	for _, w := range want {
+		if !slices.Contains(got, w) {
+			missing = append(missing, w)
+		}
+	}
+	for _, g := range got {
+		if !slices.Contains(want, g) {
+			unexpected = append(unexpected, g)
+		}
+	}
+	return missing, unexpected
+}
+
+func sortedKeys(ms ...map[string][]string) []string {
+	var keys []string
+	for _, m := range ms {
+		for k := range m {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equal(name, want, got string) Check {
+	if want != got {
+		return Check{Name: name, Detail: fmt.Sprintf("got %q, want %q", got, want)}
+	}
+	return Check{Name: name, Pass: true, Detail: got}
+}
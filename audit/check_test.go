@@ -0,0 +1,239 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDeployment() *Deployment {
+	return &Deployment{
+		ProjectID:     "project",
+		ProjectNumber: "123",
+		Region:        "us-east5",
+		Bootloader:    DefaultBootloader,
+	}
+}
+
+func TestConditionPinsEnv(t *testing.T) {
+	d := testDeployment()
+	d.Env = map[string]string{"WITNESS_PEERS": "https://peer.example.com"}
+	p := &Provider{
+		Name:               d.ProviderName(),
+		State:              providerState,
+		AttributeCondition: strings.Join(d.Condition(), " &&\n"),
+		AttributeMapping:   d.AttributeMapping(),
+	}
+	p.OIDC.IssuerURI = issuerURI
+	p.OIDC.AllowedAudiences = []string{stsAudience}
+	if r := d.CheckProvider(p); !r.Passed() {
+		t.Fatalf("CheckProvider() of the expected condition failed:\n%s", r)
+	}
+
+	condition := p.AttributeCondition
+	for _, tc := range []struct {
+		name      string
+		condition string
+	}{
+		{"other value", strings.ReplaceAll(condition, "https://peer.example.com", "https://evil.example.com")},
+		{"unpinned", strings.ReplaceAll(condition, "assertion.submods.container.env.WITNESS_PEERS=='https://peer.example.com' &&", "")},
+		{"unset not required", strings.ReplaceAll(condition, "!('WITNESS_STATE_BUCKET' in assertion.submods.container.env) &&", "")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.condition == condition {
+				t.Fatal("condition unchanged")
+			}
+			p.AttributeCondition = tc.condition
+			if r := d.CheckProvider(p); r.Passed() {
+				t.Errorf("CheckProvider() passed:\n%s", r)
+			}
+		})
+	}
+
+	// Every optional variable is either pinned or required to be unset.
+	for _, name := range OptionalEnv {
+		if !strings.Contains(condition, name) {
+			t.Errorf("condition does not cover %s", name)
+		}
+	}
+}
+
+// The deployment that testdata/snapshot was taken of, sealed at testSealed.
+func snapshotDeployment() *Deployment {
+	return &Deployment{
+		ProjectID:     "witness-project",
+		ProjectNumber: "123456789012",
+		Region:        "us-east5",
+		Bootloader:    DefaultBootloader,
+	}
+}
+
+var testSealed = time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)
+
+func loadTestSnapshot(t *testing.T) *Snapshot {
+	t.Helper()
+	s, err := LoadSnapshot("testdata/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Returns the checks of r that failed.
+func failed(r Report) Report {
+	var f Report
+	for _, c := range r {
+		if !c.Pass {
+			f = append(f, c)
+		}
+	}
+	return f
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	d := snapshotDeployment()
+	if r := d.Check(loadTestSnapshot(t), testSealed); !r.Passed() {
+		t.Fatalf("Check() of the sealed snapshot failed:\n%s", r)
+	}
+	// Activity while sealing is only ignored before -since.
+	if r := d.Check(loadTestSnapshot(t), time.Time{}); r.Passed() {
+		t.Errorf("Check() of the activity while sealing passed:\n%s", r)
+	}
+
+	for _, tc := range []struct {
+		name string
+		edit func(s *Snapshot)
+		// The name of the check that fails.
+		want string
+	}{
+		{
+			name: "STABLE clause dropped",
+			edit: func(s *Snapshot) {
+				s.Provider.AttributeCondition = strings.Replace(s.Provider.AttributeCondition, "'STABLE' in assertion.submods.confidential_space.support_attributes &&", "", 1)
+			},
+			want: "provider.condition",
+		},
+		{
+			name: "clause weakened with ||",
+			edit: func(s *Snapshot) {
+				s.Provider.AttributeCondition = strings.Replace(s.Provider.AttributeCondition, "assertion.swname=='CONFIDENTIAL_SPACE'", "assertion.swname=='CONFIDENTIAL_SPACE' || true", 1)
+			},
+			want: "provider.condition",
+		},
+		{
+			name: "condition rewritten with ||",
+			edit: func(s *Snapshot) {
+				s.Provider.AttributeCondition = "(" + s.Provider.AttributeCondition + ") || assertion.sub == 'attacker'"
+			},
+			want: "provider.condition",
+		},
+		{
+			name: "provider disabled",
+			edit: func(s *Snapshot) { s.Provider.Disabled = true },
+			want: "provider.state",
+		},
+		{
+			name: "mapping changed",
+			edit: func(s *Snapshot) { s.Provider.AttributeMapping["google.subject"] = "'attacker'" },
+			want: "provider.mapping",
+		},
+		{
+			name: "human owner",
+			edit: func(s *Snapshot) {
+				s.ProjectIAM.Bindings = append(s.ProjectIAM.Bindings, Binding{Role: "roles/owner", Members: []string{"user:owner@example.com"}})
+			},
+			want: "project.roles/owner",
+		},
+		{
+			name: "human signer",
+			edit: func(s *Snapshot) {
+				s.KeyringIAM.Bindings[0].Members = append(s.KeyringIAM.Bindings[0].Members, "user:owner@example.com")
+			},
+			want: "keyring.roles/cloudkms.signerVerifier",
+		},
+		{
+			name: "conditional binding",
+			edit: func(s *Snapshot) {
+				b := s.KeyringIAM.Bindings[0]
+				b.Condition = &struct {
+					Expression string `json:"expression"`
+					Title      string `json:"title,omitempty"`
+				}{Expression: "request.time < timestamp('2030-01-01T00:00:00Z')"}
+				s.KeyringIAM.Bindings = []Binding{b}
+			},
+			want: "keyring.condition",
+		},
+		{
+			name: "service agent of another project",
+			edit: func(s *Snapshot) {
+				s.ProjectIAM.Bindings = append(s.ProjectIAM.Bindings, Binding{Role: "roles/compute.serviceAgent", Members: []string{"serviceAccount:service-999@compute-system.iam.gserviceaccount.com"}})
+			},
+			want: "project.roles/compute.serviceAgent",
+		},
+		{
+			name: "service agent with another role",
+			edit: func(s *Snapshot) {
+				s.ProjectIAM.Bindings = append(s.ProjectIAM.Bindings, Binding{Role: "roles/editor", Members: []string{"serviceAccount:service-123456789012@compute-system.iam.gserviceaccount.com"}})
+			},
+			want: "project.roles/editor",
+		},
+		{
+			name: "new activity touching KMS",
+			edit: func(s *Snapshot) {
+				s.Activity = append(s.Activity, testLogEntry("-k1", "cloudkms.googleapis.com", "CreateCryptoKeyVersion"))
+			},
+			want: "activity",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := loadTestSnapshot(t)
+			tc.edit(s)
+			f := failed(d.Check(s, testSealed))
+			if len(f) == 0 {
+				t.Fatal("Check() passed")
+			}
+			for _, c := range f {
+				if c.Name != tc.want {
+					t.Errorf("check %s failed: %s", c.Name, c.Detail)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSnapshotServiceAgent(t *testing.T) {
+	// The service agent in the fixture is allowed, and says so.
+	r := snapshotDeployment().Check(loadTestSnapshot(t), testSealed)
+	for _, c := range r {
+		if c.Name == "project.roles/compute.serviceAgent" {
+			if !c.Pass || !strings.Contains(c.Detail, "service agent") {
+				t.Errorf("service agent check = %+v", c)
+			}
+			return
+		}
+	}
+	t.Errorf("no check for the service agent:\n%s", r)
+}
+
+func TestTouches(t *testing.T) {
+	for _, tc := range []struct {
+		service, method, resource string
+		want                      string
+	}{
+		{"cloudkms.googleapis.com", "AsymmetricSign", "", "KMS"},
+		{"iam.googleapis.com", "google.iam.v1.WorkloadIdentityPools.UpdateWorkloadIdentityPoolProvider", "", "identity pool"},
+		{"sts.googleapis.com", "ExchangeToken", "projects/1/locations/global/workloadIdentityPools/pool", "identity pool"},
+		{"compute.googleapis.com", "v1.compute.regionInstanceTemplates.insert", "", "instance template"},
+		{"cloudresourcemanager.googleapis.com", "SetIamPolicy", "", "IAM"},
+		{"iam.googleapis.com", "CreateServiceAccountKey", "", "IAM"},
+		{"compute.googleapis.com", "v1.compute.instances.start", "", ""},
+	} {
+		var e LogEntry
+		e.ProtoPayload.ServiceName = tc.service
+		e.ProtoPayload.MethodName = tc.method
+		e.ProtoPayload.ResourceName = tc.resource
+		if got := e.Touches(); got != tc.want {
+			t.Errorf("Touches() of %s %s = %q, want %q", tc.service, tc.method, got, tc.want)
+		}
+	}
+}
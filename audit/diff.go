@@ -0,0 +1,146 @@
+// Compares two snapshots of a deployment, to show what changed between them.
+
+package audit
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Diff is what changed between two snapshots. Etags and the order of
+// bindings, members and condition clauses are ignored.
+type Diff struct {
+	Provider    []Change      `json:"provider,omitempty"`
+	KeyringIAM  []Change      `json:"keyring_iam,omitempty"`
+	ProjectIAM  []Change      `json:"project_iam,omitempty"`
+	NewActivity []NewLogEntry `json:"new_activity,omitempty"`
+}
+
+// Change is a field of the provider, or a role of a policy, with the values
+// or members that were removed from it and added to it.
+type Change struct {
+	Field   string   `json:"field"`
+	Removed []string `json:"removed,omitempty"`
+	Added   []string `json:"added,omitempty"`
+}
+
+// NewLogEntry is an admin activity entry in the later snapshot but not the earlier one.
+type NewLogEntry struct {
+	LogEntry
+	// What sensitive part of the deployment the entry touches, if any.
+	Touches string `json:"touches,omitempty"`
+}
+
+// Compare returns the changes from before to after.
+func Compare(before, after *Snapshot) *Diff {
+	d := &Diff{
+		Provider:   compareProvider(before.Provider, after.Provider),
+		KeyringIAM: compareBindings(memberships(before.KeyringIAM), memberships(after.KeyringIAM)),
+		ProjectIAM: compareBindings(memberships(before.ProjectIAM), memberships(after.ProjectIAM)),
+	}
+	seen := make(map[string]bool)
+	for _, e := range before.Activity {
+		seen[e.InsertID] = true
+	}
+	for _, e := range after.Activity {
+		if !seen[e.InsertID] {
+			d.NewActivity = append(d.NewActivity, NewLogEntry{LogEntry: e, Touches: e.Touches()})
+		}
+	}
+	slices.SortFunc(d.NewActivity, func(a, b NewLogEntry) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return d
+}
+
+// Relevant reports whether the diff has a security-relevant change: any
+// change to the provider or an IAM policy, or new activity that touches
+// IAM, KMS, instance templates or the identity pools.
+func (d *Diff) Relevant() bool {
+	if len(d.Provider) > 0 || len(d.KeyringIAM) > 0 || len(d.ProjectIAM) > 0 {
+		return true
+	}
+	return slices.ContainsFunc(d.NewActivity, func(e NewLogEntry) bool {
+		return e.Touches != ""
+	})
+}
+
+func (d *Diff) String() string {
+	var b strings.Builder
+	for _, section := range []struct {
+		name    string
+		changes []Change
+	}{{"provider", d.Provider}, {"keyring", d.KeyringIAM}, {"project", d.ProjectIAM}} {
+		for _, c := range section.changes {
+			for _, v := range c.Removed {
+				fmt.Fprintf(&b, "- %s %s: %s\n", section.name, c.Field, v)
+			}
+			for _, v := range c.Added {
+				fmt.Fprintf(&b, "+ %s %s: %s\n", section.name, c.Field, v)
+			}
+		}
+	}
+	for _, e := range d.NewActivity {
+		touches := ""
+		if e.Touches != "" {
+			touches = " [" + e.Touches + "]"
+		}
+		fmt.Fprintf(&b, "+ activity %s%s\n", e, touches)
+	}
+	return b.String()
+}
+
+/// Helper functions
+
+func compareProvider(before, after *Provider) []Change {
+	var changes []Change
+	field := func(name string, before, after []string) {
+		if removed, added := diffSets(before, after); len(removed) > 0 || len(added) > 0 {
+			changes = append(changes, Change{Field: name, Removed: removed, Added: added})
+		}
+	}
+	field("name", []string{before.Name}, []string{after.Name})
+	field("state", []string{before.State}, []string{after.State})
+	field("disabled", []string{fmt.Sprint(before.Disabled)}, []string{fmt.Sprint(after.Disabled)})
+	field("issuer", []string{before.OIDC.IssuerURI}, []string{after.OIDC.IssuerURI})
+	field("audiences", before.OIDC.AllowedAudiences, after.OIDC.AllowedAudiences)
+	field("condition", SplitCondition(before.AttributeCondition), SplitCondition(after.AttributeCondition))
+	for _, k := range sortedKeys(mappingSets(before.AttributeMapping), mappingSets(after.AttributeMapping)) {
+		field("mapping."+k, mappingSets(before.AttributeMapping)[k], mappingSets(after.AttributeMapping)[k])
+	}
+	return changes
+}
+
+func compareBindings(before, after map[string][]string) []Change {
+	var changes []Change
+	for _, role := range sortedKeys(before, after) {
+		if removed, added := diffSets(before[role], after[role]); len(removed) > 0 || len(added) > 0 {
+			changes = append(changes, Change{Field: role, Removed: removed, Added: added})
+		}
+	}
+	return changes
+}
+
+// Returns the members of each role in a policy, with the condition of
+// conditional bindings appended to their members.
+func memberships(p *Policy) map[string][]string {
+	roles := make(map[string][]string)
+	for _, b := range p.Bindings {
+		for _, m := range b.Members {
+			if b.Condition != nil {
+				m += " if " + b.Condition.Expression
+			}
+			roles[b.Role] = append(roles[b.Role], m)
+		}
+	}
+	return roles
+}
+
+func mappingSets(m map[string]string) map[string][]string {
+	sets := make(map[string][]string, len(m))
+	for k, v := range m {
+		sets[k] = []string{v}
+	}
+	return sets
+}
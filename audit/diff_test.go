@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	before := loadTestSnapshot(t)
+	if d := Compare(before, loadTestSnapshot(t)); d.Relevant() || d.String() != "" {
+		t.Fatalf("Compare() of the snapshot with itself = %s", d)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		edit     func(s *Snapshot)
+		relevant bool
+		// A line of the diff.
+		want string
+	}{
+		{
+			name: "etags and order",
+			edit: func(s *Snapshot) {
+				s.ProjectIAM.Etag = "BwYnew="
+				slices.Reverse(s.ProjectIAM.Bindings)
+				for _, b := range s.ProjectIAM.Bindings {
+					slices.Reverse(b.Members)
+				}
+				clauses := SplitCondition(s.Provider.AttributeCondition)
+				slices.Reverse(clauses)
+				s.Provider.AttributeCondition = strings.Join(clauses, " && ")
+			},
+		},
+		{
+			name: "STABLE clause dropped",
+			edit: func(s *Snapshot) {
+				s.Provider.AttributeCondition = strings.Replace(s.Provider.AttributeCondition, "'STABLE' in assertion.submods.confidential_space.support_attributes &&", "", 1)
+			},
+			relevant: true,
+			want:     "- provider condition: 'STABLE' in assertion.submods.confidential_space.support_attributes",
+		},
+		{
+			name: "binding added",
+			edit: func(s *Snapshot) {
+				s.ProjectIAM.Bindings = append(s.ProjectIAM.Bindings, Binding{Role: "roles/owner", Members: []string{"user:owner@example.com"}})
+			},
+			relevant: true,
+			want:     "+ project roles/owner: user:owner@example.com",
+		},
+		{
+			name: "binding made conditional",
+			edit: func(s *Snapshot) {
+				b := s.KeyringIAM.Bindings[0]
+				b.Condition = &struct {
+					Expression string `json:"expression"`
+					Title      string `json:"title,omitempty"`
+				}{Expression: "true"}
+				s.KeyringIAM.Bindings = []Binding{b}
+			},
+			relevant: true,
+			want:     " if true",
+		},
+		{
+			name: "new activity touching KMS",
+			edit: func(s *Snapshot) {
+				s.Activity = append(s.Activity, testLogEntry("-k1", "cloudkms.googleapis.com", "CreateCryptoKeyVersion"))
+			},
+			relevant: true,
+			want:     "[KMS]",
+		},
+		{
+			name: "new benign activity",
+			edit: func(s *Snapshot) {
+				s.Activity = append(s.Activity, testLogEntry("-a2", "compute.googleapis.com", "v1.compute.instances.reset"))
+			},
+			want: "+ activity ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			after := loadTestSnapshot(t)
+			tc.edit(after)
+			d := Compare(before, after)
+			if d.Relevant() != tc.relevant {
+				t.Errorf("Relevant() = %v, want %v:\n%s", d.Relevant(), tc.relevant, d)
+			}
+			if tc.want == "" && d.String() != "" {
+				t.Errorf("Compare() = %s, want no changes", d)
+			}
+			if !strings.Contains(d.String(), tc.want) {
+				t.Errorf("Compare() = %s, want %q", d, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompareActivityOrder(t *testing.T) {
+	before := loadTestSnapshot(t)
+	after := loadTestSnapshot(t)
+	later := testLogEntry("-a3", "compute.googleapis.com", "v1.compute.instances.stop")
+	later.Timestamp = later.Timestamp.Add(time.Hour)
+	after.Activity = append([]LogEntry{later, testLogEntry("-a2", "compute.googleapis.com", "v1.compute.instances.reset")}, after.Activity...)
+
+	d := Compare(before, after)
+	if len(d.NewActivity) != 2 || d.NewActivity[0].InsertID != "-a2" || d.NewActivity[1].InsertID != "-a3" {
+		t.Errorf("Compare() = %+v, want -a2 then -a3", d.NewActivity)
+	}
+}
+
+// Returns an admin activity entry a day after the snapshot was sealed.
+func testLogEntry(id, service, method string) LogEntry {
+	var e LogEntry
+	e.InsertID = id
+	e.Timestamp = testSealed.Add(24 * time.Hour)
+	e.ProtoPayload.ServiceName = service
+	e.ProtoPayload.MethodName = method
+	return e
+}
@@ -0,0 +1,346 @@
+// Checks the invariants of a deployment against the output of
+// terraform show -json, for either a saved plan or the current state, so that
+// a change to the terraform configuration that would weaken the seal is
+// caught before it is applied.
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// The production Confidential Space image family, as opposed to the debug one.
+	confidentialSpaceImage = "projects/confidential-space-images/global/images/family/confidential-space"
+
+	teeEnvPrefix = "tee-env-"
+)
+
+// IAM resources that grant roles alongside the authoritative policies, and
+// so must never be part of the deployment.
+var additiveIAM = []string{
+	"google_project_iam_member",
+	"google_project_iam_binding",
+	"google_kms_key_ring_iam_member",
+	"google_kms_key_ring_iam_binding",
+	"google_kms_crypto_key_iam_policy",
+	"google_kms_crypto_key_iam_member",
+	"google_kms_crypto_key_iam_binding",
+	"google_service_account_iam_policy",
+	"google_service_account_iam_member",
+	"google_service_account_iam_binding",
+	"google_iam_workload_identity_pool_iam_policy",
+	"google_iam_workload_identity_pool_iam_member",
+	"google_iam_workload_identity_pool_iam_binding",
+	"google_storage_bucket_iam_member",
+	"google_storage_bucket_iam_binding",
+}
+
+// Terraform holds the resources of a plan or state, as output by terraform show -json.
+type Terraform struct {
+	resources []tfResource
+}
+
+type tfResource struct {
+	Address string         `json:"address"`
+	Mode    string         `json:"mode"`
+	Type    string         `json:"type"`
+	Values  map[string]any `json:"values"`
+}
+
+type tfModule struct {
+	Resources    []tfResource `json:"resources"`
+	ChildModules []tfModule   `json:"child_modules"`
+}
+
+type tfValues struct {
+	RootModule tfModule `json:"root_module"`
+}
+
+// ParseTerraform parses the output of terraform show -json. For a plan, the
+// planned values are used, along with the data sources read while planning.
+// The managed resources of the prior state are ignored, as the plan may
+// destroy them.
+func ParseTerraform(data []byte) (*Terraform, error) {
+	var show struct {
+		Values        *tfValues `json:"values"`
+		PlannedValues *tfValues `json:"planned_values"`
+		PriorState    *struct {
+			Values *tfValues `json:"values"`
+		} `json:"prior_state"`
+	}
+	if err := json.Unmarshal(data, &show); err != nil {
+		return nil, fmt.Errorf("failed to parse terraform output: %w", err)
+	}
+
+	t := &Terraform{}
+	seen := make(map[string]bool)
+	for _, v := range []*tfValues{show.PlannedValues, show.Values} {
+		if v != nil {
+			t.add(v.RootModule, seen, false)
+		}
+	}
+	if show.PriorState != nil && show.PriorState.Values != nil {
+		t.add(show.PriorState.Values.RootModule, seen, true)
+	}
+	if len(t.resources) == 0 {
+		return nil, errors.New("terraform output has no resources")
+	}
+	return t, nil
+}
+
+// Deployment derives the deployment from the project and keyring in the
+// terraform output. bootloader is the image it must pin, and vkey, if not
+// empty, the verifier key it must pin. The verifier key is never taken from
+// the terraform output itself, as then any key would pass, so it is an error
+// for the condition or the instance template to pin one that vkey does not
+// give. env holds the values of the variables in OptionalEnv that must be
+// pinned, all others must be unset.
+func (t *Terraform) Deployment(bootloader, vkey string, env map[string]string) (*Deployment, error) {
+	// Both the root module and the deployment module read the project.
+	var project map[string]any
+	for _, res := range t.resources {
+		if res.Type != "google_project" {
+			continue
+		}
+		if project != nil && (str(res.Values, "project_id") != str(project, "project_id") || str(res.Values, "number") != str(project, "number")) {
+			return nil, errors.New("terraform output reads more than one project")
+		}
+		project = res.Values
+	}
+	keyring := t.one("google_kms_key_ring", nil)
+	if project == nil || keyring == nil {
+		return nil, errors.New("terraform output has no project data source or no single keyring")
+	}
+	d := &Deployment{
+		ProjectID:     str(project, "project_id"),
+		ProjectNumber: str(project, "number"),
+		Region:        str(keyring.Values, "location"),
+		Bootloader:    bootloader,
+		VKey:          vkey,
+		Env:           env,
+	}
+	if d.ProjectID == "" || d.ProjectNumber == "" || d.Region == "" {
+		return nil, errors.New("terraform output does not know the project ID, project number or keyring location")
+	}
+	if d.VKey == "" && t.pinsVKey() {
+		return nil, errors.New("terraform output pins a verifier key, which must be given to check it against")
+	}
+	return d, nil
+}
+
+// CheckTerraform checks that the planned or applied configuration seals the deployment.
+func (d *Deployment) CheckTerraform(t *Terraform) Report {
+	var r Report
+	if p := t.provider(); p == nil {
+		r = append(r, Check{Name: "provider", Detail: "no single attestation-verifier provider"})
+	} else {
+		r = append(r, d.CheckProvider(p)...)
+	}
+	r = append(r, t.checkPolicy("google_kms_key_ring_iam_policy", d.CheckKeyringIAM)...)
+	r = append(r, t.checkPolicy("google_project_iam_policy", d.CheckProjectIAM)...)
+	r = append(r, t.checkPolicy("google_storage_bucket_iam_policy", d.CheckBucketIAM)...)
+	if res := t.one("google_storage_bucket_iam_policy", nil); res != nil {
+		r = append(r, equal("bucket.name", d.StateBucket(), strings.TrimPrefix(str(res.Values, "bucket"), "b/")))
+	}
+	r = append(r, d.checkTemplate(t.template())...)
+
+	for _, res := range t.resources {
+		for _, typ := range additiveIAM {
+			if res.Type == typ {
+				r = append(r, Check{Name: "terraform.iam", Detail: "unexpected " + res.Address})
+			}
+		}
+	}
+	return r
+}
+
+// Helper methods
+
+// Adds the resources of a module and its children, or only the data
+// resources if dataOnly is set, skipping addresses already seen in an earlier source.
+func (t *Terraform) add(m tfModule, seen map[string]bool, dataOnly bool) {
+	for _, res := range m.Resources {
+		if !seen[res.Address] && (!dataOnly || res.Mode == "data") {
+			seen[res.Address] = true
+			t.resources = append(t.resources, res)
+		}
+	}
+	for _, child := range m.ChildModules {
+		t.add(child, seen, dataOnly)
+	}
+}
+
+// Returns the only resource of a type that match accepts, or nil if there is not exactly one.
+func (t *Terraform) one(typ string, match func(values map[string]any) bool) *tfResource {
+	var found []*tfResource
+	for i, res := range t.resources {
+		if res.Type == typ && (match == nil || match(res.Values)) {
+			found = append(found, &t.resources[i])
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+func (t *Terraform) provider() *Provider {
+	res := t.one("google_iam_workload_identity_pool_provider", func(v map[string]any) bool {
+		return str(v, "workload_identity_pool_provider_id") == providerID
+	})
+	if res == nil {
+		return nil
+	}
+	p := &Provider{
+		Name:               str(res.Values, "name"),
+		State:              str(res.Values, "state"),
+		AttributeCondition: str(res.Values, "attribute_condition"),
+		AttributeMapping:   make(map[string]string),
+	}
+	p.Disabled, _ = res.Values["disabled"].(bool)
+	for k, v := range mapping(res.Values, "attribute_mapping") {
+		p.AttributeMapping[k], _ = v.(string)
+	}
+	if oidc := blocks(res.Values, "oidc"); len(oidc) == 1 {
+		p.OIDC.IssuerURI = str(oidc[0], "issuer_uri")
+		p.OIDC.AllowedAudiences = strs(oidc[0], "allowed_audiences")
+	}
+	return p
+}
+
+func (t *Terraform) template() *tfResource {
+	res := t.one("google_compute_region_instance_template", nil)
+	if res == nil {
+		res = t.one("google_compute_instance_template", nil)
+	}
+	return res
+}
+
+// Reports whether the provider condition or an instance template pins WITNESS_VKEY.
+func (t *Terraform) pinsVKey() bool {
+	for _, res := range t.resources {
+		switch res.Type {
+		case "google_iam_workload_identity_pool_provider":
+			if strings.Contains(str(res.Values, "attribute_condition"), "WITNESS_VKEY") {
+				return true
+			}
+		case "google_compute_region_instance_template", "google_compute_instance_template":
+			if _, ok := mapping(res.Values, "metadata")[teeEnvPrefix+"WITNESS_VKEY"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks the policy_data of the only resource of an authoritative IAM policy type.
+func (t *Terraform) checkPolicy(typ string, check func(*Policy) Report) Report {
+	res := t.one(typ, nil)
+	if res == nil {
+		return Report{{Name: "terraform.iam", Detail: "no single " + typ}}
+	}
+	var p Policy
+	if err := json.Unmarshal([]byte(str(res.Values, "policy_data")), &p); err != nil {
+		return Report{{Name: "terraform.iam", Detail: fmt.Sprintf("unknown or invalid policy_data of %s: %v", res.Address, err)}}
+	}
+	return check(&p)
+}
+
+// Checks that the instance template launches the pinned bootloader on the
+// production image, with exactly the environment pinned by the condition.
+func (d *Deployment) checkTemplate(res *tfResource) Report {
+	if res == nil {
+		return Report{{Name: "template", Detail: "no single instance template"}}
+	}
+	var r Report
+	metadata := mapping(res.Values, "metadata")
+	r = append(r, equal("template.image_reference", d.Bootloader, str(metadata, "tee-image-reference")))
+
+	want := map[string]string{
+		"WITNESS_KEY":      d.WitnessKey(),
+		"WITNESS_NAME":     d.WitnessName(),
+		"WITNESS_AUDIENCE": d.WitnessAudience(),
+	}
+	if d.VKey != "" {
+		want["WITNESS_VKEY"] = d.VKey
+	}
+	for name, value := range d.Env {
+		want[name] = value
+	}
+	names := make(map[string]bool)
+	for k := range want {
+		names[k] = true
+	}
+	for k := range metadata {
+		if name, ok := strings.CutPrefix(k, teeEnvPrefix); ok {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		got := str(metadata, teeEnvPrefix+name)
+		if _, expected := want[name]; !expected {
+			r = append(r, Check{Name: "template.env." + name, Detail: fmt.Sprintf("unexpected variable set to %q", got)})
+		} else {
+			r = append(r, equal("template.env."+name, want[name], got))
+		}
+	}
+
+	boot := 0
+	for _, disk := range blocks(res.Values, "disk") {
+		if isBoot, _ := disk["boot"].(bool); !isBoot {
+			continue
+		}
+		boot++
+		r = append(r, equal("template.image", confidentialSpaceImage, str(disk, "source_image")))
+	}
+	if boot != 1 {
+		r = append(r, Check{Name: "template.image", Detail: fmt.Sprintf("%d boot disks, want 1", boot)})
+	}
+	return r
+}
+
+/// Helper functions
+
+// Values that are unknown in a plan are absent, and so read as empty.
+
+func str(values map[string]any, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
+
+func strs(values map[string]any, key string) []string {
+	var ss []string
+	list, _ := values[key].([]any)
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+func mapping(values map[string]any, key string) map[string]any {
+	m, _ := values[key].(map[string]any)
+	return m
+}
+
+func blocks(values map[string]any, key string) []map[string]any {
+	var bs []map[string]any
+	list, _ := values[key].([]any)
+	for _, v := range list {
+		if b, ok := v.(map[string]any); ok {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
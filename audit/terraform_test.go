@@ -0,0 +1,356 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testTerraformVKey = "witness-project+12345678+AQ=="
+
+// Parses testdata/terraform/plan.json, a plan of the deployment that
+// testdata/snapshot was taken of.
+func loadTestTerraform(t *testing.T) *Terraform {
+	t.Helper()
+	return loadTestPlan(t, nil)
+}
+
+// Parses testdata/terraform/plan.json after edit, if set, changes the plan as decoded.
+func loadTestPlan(t *testing.T, edit func(plan map[string]any)) *Terraform {
+	t.Helper()
+	data, err := os.ReadFile("testdata/terraform/plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		var plan map[string]any
+		if err := json.Unmarshal(data, &plan); err != nil {
+			t.Fatal(err)
+		}
+		edit(plan)
+		if data, err = json.Marshal(plan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf, err := ParseTerraform(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+// Returns the values of the only resource of a type, which edits change in place.
+func (tf *Terraform) testValues(t *testing.T, typ string) map[string]any {
+	t.Helper()
+	res := tf.one(typ, nil)
+	if res == nil {
+		t.Fatalf("no single %s", typ)
+	}
+	return res.Values
+}
+
+func (tf *Terraform) testEditPolicy(t *testing.T, typ string, edit func(p *Policy)) {
+	t.Helper()
+	values := tf.testValues(t, typ)
+	var p Policy
+	if err := json.Unmarshal([]byte(str(values, "policy_data")), &p); err != nil {
+		t.Fatal(err)
+	}
+	edit(&p)
+	data, _ := json.Marshal(p)
+	values["policy_data"] = string(data)
+}
+
+func (tf *Terraform) testEditCondition(t *testing.T, old, new string) {
+	t.Helper()
+	res := tf.one("google_iam_workload_identity_pool_provider", func(v map[string]any) bool {
+		return str(v, "workload_identity_pool_provider_id") == providerID
+	})
+	if res == nil {
+		t.Fatal("no single attestation-verifier provider")
+	}
+	values := res.Values
+	condition := str(values, "attribute_condition")
+	if !strings.Contains(condition, old) {
+		t.Fatalf("condition does not contain %q", old)
+	}
+	values["attribute_condition"] = strings.Replace(condition, old, new, 1)
+}
+
+func (tf *Terraform) testSetEnv(t *testing.T, name, value string) {
+	t.Helper()
+	mapping(tf.testValues(t, "google_compute_region_instance_template"), "metadata")[teeEnvPrefix+name] = value
+}
+
+func TestTerraformDeployment(t *testing.T) {
+	d, err := loadTestTerraform(t).Deployment(DefaultBootloader, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := snapshotDeployment()
+	if d.ProjectID != want.ProjectID || d.ProjectNumber != want.ProjectNumber || d.Region != want.Region || d.VKey != "" {
+		t.Errorf("Deployment() = %+v, want %+v", d, want)
+	}
+
+	// The verifier key is never taken from the terraform output.
+	for _, tc := range []struct {
+		name string
+		edit func(tf *Terraform)
+	}{
+		{"pinned by the condition", func(tf *Terraform) {
+			tf.testEditCondition(t, "assertion.swname=='CONFIDENTIAL_SPACE'", "assertion.swname=='CONFIDENTIAL_SPACE' &&\nassertion.submods.container.env.WITNESS_VKEY=='"+testTerraformVKey+"'")
+		}},
+		{"launched by the template", func(tf *Terraform) { tf.testSetEnv(t, "WITNESS_VKEY", testTerraformVKey) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := loadTestTerraform(t)
+			tc.edit(tf)
+			if d, err := tf.Deployment(DefaultBootloader, "", nil); err == nil {
+				t.Errorf("Deployment() without a verifier key = %+v", d)
+			}
+			if _, err := tf.Deployment(DefaultBootloader, testTerraformVKey, nil); err != nil {
+				t.Errorf("Deployment() with a verifier key = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckTerraform(t *testing.T) {
+	tf := loadTestTerraform(t)
+	d, err := tf.Deployment(DefaultBootloader, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := d.CheckTerraform(tf); !r.Passed() {
+		t.Fatalf("CheckTerraform() of the plan failed:\n%s", r)
+	}
+
+	const vkeyClause = "assertion.submods.container.env.WITNESS_VKEY=='" + testTerraformVKey + "'"
+	pinVKey := func(t *testing.T, tf *Terraform) {
+		tf.testEditCondition(t, "assertion.swname=='CONFIDENTIAL_SPACE'", "assertion.swname=='CONFIDENTIAL_SPACE' &&\n"+vkeyClause)
+		tf.testSetEnv(t, "WITNESS_VKEY", testTerraformVKey)
+	}
+	const peersClause = "assertion.submods.container.env.WITNESS_PEERS=='https://peer.example.com'"
+	pinPeers := func(t *testing.T, tf *Terraform) {
+		tf.testEditCondition(t, "!('WITNESS_PEERS' in assertion.submods.container.env)", peersClause)
+	}
+
+	for _, tc := range []struct {
+		name string
+		edit func(t *testing.T, tf *Terraform)
+		vkey string
+		env  map[string]string
+		// The name of the check that fails, or empty if all pass.
+		want string
+	}{
+		{
+			name: "verifier key pinned",
+			edit: pinVKey,
+			vkey: testTerraformVKey,
+		},
+		{
+			name: "verifier key of the template differs",
+			edit: func(t *testing.T, tf *Terraform) {
+				pinVKey(t, tf)
+				tf.testSetEnv(t, "WITNESS_VKEY", "other+12345678+AQ==")
+			},
+			vkey: testTerraformVKey,
+			want: "template.env.WITNESS_VKEY",
+		},
+		{
+			name: "verifier key of the condition differs",
+			edit: func(t *testing.T, tf *Terraform) {
+				pinVKey(t, tf)
+				tf.testEditCondition(t, testTerraformVKey, "other+12345678+AQ==")
+			},
+			vkey: testTerraformVKey,
+			want: "provider.condition",
+		},
+		{
+			name: "verifier key not pinned by the condition",
+			edit: func(t *testing.T, tf *Terraform) { tf.testSetEnv(t, "WITNESS_VKEY", testTerraformVKey) },
+			vkey: testTerraformVKey,
+			want: "provider.condition",
+		},
+		{
+			name: "variable pinned",
+			edit: func(t *testing.T, tf *Terraform) {
+				pinPeers(t, tf)
+				tf.testSetEnv(t, "WITNESS_PEERS", "https://peer.example.com")
+			},
+			env: map[string]string{"WITNESS_PEERS": "https://peer.example.com"},
+		},
+		{
+			name: "variable of the template differs",
+			edit: func(t *testing.T, tf *Terraform) {
+				pinPeers(t, tf)
+				tf.testSetEnv(t, "WITNESS_PEERS", "https://evil.example.com")
+			},
+			env:  map[string]string{"WITNESS_PEERS": "https://peer.example.com"},
+			want: "template.env.WITNESS_PEERS",
+		},
+		{
+			name: "unexpected variable",
+			edit: func(t *testing.T, tf *Terraform) { tf.testSetEnv(t, "WITNESS_INSECURE_DEV_MODE", "true") },
+			want: "template.env.WITNESS_INSECURE_DEV_MODE",
+		},
+		{
+			name: "STABLE clause dropped",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testEditCondition(t, "'STABLE' in assertion.submods.confidential_space.support_attributes &&", "")
+			},
+			want: "provider.condition",
+		},
+		{
+			name: "clause weakened with ||",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testEditCondition(t, "assertion.swname=='CONFIDENTIAL_SPACE'", "assertion.swname=='CONFIDENTIAL_SPACE' || true")
+			},
+			want: "provider.condition",
+		},
+		{
+			name: "human owner",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testEditPolicy(t, "google_project_iam_policy", func(p *Policy) {
+					p.Bindings = append(p.Bindings, Binding{Role: "roles/owner", Members: []string{"user:owner@example.com"}})
+				})
+			},
+			want: "project.roles/owner",
+		},
+		{
+			name: "human signer",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testEditPolicy(t, "google_kms_key_ring_iam_policy", func(p *Policy) {
+					p.Bindings[0].Members = append(p.Bindings[0].Members, "user:owner@example.com")
+				})
+			},
+			want: "keyring.roles/cloudkms.signerVerifier",
+		},
+		{
+			name: "human state object admin",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testEditPolicy(t, "google_storage_bucket_iam_policy", func(p *Policy) {
+					p.Bindings = append(p.Bindings, Binding{Role: "roles/storage.objectAdmin", Members: []string{"user:owner@example.com"}})
+				})
+			},
+			want: "bucket.roles/storage.objectAdmin",
+		},
+		{
+			name: "policy of another bucket",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.testValues(t, "google_storage_bucket_iam_policy")["bucket"] = "b/other-bucket"
+			},
+			want: "bucket.name",
+		},
+		{
+			name: "additive IAM",
+			edit: func(t *testing.T, tf *Terraform) {
+				tf.resources = append(tf.resources, tfResource{
+					Address: "google_project_iam_member.owner",
+					Type:    "google_project_iam_member",
+					Values:  map[string]any{"role": "roles/owner", "member": "user:owner@example.com"},
+				})
+			},
+			want: "terraform.iam",
+		},
+		{
+			name: "other bootloader",
+			edit: func(t *testing.T, tf *Terraform) {
+				mapping(tf.testValues(t, "google_compute_region_instance_template"), "metadata")["tee-image-reference"] = "ghcr.io/aditsachde/confidential-witness:latest"
+			},
+			want: "template.image_reference",
+		},
+		{
+			name: "debug image",
+			edit: func(t *testing.T, tf *Terraform) {
+				disks := blocks(tf.testValues(t, "google_compute_region_instance_template"), "disk")
+				disks[0]["source_image"] = "projects/confidential-space-images/global/images/family/confidential-space-debug"
+			},
+			want: "template.image",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tf := loadTestTerraform(t)
+			tc.edit(t, tf)
+			d, err := tf.Deployment(DefaultBootloader, tc.vkey, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := d.CheckTerraform(tf)
+			if tc.want == "" {
+				if !r.Passed() {
+					t.Errorf("CheckTerraform() failed:\n%s", r)
+				}
+				return
+			}
+			f := failed(r)
+			if len(f) == 0 {
+				t.Fatal("CheckTerraform() passed")
+			}
+			for _, c := range f {
+				if c.Name != tc.want {
+					t.Errorf("check %s failed: %s", c.Name, c.Detail)
+				}
+			}
+		})
+	}
+}
+
+// Removes a resource from the planned values, as a plan that destroys it does.
+func testDestroy(t *testing.T, plan map[string]any, address string) {
+	t.Helper()
+	var remove func(m map[string]any) bool
+	remove = func(m map[string]any) bool {
+		resources, _ := m["resources"].([]any)
+		for i, res := range resources {
+			if res.(map[string]any)["address"] == address {
+				m["resources"] = append(resources[:i], resources[i+1:]...)
+				return true
+			}
+		}
+		children, _ := m["child_modules"].([]any)
+		for _, child := range children {
+			if remove(child.(map[string]any)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !remove(mapping(mapping(plan, "planned_values"), "root_module")) {
+		t.Fatalf("%s is not planned", address)
+	}
+	for _, c := range blocks(plan, "resource_changes") {
+		if c["address"] == address {
+			change := mapping(c, "change")
+			change["actions"] = []any{"delete"}
+			change["after"] = nil
+		}
+	}
+}
+
+func TestCheckTerraformDestroy(t *testing.T) {
+	for _, address := range []string{
+		"google_project_iam_policy.minimal_roles",
+		"module.deployment.google_kms_key_ring_iam_policy.trusted_workload_binding",
+		"module.deployment.google_storage_bucket_iam_policy.trusted_workload_state_binding",
+	} {
+		t.Run(address, func(t *testing.T) {
+			tf := loadTestPlan(t, func(plan map[string]any) { testDestroy(t, plan, address) })
+			d, err := tf.Deployment(DefaultBootloader, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := d.CheckTerraform(tf)
+			f := failed(r)
+			if len(f) == 0 {
+				t.Fatal("CheckTerraform() of a plan that destroys the policy passed")
+			}
+			for _, c := range f {
+				if c.Name != "terraform.iam" {
+					t.Errorf("check %s failed: %s", c.Name, c.Detail)
+				}
+			}
+		})
+	}
+}
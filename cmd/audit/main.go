@@ -0,0 +1,224 @@
+// Audits a sealed deployment from snapshots of its attestation identity pool
+// provider, keyring and project IAM policies and admin activity log.
+//
+// Usage:
+//
+//	audit fetch -project id -region region -out dir
+//	audit check -project id -project-number n -region region [-bootloader ref] [-vkey vkey] [-env name=value]... [-since time] [-json] dir
+//	audit diff [-json] before after
+//	audit terraform [-bootloader ref] [-vkey vkey] [-env name=value]... [-json] show.json
+//
+// fetch saves a snapshot with gcloud, which must be logged in as a principal
+// that can read the policies and logs, such as the auditing identity pool.
+// check runs offline against a saved snapshot, printing a report and exiting
+// non-zero if the configuration differs from the sealed deployment or any
+// activity since -since touches IAM, KMS, instance templates or the identity pools.
+// diff compares two snapshots, printing the changes to the provider and IAM
+// policies and the new activity between them, and exits non-zero if any of
+// them is security-relevant. terraform checks the same invariants against the
+// output of terraform show -json for a plan or the state, along with the
+// instance template, and exits non-zero if the configuration would weaken them.
+//
+// Each -env pins a variable in audit.OptionalEnv to a value. Every one of them
+// that is not given must be unset.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/audit"
+)
+
+const usage = "Usage: audit (fetch | check | diff | terraform) [flags]"
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalln(usage)
+	}
+	switch os.Args[1] {
+	case "fetch":
+		fetch(os.Args[2:])
+	case "check":
+		check(os.Args[2:])
+	case "diff":
+		diff(os.Args[2:])
+	case "terraform":
+		terraform(os.Args[2:])
+	default:
+		log.Fatalln(usage)
+	}
+}
+
+func fetch(args []string) {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	project := fs.String("project", "", "ID of the project of the deployment")
+	region := fs.String("region", "", "region of the keyring")
+	out := fs.String("out", "", "directory to save the snapshot to")
+	fs.Parse(args)
+	if *project == "" || *region == "" || *out == "" {
+		log.Fatalln("Usage: audit fetch -project id -region region -out dir")
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalln("Failed to create snapshot directory:", err)
+	}
+	for name, cmd := range map[string][]string{
+		audit.ProviderFile: {"iam", "workload-identity-pools", "providers", "describe", "attestation-verifier",
+			"--workload-identity-pool=trusted-workload-pool", "--location=global"},
+		audit.KeyringIAMFile: {"kms", "keyrings", "get-iam-policy", "witness-keyring", "--location=" + *region},
+		audit.ProjectIAMFile: {"projects", "get-iam-policy", *project},
+		audit.ActivityFile: {"logging", "read", "logName=projects/" + *project + "/logs/cloudaudit.googleapis.com%2Factivity",
+			"--freshness=400d"},
+	} {
+		output, err := exec.Command("gcloud", append(cmd, "--project="+*project, "--format=json")...).Output()
+		if err != nil {
+			log.Fatalf("Failed to fetch %s: %v", name, err)
+		}
+		if !json.Valid(output) {
+			log.Fatalf("Failed to fetch %s: gcloud did not output JSON", name)
+		}
+		if err := os.WriteFile(filepath.Join(*out, name), output, 0o644); err != nil {
+			log.Fatalf("Failed to save %s: %v", name, err)
+		}
+	}
+}
+
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var d audit.Deployment
+	fs.StringVar(&d.ProjectID, "project", "", "ID of the project of the deployment")
+	fs.StringVar(&d.ProjectNumber, "project-number", "", "number of the project of the deployment")
+	fs.StringVar(&d.Region, "region", "", "region of the keyring")
+	fs.StringVar(&d.Bootloader, "bootloader", audit.DefaultBootloader, "image reference of the pinned bootloader")
+	fs.StringVar(&d.VKey, "vkey", "", "verifier key pinned by WITNESS_VKEY, if any")
+	d.Env = envFlag(fs)
+	since := fs.String("since", "", "RFC 3339 time the deployment was sealed, before which activity is ignored")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if d.ProjectID == "" || d.ProjectNumber == "" || d.Region == "" || fs.NArg() != 1 {
+		log.Fatalln("Usage: audit check -project id -project-number n -region region [-bootloader ref] [-vkey vkey] [-env name=value]... [-since time] [-json] dir")
+	}
+
+	var sinceTime time.Time
+	if *since != "" {
+		var err error
+		if sinceTime, err = time.Parse(time.RFC3339, *since); err != nil {
+			log.Fatalln("Failed to parse -since:", err)
+		}
+	}
+	snapshot, err := audit.LoadSnapshot(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	printReport(d.Check(snapshot, sinceTime), *asJSON)
+}
+
+func diff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the diff as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		log.Fatalln("Usage: audit diff [-json] before after")
+	}
+
+	before, err := audit.LoadSnapshot(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	after, err := audit.LoadSnapshot(fs.Arg(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	d := audit.Compare(before, after)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Relevant bool `json:"relevant"`
+			*audit.Diff
+		}{d.Relevant(), d})
+	} else {
+		fmt.Print(d)
+		if d.Relevant() {
+			fmt.Println("SECURITY-RELEVANT CHANGES")
+		} else {
+			fmt.Println("NO SECURITY-RELEVANT CHANGES")
+		}
+	}
+	if d.Relevant() {
+		os.Exit(1)
+	}
+}
+
+func terraform(args []string) {
+	fs := flag.NewFlagSet("terraform", flag.ExitOnError)
+	bootloader := fs.String("bootloader", audit.DefaultBootloader, "image reference the bootloader must be pinned to")
+	vkey := fs.String("vkey", "", "verifier key that must be pinned, required if the condition or template pins one")
+	env := envFlag(fs)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: audit terraform [-bootloader ref] [-vkey vkey] [-env name=value]... [-json] show.json")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalln("Failed to read terraform output:", err)
+	}
+	t, err := audit.ParseTerraform(data)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d, err := t.Deployment(*bootloader, *vkey, env)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printReport(d.CheckTerraform(t), *asJSON)
+}
+
+/// Helper functions
+
+// Registers the repeatable -env flag, returning the variables it pins.
+func envFlag(fs *flag.FlagSet) map[string]string {
+	env := make(map[string]string)
+	fs.Func("env", "name=value of a variable in audit.OptionalEnv that must be pinned, repeated for each", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || !slices.Contains(audit.OptionalEnv, name) {
+			return fmt.Errorf("want name=value with a name in %s", strings.Join(audit.OptionalEnv, ", "))
+		}
+		env[name] = value
+		return nil
+	})
+	return env
+}
+
+// Prints a report as text or JSON, and exits non-zero if it did not pass.
+func printReport(report audit.Report, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]any{"passed": report.Passed(), "checks": report})
+	} else {
+		fmt.Print(report)
+		if report.Passed() {
+			fmt.Println("PASS")
+		} else {
+			fmt.Println("FAIL")
+		}
+	}
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,150 @@
+// Implements an endpoint that returns a fresh attestation token from the
+// Confidential Space launcher, bound to a nonce chosen by the client and to
+// the verifier key of the witness. This lets anyone check that the process
+// holding the signing key runs the attested image, without trusting the operator.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/attestation"
+)
+
+const (
+	// The launcher serves custom tokens on this socket inside the confidential space.
+	launcherSocket = "/run/container_launcher/teeserver.sock"
+
+	// Limits on nonces imposed by the launcher.
+	minNonceSize = 10
+	maxNonceSize = 74
+
+	// Token requests in flight at once, beyond which clients are turned away.
+	maxTokenRequests = 4
+)
+
+type Attester struct {
+	client   *http.Client
+	audience string
+	// Binds every token to the verifier key of the witness.
+	vkeyNonce string
+	sem       chan struct{}
+}
+
+// NewAttester returns an Attester that requests tokens for audience from the
+// launcher listening on socket, bound to vkey. stsAudience is the audience of
+// the tokens the witness exchanges for its own credentials, which audience
+// must not be usable as.
+func NewAttester(socket, audience, stsAudience, vkey string) (*Attester, error) {
+	if err := checkAttestationAudience(audience, stsAudience); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return &Attester{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		audience:  audience,
+		vkeyNonce: attestation.VKeyNonce(vkey),
+		sem:       make(chan struct{}, maxTokenRequests),
+	}, nil
+}
+
+// Token returns a token with nonce and the verifier key binding as its nonces.
+func (a *Attester) Token(ctx context.Context, nonce string) ([]byte, error) {
+	body, err := json.Marshal(map[string]any{
+		"audience":   a.audience,
+		"token_type": "OIDC",
+		"nonces":     []string{nonce, a.vkeyNonce},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode token request: %w", err)
+	}
+	// The host is ignored, as the connection always goes to the socket.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/v1/token", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token from launcher: %w", err)
+	}
+	defer resp.Body.Close()
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status response from launcher (%s): %q", resp.Status, token)
+	}
+	return token, nil
+}
+
+// ServeHTTP returns a token for the nonce in the nonce query parameter.
+func (a *Attester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nonce := r.URL.Query().Get("nonce")
+	if len(nonce) < minNonceSize || len(nonce) > maxNonceSize {
+		http.Error(w, fmt.Sprintf("nonce must be between %d and %d bytes", minNonceSize, maxNonceSize), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case a.sem <- struct{}{}:
+		defer func() { <-a.sem }()
+	default:
+		http.Error(w, "too many attestation requests", http.StatusTooManyRequests)
+		return
+	}
+
+	token, err := a.Token(r.Context(), nonce)
+	if err != nil {
+		log.Println("Attestation failed:", err)
+		attestationErrors.Inc()
+		http.Error(w, "failed to get attestation token", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwt")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(token)
+}
+
+/// Helper functions
+
+// Audiences that the workload identity pool provider accepts in tokens, as set
+// in allowed_audiences in terraform/deployment/deployment.tf.
+var providerAudiences = []string{"https://sts.googleapis.com"}
+
+// Tokens are handed to anyone who asks, so they must not be accepted by the
+// workload identity pool that grants the witness access to its key.
+func checkAttestationAudience(audience, stsAudience string) error {
+	if audience == "" {
+		return fmt.Errorf("attestation audience must not be empty")
+	}
+	for _, a := range providerAudiences {
+		if strings.EqualFold(strings.TrimSuffix(audience, "/"), a) {
+			return fmt.Errorf("attestation audience %q is accepted by the workload identity pool provider", audience)
+		}
+	}
+	if audience == stsAudience {
+		return fmt.Errorf("attestation audience %q is the audience of the witness credentials", audience)
+	}
+	if strings.HasPrefix(audience, "//iam.googleapis.com/") {
+		return fmt.Errorf("attestation audience %q is a workload identity pool provider", audience)
+	}
+	return nil
+}
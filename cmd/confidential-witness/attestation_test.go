@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aditsachde/confidential-witness/attestation"
+	"github.com/aditsachde/confidential-witness/internal/fakelauncher"
+)
+
+const testVKey = "example.com/witness+12345678+AQ=="
+
+func newTestAttester(t *testing.T) (*Attester, *fakelauncher.Server) {
+	t.Helper()
+	launcher, err := fakelauncher.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(launcher.Close)
+	a, err := NewAttester(launcher.Socket(), "confidential-witness", "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider", testVKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, launcher
+}
+
+func getAttestation(t *testing.T, a *Attester, nonce string) *http.Response {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/attestation?nonce="+nonce, nil))
+	return rec.Result()
+}
+
+func TestAttester(t *testing.T) {
+	a, launcher := newTestAttester(t)
+	const nonce = "0123456789abcdef"
+	resp := getAttestation(t, a, nonce)
+	token, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("attestation returned %s: %s", resp.Status, token)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	if strings.Count(string(token), ".") != 2 {
+		t.Errorf("attestation returned %q, want a JWT", token)
+	}
+
+	reqs := launcher.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("launcher received %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.Audience != "confidential-witness" || req.TokenType != "OIDC" {
+		t.Errorf("token requested for audience %q of type %q", req.Audience, req.TokenType)
+	}
+	// The token is bound to the nonce of the client and to the verifier key.
+	if want := []string{nonce, attestation.VKeyNonce(testVKey)}; !slices.Equal(req.Nonces, want) {
+		t.Errorf("token requested with nonces %q, want %q", req.Nonces, want)
+	}
+}
+
+func TestAttesterErrors(t *testing.T) {
+	a, launcher := newTestAttester(t)
+	for _, tc := range []struct {
+		name  string
+		nonce string
+		want  int
+	}{
+		{"missing nonce", "", http.StatusBadRequest},
+		{"short nonce", strings.Repeat("a", minNonceSize-1), http.StatusBadRequest},
+		{"long nonce", strings.Repeat("a", maxNonceSize+1), http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := getAttestation(t, a, tc.nonce).StatusCode; got != tc.want {
+				t.Errorf("attestation returned %d, want %d", got, tc.want)
+			}
+		})
+	}
+	if got := len(launcher.Requests()); got != 0 {
+		t.Errorf("launcher received %d requests for invalid nonces", got)
+	}
+
+	// Clients are turned away while too many tokens are being requested.
+	for range maxTokenRequests {
+		a.sem <- struct{}{}
+	}
+	if got := getAttestation(t, a, "0123456789").StatusCode; got != http.StatusTooManyRequests {
+		t.Errorf("attestation with too many requests in flight returned %d, want %d", got, http.StatusTooManyRequests)
+	}
+	for range maxTokenRequests {
+		<-a.sem
+	}
+
+	launcher.Close()
+	if got := getAttestation(t, a, "0123456789").StatusCode; got != http.StatusBadGateway {
+		t.Errorf("attestation without a launcher returned %d, want %d", got, http.StatusBadGateway)
+	}
+}
+
+func TestCheckAttestationAudience(t *testing.T) {
+	const stsAudience = "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider"
+	for _, tc := range []struct {
+		audience string
+		ok       bool
+	}{
+		{"confidential-witness", true},
+		{"https://witness.example.com", true},
+		{"", false},
+		{stsAudience, false},
+		{"https://sts.googleapis.com", false},
+		{"https://STS.googleapis.com/", false},
+		{"//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/other/providers/provider", false},
+	} {
+		if err := checkAttestationAudience(tc.audience, stsAudience); (err == nil) != tc.ok {
+			t.Errorf("checkAttestationAudience(%q) = %v", tc.audience, err)
+		}
+	}
+}
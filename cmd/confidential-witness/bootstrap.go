@@ -0,0 +1,331 @@
+// Seeds persistence on startup with checkpoints cosigned by a quorum of other witnesses.
+//
+// Without this, every restart of the witness with empty state is a new
+// trust-on-first-use window, in which a malicious log can present a forked view.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Path of the URL to the latest checkpoint for a log with at least N witness cosignatures.
+//   - first position is for the logID
+//   - second position is N
+const httpDistributorCheckpointN = "/distributor/v0/logs/%s/checkpoint.%d"
+
+// How often logs that have not been seeded yet are retried.
+const bootstrapRetryInterval = 30 * time.Second
+
+type BootstrapConfig struct {
+	// Base URLs of the distributors to fetch checkpoints from.
+	Distributors []string
+	// Verifier keys of the witnesses whose cosignatures are trusted.
+	Witnesses []string
+	// Number of distinct trusted witnesses that must have cosigned a checkpoint.
+	Quorum int
+	// How long to refuse to cosign a log that has not been seeded
+	// before falling back to trust-on-first-use.
+	Timeout time.Duration
+}
+
+type Bootstrap struct {
+	p         omniwitness.LogStatePersistence
+	signer    note.Signer
+	logs      map[string]witnessedLog
+	witnesses []note.Verifier
+	cfg       BootstrapConfig
+	client    *http.Client
+	alerts    *Alerter
+	deadline  time.Time
+
+	mu     sync.RWMutex
+	seeded map[string]bool
+}
+
+// NewBootstrap constructs a bootstrapper that seeds p with checkpoints
+// for every log in logs. signer cosigns the checkpoints that are stored,
+// and is never counted towards the quorum. alerts is told about logs
+// for which no quorum is found.
+func NewBootstrap(p omniwitness.LogStatePersistence, signer note.Signer, logs map[string]witnessedLog, cfg BootstrapConfig, client *http.Client, alerts *Alerter) (*Bootstrap, error) {
+	if len(cfg.Distributors) == 0 {
+		return nil, errors.New("no distributors configured")
+	}
+	if cfg.Quorum < 1 || cfg.Quorum > len(cfg.Witnesses) {
+		return nil, fmt.Errorf("quorum %d is not between 1 and the %d configured witnesses", cfg.Quorum, len(cfg.Witnesses))
+	}
+
+	b := &Bootstrap{
+		p:        p,
+		signer:   signer,
+		logs:     logs,
+		cfg:      cfg,
+		client:   client,
+		alerts:   alerts,
+		deadline: time.Now().Add(cfg.Timeout),
+		seeded:   make(map[string]bool),
+	}
+
+	for _, vkey := range cfg.Witnesses {
+		v, err := f_note.NewVerifierForCosignatureV1(vkey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid witness key %q: %w", vkey, err)
+		}
+		if v.Name() == signer.Name() && v.KeyHash() == signer.KeyHash() {
+			return nil, errors.New("the witness cannot be part of its own bootstrap quorum")
+		}
+		b.witnesses = append(b.witnesses, v)
+	}
+
+	return b, nil
+}
+
+// Persistence wraps the persistence the bootstrapper seeds, refusing to write
+// to logs that have not been seeded yet until the timeout expires.
+// As the witness always writes before returning a cosignature, it refuses to cosign those logs.
+func (b *Bootstrap) Persistence() omniwitness.LogStatePersistence {
+	return &bootstrapPersistence{
+		LogStatePersistence: b.p,
+		b:                   b,
+	}
+}
+
+// Run seeds every log, retrying until all logs are seeded or the timeout expires.
+// The persistence must already be initialized.
+func (b *Bootstrap) Run(ctx context.Context) error {
+	for {
+		remaining := 0
+		for id := range b.logs {
+			if b.isSeeded(id) {
+				continue
+			}
+			if err := b.seed(ctx, id); err != nil {
+				log.Printf("Bootstrap of log %s failed: %v", id, err)
+				if errors.Is(err, errNoQuorum) {
+					b.alerts.Fire(AlertBootstrapQuorum, id, "No distributor returned a checkpoint cosigned by %d trusted witnesses, the log is not cosigned until one does or bootstrap times out.", b.cfg.Quorum)
+				}
+				remaining++
+				continue
+			}
+			b.markSeeded(id)
+		}
+
+		if remaining == 0 {
+			log.Println("Bootstrap complete")
+			return nil
+		}
+		if time.Now().After(b.deadline) {
+			log.Printf("Bootstrap timed out with %d logs not seeded, falling back to TOFU", remaining)
+			b.alerts.Fire(AlertBootstrapQuorum, "", "Bootstrap timed out with %d logs not seeded, falling back to trust on first use.", remaining)
+			return nil
+		}
+
+		select {
+		case <-time.After(bootstrapRetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Done reports whether every log is seeded or the timeout has expired.
+func (b *Bootstrap) Done() bool {
+	if time.Now().After(b.deadline) {
+		return true
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.seeded) == len(b.logs)
+}
+
+// Helper methods
+
+func (b *Bootstrap) isSeeded(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.seeded[id]
+}
+
+func (b *Bootstrap) markSeeded(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seeded[id] = true
+}
+
+// Stores the latest checkpoint with a quorum for the log, unless state already exists.
+func (b *Bootstrap) seed(ctx context.Context, id string) error {
+	if found, err := hasState(b.p, id); err != nil || found {
+		// State that survived a restart is our own record, and is not replaced.
+		return err
+	}
+
+	n, err := b.fetch(ctx, b.logs[id])
+	if err != nil {
+		return err
+	}
+	return seedLog(b.p, b.signer, id, n)
+}
+
+// Returns the largest checkpoint with a quorum of cosignatures from any distributor,
+// with every signature other than the log's removed.
+func (b *Bootstrap) fetch(ctx context.Context, l witnessedLog) (*note.Note, error) {
+	var best *note.Note
+	var bestSize uint64
+	// Root hashes returned for each size, so that any two distributors disagreeing is caught.
+	hashes := make(map[uint64][]byte)
+
+	for _, d := range b.cfg.Distributors {
+		raw, err := httpGet(ctx, b.client, d+fmt.Sprintf(httpDistributorCheckpointN, l.id, b.cfg.Quorum))
+		if err != nil {
+			log.Printf("Bootstrap of log %s from %s failed: %v", l.id, d, err)
+			continue
+		}
+
+		cp, n, err := l.parse(raw, b.witnesses...)
+		if err != nil {
+			log.Printf("Bootstrap of log %s from %s returned an invalid checkpoint: %v", l.id, d, err)
+			continue
+		}
+		if got := b.countWitnesses(n); got < b.cfg.Quorum {
+			log.Printf("Bootstrap of log %s from %s has %d trusted cosignatures, want %d", l.id, d, got, b.cfg.Quorum)
+			continue
+		}
+
+		// Distributors disagreeing is evidence of a fork, not something to pick a side in.
+		if hash, ok := hashes[cp.Size]; ok && string(cp.Hash) != string(hash) {
+			return nil, fmt.Errorf("distributors returned conflicting checkpoints of size %d", cp.Size)
+		}
+		hashes[cp.Size] = cp.Hash
+		if best == nil || cp.Size > bestSize {
+			best = &note.Note{Text: n.Text, Sigs: logSigs(n, l)}
+			bestSize = cp.Size
+		}
+	}
+
+	if best == nil {
+		return nil, errNoQuorum
+	}
+	return best, nil
+}
+
+var errNoQuorum = errors.New("no distributor returned a checkpoint with a quorum")
+
+// Counts the distinct trusted witnesses that have signed n.
+func (b *Bootstrap) countWitnesses(n *note.Note) int {
+	count := 0
+	for _, v := range b.witnesses {
+		if hasSig(n, v) {
+			count++
+		}
+	}
+	return count
+}
+
+type bootstrapPersistence struct {
+	omniwitness.LogStatePersistence
+	b *Bootstrap
+}
+
+func (p *bootstrapPersistence) WriteOps(logID string) (omniwitness.LogStateWriteOps, error) {
+	if !p.b.isSeeded(logID) && !p.b.Done() {
+		return nil, status.Errorf(codes.Unavailable, "log %s has not been bootstrapped yet", logID)
+	}
+	return p.LogStatePersistence.WriteOps(logID)
+}
+
+/// Helper functions
+
+func httpGet(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %q", errNotFound, body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status response (%s): %q", resp.Status, body)
+	}
+	return body, nil
+}
+
+var errNotFound = errors.New("not found")
+
+// Reports whether p holds a checkpoint for the log.
+func hasState(p omniwitness.LogStatePersistence, id string) (bool, error) {
+	read, err := p.ReadOps(id)
+	if err != nil {
+		return false, fmt.Errorf("ReadOps(): %w", err)
+	}
+	if _, err := read.GetLatest(); err == nil {
+		return true, nil
+	} else if status.Code(err) != codes.NotFound {
+		return false, fmt.Errorf("GetLatest(): %w", err)
+	}
+	return false, nil
+}
+
+// Stores n, cosigned by signer, as the first checkpoint for the log.
+// This fails if any state was written for the log in the meantime.
+func seedLog(p omniwitness.LogStatePersistence, signer note.Signer, id string, n *note.Note) error {
+	write, err := p.WriteOps(id)
+	if err != nil {
+		return fmt.Errorf("WriteOps(): %w", err)
+	}
+	defer write.Close()
+
+	if _, err := write.GetLatest(); err == nil {
+		return fmt.Errorf("log %s already has state", id)
+	} else if status.Code(err) != codes.NotFound {
+		return fmt.Errorf("GetLatest(): %w", err)
+	}
+
+	signed, err := note.Sign(n, signer)
+	if err != nil {
+		return fmt.Errorf("failed to cosign checkpoint: %w", err)
+	}
+	return write.Set(signed)
+}
+
+// Reports whether n carries a verified signature from v.
+func hasSig(n *note.Note, v note.Verifier) bool {
+	for _, s := range n.Sigs {
+		if s.Name == v.Name() && s.Hash == v.KeyHash() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns only the signatures on n made by the log l.
+func logSigs(n *note.Note, l witnessedLog) []note.Signature {
+	var sigs []note.Signature
+	for _, s := range n.Sigs {
+		if s.Name == l.verifier.Name() && s.Hash == l.verifier.KeyHash() {
+			sigs = append(sigs, s)
+		}
+	}
+	return sigs
+}
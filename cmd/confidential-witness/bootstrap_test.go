@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	f_note "github.com/transparency-dev/formats/note"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Three trusted witnesses, with a quorum of two, and the local witness.
+type testBootstrap struct {
+	l         *testLog
+	witnesses []note.Signer
+	vkeys     []string
+	local     note.Signer
+	localVKey string
+	sink      *recordingSink
+}
+
+func newTestBootstrapWitnesses(t *testing.T, l *testLog) *testBootstrap {
+	t.Helper()
+	tb := &testBootstrap{l: l, sink: &recordingSink{}}
+	for i := range 3 {
+		signer, vkey := newTestCosignerKey(t, fmt.Sprintf("example.com/witness%d", i))
+		tb.witnesses = append(tb.witnesses, signer)
+		tb.vkeys = append(tb.vkeys, vkey)
+	}
+	tb.local, tb.localVKey = newTestCosignerKey(t, "example.com/local")
+	return tb
+}
+
+func (tb *testBootstrap) newBootstrap(t *testing.T, timeout time.Duration, distributors ...string) *Bootstrap {
+	t.Helper()
+	b, err := NewBootstrap(NewPersistence(), tb.local, map[string]witnessedLog{tb.l.id: tb.l.witnessedLog}, BootstrapConfig{
+		Distributors: distributors,
+		Witnesses:    tb.vkeys,
+		Quorum:       2,
+		Timeout:      timeout,
+	}, http.DefaultClient, NewAlerter("test", []AlertSink{tb.sink}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Serves raw as the checkpoint of l with a quorum of 2, or fails with code if raw is nil.
+func newTestDistributor(t *testing.T, l *testLog, raw []byte, code int) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf(httpDistributorCheckpointN, l.id, 2) {
+			http.NotFound(w, r)
+			return
+		}
+		if raw == nil {
+			http.Error(w, "unavailable", code)
+			return
+		}
+		w.Write(raw)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// Adds the cosignatures of witnesses to the checkpoint raw of l.
+func cosign(t *testing.T, l *testLog, raw []byte, witnesses ...note.Signer) []byte {
+	t.Helper()
+	n, err := note.Open(raw, note.VerifierList(l.verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := note.Sign(n, witnesses...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// Returns a cosignature signer and its verifier key.
+func newTestCosignerKey(t *testing.T, name string) (note.Signer, string) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := f_note.NewSignerForCosignatureV1(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, vkey
+}
+
+func TestBootstrapRun(t *testing.T) {
+	l := newTestLog(t, 8)
+	tb := newTestBootstrapWitnesses(t, l)
+	b := tb.newBootstrap(t, time.Hour, newTestDistributor(t, l, l.checkpoint(t, 5, tb.witnesses[0], tb.witnesses[1]), 0))
+	p := b.Persistence()
+
+	// Logs are not cosigned until they are seeded.
+	if _, err := p.WriteOps(l.id); err == nil {
+		t.Fatal("WriteOps() before bootstrap succeeded")
+	}
+	if b.Done() {
+		t.Fatal("Done() before bootstrap")
+	}
+
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Done() {
+		t.Error("Done() = false after bootstrap")
+	}
+	cp, n, err := l.latest(p)
+	if err != nil || cp == nil {
+		t.Fatalf("latest() = %v, %v", cp, err)
+	}
+	if cp.Size != 5 {
+		t.Errorf("seeded size %d, want 5", cp.Size)
+	}
+	// Only the signature of the log is kept, cosigned by the local witness.
+	raw, err := p.ReadOps(l.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := raw.GetLatest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := f_note.NewVerifierForCosignatureV1(tb.localVKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := note.Open(stored, note.VerifierList(l.verifier, local)); err != nil {
+		t.Errorf("stored checkpoint is not cosigned by the local witness: %v", err)
+	}
+	if len(n.Sigs) != 1 {
+		t.Errorf("stored checkpoint has %d verified signatures, want only the log's", len(n.Sigs))
+	}
+}
+
+func TestBootstrapFetch(t *testing.T) {
+	l := newTestLog(t, 8)
+	tb := newTestBootstrapWitnesses(t, l)
+	w := tb.witnesses
+	quorum := func(size uint64) string {
+		return newTestDistributor(t, l, l.checkpoint(t, size, w[0], w[2]), 0)
+	}
+	untrusted, _ := newTestCosigner(t, "example.com/untrusted")
+	other := newTestLog(t, 8)
+
+	for _, tc := range []struct {
+		name         string
+		distributors []string
+		// The size of the checkpoint fetched, or 0 if none is.
+		want uint64
+		// Whether the failure is for lack of a quorum, rather than a conflict.
+		noQuorum bool
+	}{
+		{"quorum", []string{quorum(5)}, 5, false},
+		{"largest", []string{quorum(3), quorum(6), quorum(5)}, 6, false},
+		{"same checkpoint", []string{quorum(5), newTestDistributor(t, l, l.checkpoint(t, 5, w[1], w[2]), 0)}, 5, false},
+		{"one failing", []string{newTestDistributor(t, l, nil, http.StatusInternalServerError), quorum(4)}, 4, false},
+		{"one unreachable", []string{"http://127.0.0.1:1", quorum(4)}, 4, false},
+		{"all failing", []string{
+			newTestDistributor(t, l, nil, http.StatusInternalServerError),
+			newTestDistributor(t, l, nil, http.StatusNotFound),
+		}, 0, true},
+		{"below quorum", []string{newTestDistributor(t, l, l.checkpoint(t, 5, w[0]), 0)}, 0, true},
+		{"same witness twice", []string{newTestDistributor(t, l, cosign(t, l, l.checkpoint(t, 5, w[0]), w[0]), 0)}, 0, true},
+		{"untrusted witnesses", []string{newTestDistributor(t, l, l.checkpoint(t, 5, w[0], untrusted), 0)}, 0, true},
+		{"other log", []string{newTestDistributor(t, l, other.checkpoint(t, 5, w[0], w[1]), 0)}, 0, true},
+		{"not a checkpoint", []string{newTestDistributor(t, l, []byte("checkpoint"), 0)}, 0, true},
+		{"conflicting", []string{quorum(5), newTestDistributor(t, l, cosign(t, l, forkedCheckpoint(t, l, 5), w[0], w[1]), 0)}, 0, false},
+		{"conflicting below largest", []string{
+			newTestDistributor(t, l, cosign(t, l, forkedCheckpoint(t, l, 5), w[0], w[1]), 0),
+			quorum(6),
+			quorum(5),
+		}, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tb.newBootstrap(t, time.Hour, tc.distributors...)
+			n, err := b.fetch(context.Background(), l.witnessedLog)
+			if tc.want == 0 {
+				if err == nil {
+					t.Fatalf("fetch() = %q", n.Text)
+				}
+				if errors.Is(err, errNoQuorum) != tc.noQuorum {
+					t.Errorf("fetch() = %v, want no quorum %v", err, tc.noQuorum)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(n.Text, fmt.Sprintf("%s\n%d\n", l.origin, tc.want)) {
+				t.Errorf("fetch() = %q, want size %d", n.Text, tc.want)
+			}
+			if len(n.Sigs) != 1 || n.Sigs[0].Name != l.origin {
+				t.Errorf("fetch() kept signatures %v, want only the log's", n.Sigs)
+			}
+		})
+	}
+}
+
+func TestBootstrapTimeout(t *testing.T) {
+	l := newTestLog(t, 8)
+	tb := newTestBootstrapWitnesses(t, l)
+	// The timeout is zero, so a single attempt is made before falling back to TOFU.
+	b := tb.newBootstrap(t, 0, newTestDistributor(t, l, nil, http.StatusNotFound))
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Done() {
+		t.Error("Done() = false after the timeout")
+	}
+	if _, err := b.Persistence().WriteOps(l.id); err != nil {
+		t.Errorf("WriteOps() after the timeout = %v", err)
+	}
+	b.alerts.Wait()
+	if len(tb.sink.Alerts()) == 0 {
+		t.Error("no alert for the missing quorum")
+	}
+}
+
+func TestNewBootstrapErrors(t *testing.T) {
+	l := newTestLog(t, 8)
+	tb := newTestBootstrapWitnesses(t, l)
+	vkey := tb.vkeys[0]
+	for _, tc := range []struct {
+		name string
+		cfg  BootstrapConfig
+	}{
+		{"no distributors", BootstrapConfig{Witnesses: []string{vkey}, Quorum: 1}},
+		{"quorum zero", BootstrapConfig{Distributors: []string{"http://d"}, Witnesses: []string{vkey}, Quorum: 0}},
+		{"quorum above witnesses", BootstrapConfig{Distributors: []string{"http://d"}, Witnesses: []string{vkey}, Quorum: 2}},
+		{"invalid witness key", BootstrapConfig{Distributors: []string{"http://d"}, Witnesses: []string{"key"}, Quorum: 1}},
+		{"local witness", BootstrapConfig{Distributors: []string{"http://d"}, Witnesses: []string{tb.localVKey}, Quorum: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewBootstrap(NewPersistence(), tb.local, nil, tc.cfg, http.DefaultClient, NewAlerter("test", nil, 0)); err == nil {
+				t.Error("NewBootstrap() succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Implements a canary that periodically signs a test note, so that signing
+// failures show up before clients see invalid cosignatures.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	canaryInterval = time.Minute
+	// A checkpoint for a log that does not exist. The signatures are discarded.
+	canaryNote = "confidential-witness/canary\n0\n47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n"
+)
+
+type Canary struct {
+	signer   *NoteKms
+	interval time.Duration
+
+	mu          sync.RWMutex
+	lastSuccess time.Time
+	lastErr     error
+}
+
+func NewCanary(signer *NoteKms, interval time.Duration) *Canary {
+	return &Canary{
+		signer:   signer,
+		interval: interval,
+	}
+}
+
+// Run signs the canary note every interval until ctx is done.
+func (c *Canary) Run(ctx context.Context) error {
+	for {
+		c.check()
+		select {
+		case <-time.After(c.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Last returns the time of the last successful canary signature, and the error
+// of the last attempt, if it failed.
+func (c *Canary) Last() (time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastSuccess, c.lastErr
+}
+
+// Helper methods
+
+func (c *Canary) check() {
+	start := time.Now()
+	err := c.sign()
+	observeSince(canaryLatency, start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	if err != nil {
+		log.Println("Canary signature failed:", err)
+		canaryErrors.Inc()
+		canarySuccess.Set(0)
+		return
+	}
+	c.lastSuccess = time.Now()
+	canarySuccess.Set(1)
+	canaryLastSuccess.Set(float64(c.lastSuccess.Unix()))
+}
+
+// Produces a cosignature over the canary note, and verifies it as a client would.
+// The timestamp is taken from the clock like for any other cosignature, so that
+// the canary fails while the witness refuses to sign, but it is neither logged
+// nor counted as a cosignature.
+func (c *Canary) sign() error {
+	t, err := c.signer.clock.Next()
+	if err != nil {
+		return err
+	}
+	msg, err := formatCosignatureV1(t, []byte(canaryNote))
+	if err != nil {
+		return err
+	}
+	sig, err := c.signer.signMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	cosig := make([]byte, 0, timestampSize+len(sig))
+	cosig = binary.BigEndian.AppendUint64(cosig, t)
+	cosig = append(cosig, sig...)
+	if !c.signer.Verify([]byte(canaryNote), cosig) {
+		return errors.New("cosignature does not verify")
+	}
+	return nil
+}
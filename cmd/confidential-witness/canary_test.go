@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCanaryUsesClock(t *testing.T) {
+	backend, err := NewDevBackend("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewClock(ClockRefuse, nil)
+	n, err := NewNoteKms(context.Background(), backend, "example.com/witness", clock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCanary(n, time.Minute)
+
+	c.check()
+	if last, err := c.Last(); err != nil || last.IsZero() {
+		t.Fatalf("Last() = %v, %v, want a success", last, err)
+	}
+	if s := clock.Status(); s.LastIssued == nil {
+		t.Error("canary did not take its timestamp from the clock")
+	}
+
+	// While the witness refuses to sign, so does the canary.
+	clock.Observe(uint64(time.Now().Add(time.Hour).Unix()))
+	c.check()
+	if _, err := c.Last(); err == nil {
+		t.Error("canary succeeded while the clock refuses to sign")
+	}
+}
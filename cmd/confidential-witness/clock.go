@@ -0,0 +1,160 @@
+// Implements monotonic cosignature timestamps, so that a skewed clock after a
+// restart cannot make the witness issue cosignatures that go back in time.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+)
+
+type ClockPolicy string
+
+const (
+	// Timestamps earlier than the highest issued one are raised to it.
+	ClockClamp ClockPolicy = "clamp"
+	// Signing fails while the clock is earlier than the highest issued timestamp.
+	ClockRefuse ClockPolicy = "refuse"
+)
+
+func ParseClockPolicy(s string) (ClockPolicy, error) {
+	switch p := ClockPolicy(s); p {
+	case ClockClamp, ClockRefuse:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown clock policy %q", s)
+}
+
+type ClockStatus struct {
+	Policy      ClockPolicy `json:"policy"`
+	LastIssued  *time.Time  `json:"last_issued,omitempty"`
+	Anomalies   uint64      `json:"anomalies"`
+	LastAnomaly *time.Time  `json:"last_anomaly,omitempty"`
+	// How far the clock was behind the highest issued timestamp at the last anomaly.
+	LastAnomalyBehindSeconds uint64 `json:"last_anomaly_behind_seconds,omitempty"`
+}
+
+type Clock struct {
+	policy ClockPolicy
+	now    func() time.Time
+	// Optional verification of the local clock, which blocks signing if it fails.
+	trusted *TimeCheck
+
+	mu          sync.Mutex
+	last        uint64
+	anomalies   uint64
+	lastAnomaly time.Time
+	lastBehind  uint64
+}
+
+// NewClock returns a Clock that applies policy when the clock goes backwards.
+// trusted may be nil, in which case the local clock is not verified.
+func NewClock(policy ClockPolicy, trusted *TimeCheck) *Clock {
+	return &Clock{
+		policy:  policy,
+		now:     time.Now,
+		trusted: trusted,
+	}
+}
+
+// Next returns the timestamp for a new cosignature, which is never earlier
+// than any timestamp returned or observed before.
+func (c *Clock) Next() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.trusted != nil {
+		if err := c.trusted.Check(now); err != nil {
+			untrustedTimeRejections.Inc()
+			return 0, fmt.Errorf("refusing to sign with unverified time: %w", err)
+		}
+	}
+	t := uint64(now.Unix())
+	if t < c.last {
+		c.anomalies++
+		c.lastAnomaly = now
+		c.lastBehind = c.last - t
+		clockAnomalies.Inc()
+		clockBehind.Set(float64(c.lastBehind))
+
+		if c.policy == ClockRefuse {
+			return 0, fmt.Errorf("clock is %ds behind the last issued cosignature", c.lastBehind)
+		}
+		t = c.last
+	} else {
+		clockBehind.Set(0)
+	}
+	c.observe(t)
+	return t, nil
+}
+
+// Observe raises the highest issued timestamp to t, if it is higher.
+func (c *Clock) Observe(t uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe(t)
+}
+
+func (c *Clock) Status() ClockStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := ClockStatus{
+		Policy:    c.policy,
+		Anomalies: c.anomalies,
+	}
+	if c.last > 0 {
+		t := time.Unix(int64(c.last), 0).UTC()
+		s.LastIssued = &t
+	}
+	if !c.lastAnomaly.IsZero() {
+		t := c.lastAnomaly.UTC()
+		s.LastAnomaly = &t
+		s.LastAnomalyBehindSeconds = c.lastBehind
+	}
+	return s
+}
+
+// Helper methods
+
+func (c *Clock) observe(t uint64) {
+	if t > c.last {
+		c.last = t
+		lastCosignatureTimestamp.Set(float64(t))
+	}
+}
+
+/// Helper functions
+
+// Returns the highest timestamp of the cosignatures by v on the checkpoints
+// stored in p. Cosignatures that are released without being stored, such as
+// on the checkpoints of the cosignature log, are not included, so this is only
+// a lower bound on the highest timestamp the witness has issued.
+func highestCosignature(p omniwitness.LogStatePersistence, logs map[string]witnessedLog, v note.Verifier) (uint64, error) {
+	var highest uint64
+	for _, l := range logs {
+		_, n, err := l.latest(p, v)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read checkpoint for log %s: %w", l.id, err)
+		}
+		if n == nil {
+			continue
+		}
+		t, err := cosignedAt(n, v)
+		if errors.Is(err, errNotCosigned) {
+			// There is nothing to learn from state the witness has not cosigned.
+			log.Printf("Stored checkpoint for log %s is not cosigned by this witness", l.id)
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read cosignature for log %s: %w", l.id, err)
+		}
+		highest = max(highest, uint64(t.Unix()))
+	}
+	return highest, nil
+}
@@ -0,0 +1,104 @@
+// Implements a note.Signer wrapper that reuses recent cosignatures, so that
+// cosigning the same checkpoint again does not cost another KMS signature.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/sync/singleflight"
+)
+
+type cachedCosignature struct {
+	sig     []byte
+	expires time.Time
+}
+
+type CachingSigner struct {
+	inner  note.Signer
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedCosignature
+	// Collapses concurrent requests for the same message into one signature.
+	group singleflight.Group
+}
+
+// NewCachingSigner returns a Signer that returns the same cosignature for a
+// message for up to window after it was first produced by inner.
+func NewCachingSigner(inner note.Signer, window time.Duration) *CachingSigner {
+	return &CachingSigner{
+		inner:   inner,
+		window:  window,
+		entries: make(map[string]cachedCosignature),
+	}
+}
+
+func (c *CachingSigner) Sign(msg []byte) ([]byte, error) {
+	h := sha256.Sum256(msg)
+	key := hex.EncodeToString(h[:])
+
+	if sig, ok := c.get(key); ok {
+		cosignatureCacheHits.Inc()
+		return sig, nil
+	}
+
+	sig, err, shared := c.group.Do(key, func() (interface{}, error) {
+		// Another request may have filled the cache since the lookup above.
+		if sig, ok := c.get(key); ok {
+			return sig, nil
+		}
+		sig, err := c.inner.Sign(msg)
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, sig)
+		return sig, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		cosignatureCacheHits.Inc()
+	}
+	// Callers must not be able to modify the cached signature.
+	return append([]byte(nil), sig.([]byte)...), nil
+}
+
+// Helper methods
+
+func (c *CachingSigner) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return append([]byte(nil), e.sig...), true
+}
+
+// Stores sig, and drops every entry that has expired.
+func (c *CachingSigner) put(key string, sig []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedCosignature{
+		sig:     append([]byte(nil), sig...),
+		expires: now.Add(c.window),
+	}
+}
+
+// Interface implementations
+func (c *CachingSigner) Name() string    { return c.inner.Name() }
+func (c *CachingSigner) KeyHash() uint32 { return c.inner.KeyHash() }
+
+var _ note.Signer = (*CachingSigner)(nil)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A signer that returns a distinct signature for every call, blocking every
+// call until release is closed, if it is set.
+type countingSigner struct {
+	err     error
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *countingSigner) Name() string    { return "example.com/witness" }
+func (s *countingSigner) KeyHash() uint32 { return 1 }
+
+func (s *countingSigner) Sign(msg []byte) ([]byte, error) {
+	n := s.calls.Add(1)
+	if s.release != nil {
+		<-s.release
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []byte(fmt.Sprintf("sig %d", n)), nil
+}
+
+func TestCachingSigner(t *testing.T) {
+	inner := &countingSigner{}
+	c := NewCachingSigner(inner, time.Hour)
+
+	first, err := c.Sign([]byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Callers cannot modify the cached signature.
+	first[0] = 'x'
+	again, err := c.Sign([]byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != "sig 1" || inner.calls.Load() != 1 {
+		t.Errorf("Sign() of a cached message = %q after %d calls, want %q after 1", again, inner.calls.Load(), "sig 1")
+	}
+
+	// Other messages are signed separately.
+	other, err := c.Sign([]byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other, again) || inner.calls.Load() != 2 {
+		t.Errorf("Sign() of another message = %q after %d calls", other, inner.calls.Load())
+	}
+}
+
+func TestCachingSignerExpiry(t *testing.T) {
+	inner := &countingSigner{}
+	c := NewCachingSigner(inner, 10*time.Millisecond)
+	if _, err := c.Sign([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	sig, err := c.Sign([]byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sig) != "sig 2" {
+		t.Errorf("Sign() = %q, want %q", sig, "sig 2")
+	}
+	// Storing a signature drops the expired ones.
+	if len(c.entries) != 1 {
+		t.Errorf("cache holds %d entries after expiry, want 1", len(c.entries))
+	}
+	sig, err = c.Sign([]byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sig) != "sig 3" {
+		t.Errorf("Sign() of an expired message = %q, want a new signature", sig)
+	}
+}
+
+func TestCachingSignerSingleflight(t *testing.T) {
+	inner := &countingSigner{release: make(chan struct{})}
+	c := NewCachingSigner(inner, time.Hour)
+
+	sigs := make([][]byte, 10)
+	var wg sync.WaitGroup
+	for i := range sigs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sig, err := c.Sign([]byte("one"))
+			if err != nil {
+				t.Error(err)
+			}
+			sigs[i] = sig
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+	if got := inner.calls.Load(); got != 1 {
+		t.Errorf("concurrent identical requests made %d signatures, want 1", got)
+	}
+	for _, sig := range sigs {
+		if string(sig) != "sig 1" {
+			t.Errorf("Sign() = %q, want %q", sig, "sig 1")
+		}
+	}
+}
+
+func TestCachingSignerError(t *testing.T) {
+	inner := &countingSigner{err: errors.New("unavailable")}
+	c := NewCachingSigner(inner, time.Hour)
+	for range 2 {
+		if _, err := c.Sign([]byte("one")); err == nil {
+			t.Error("Sign() with a failing signer succeeded")
+		}
+	}
+	// Failures are not cached.
+	if got := inner.calls.Load(); got != 2 {
+		t.Errorf("failing signer called %d times, want 2", got)
+	}
+}
@@ -0,0 +1,93 @@
+// Implements the SigningBackend interface for a local Ed25519 key.
+// This is only intended for running the witness outside of a confidential space.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type DevBackend struct {
+	key ed25519.PrivateKey
+}
+
+// NewDevBackend constructs a SigningBackend from the PKCS #8 PEM encoded
+// Ed25519 private key at path. If path does not exist, a new key is generated
+// and written to it. If path is empty, an ephemeral key is generated.
+func NewDevBackend(path string) (*DevBackend, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		return &DevBackend{key: key}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return generateDevKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("invalid key file, expected a PEM encoded PRIVATE KEY")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	privkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key, not ed25519")
+	}
+
+	return &DevBackend{key: privkey}, nil
+}
+
+func (d *DevBackend) PublicKey(ctx context.Context) (ed25519.PublicKey, error) {
+	return d.key.Public().(ed25519.PublicKey), nil
+}
+
+func (d *DevBackend) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return ed25519.Sign(d.key, msg), nil
+}
+
+var _ SigningBackend = (*DevBackend)(nil)
+
+/// Helper functions
+
+// Generate a new Ed25519 key and write it to path, failing if it already exists.
+func generateDevKey(path string) (*DevBackend, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	return &DevBackend{key: key}, nil
+}
@@ -0,0 +1,292 @@
+// Captures evidence when a log presents checkpoints that conflict with the
+// state of the witness, and publishes it so that anyone can verify the split view.
+//
+// Conflicts are detected in updates to the witness API that omniwitness rejects,
+// and in checkpoints cosigned by peers. Each one is stored as a self-contained
+// bundle, named by its checkpoints, that only needs the log key to verify.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/equivocation"
+	"github.com/transparency-dev/witness/api"
+	"github.com/transparency-dev/witness/omniwitness"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Requests to the witness API larger than this are rejected before they reach omniwitness.
+	maxUpdateSize = 64 << 10
+	// Bundles larger than this are not stored.
+	maxEvidenceSize = 4 * maxUpdateSize
+	// No more bundles than this are stored, so that a flood of conflicts cannot exhaust storage.
+	maxEvidence = 1000
+	// Deadline for fetching a consistency proof from a log.
+	proofTimeout = 10 * time.Second
+	// Proofs are fetched from each log at most this often, as anyone can ask
+	// for one by pairing a genuine checkpoint with a proof that does not verify.
+	proofInterval = 10 * time.Second
+)
+
+type Equivocations struct {
+	ctx   context.Context
+	store EvidenceStore
+	p     omniwitness.LogStatePersistence
+	logs  map[string]witnessedLog
+	// Fetches consistency proofs from the logs.
+	client *http.Client
+	// The verifier key of the witness, which cosigns the stored checkpoints.
+	witness string
+	alerts  *Alerter
+
+	mu sync.Mutex
+	// When a proof was last fetched from each log.
+	lastProof map[string]time.Time
+	// Number of bundles in the store, or -1 until it has been listed.
+	stored int
+}
+
+func NewEquivocations(ctx context.Context, store EvidenceStore, p omniwitness.LogStatePersistence, logs map[string]witnessedLog, client *http.Client, witness string, alerts *Alerter) *Equivocations {
+	return &Equivocations{
+		ctx:       ctx,
+		store:     store,
+		p:         p,
+		logs:      logs,
+		client:    client,
+		witness:   witness,
+		alerts:    alerts,
+		lastProof: make(map[string]time.Time),
+		stored:    -1,
+	}
+}
+
+// Check compares a checkpoint for logID from source with the stored one, and
+// stores evidence if they conflict. proof is the consistency proof that came
+// with the checkpoint, if any. It returns nil if there is no conflict.
+//
+// Anyone can pair a genuine checkpoint with a proof that does not verify, so
+// such a checkpoint is only evidence if the proof fetched from the log itself
+// does not verify either, which then replaces the submitted one. Proofs are
+// fetched at most once every proofInterval for each log.
+func (e *Equivocations) Check(logID string, raw []byte, proof [][]byte, source string) (*equivocation.Bundle, error) {
+	l, ok := e.logs[logID]
+	if !ok {
+		return nil, nil
+	}
+	read, err := e.p.ReadOps(logID)
+	if err != nil {
+		return nil, fmt.Errorf("ReadOps(): %w", err)
+	}
+	stored, err := read.GetLatest()
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("GetLatest(): %w", err)
+	}
+
+	b := &equivocation.Bundle{
+		Origin:      l.origin,
+		LogKey:      l.vkey,
+		Witness:     e.witness,
+		Stored:      string(stored),
+		Conflicting: string(raw),
+		Proof:       proof,
+		Source:      source,
+		Detected:    time.Now().UTC(),
+	}
+	// Anything that is not verifiable evidence, such as a checkpoint
+	// that is not signed by the log, is not worth keeping.
+	if b.Kind, err = b.Classify(); err != nil {
+		return nil, nil
+	}
+
+	// The same conflict is only stored and alerted on once. Its ID does not
+	// depend on the proof, so it is looked up before any proof is fetched.
+	if data, err := e.store.Get(e.ctx, b.ID()); err == nil {
+		var found equivocation.Bundle
+		if err := json.Unmarshal(data, &found); err != nil {
+			return nil, fmt.Errorf("failed to decode evidence %s: %w", b.ID(), err)
+		}
+		return &found, nil
+	} else if !errors.Is(err, errNoEvidence) {
+		return nil, err
+	}
+
+	if b.Kind == equivocation.InvalidProof {
+		if !e.allowProof(logID) {
+			return nil, fmt.Errorf("not fetching another consistency proof from log %s within %s", logID, proofInterval)
+		}
+		if b.Proof, err = e.proveFromLog(l, b); err != nil {
+			return nil, err
+		}
+		if b.Kind, err = b.Classify(); err != nil {
+			return nil, nil
+		}
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode evidence: %w", err)
+	}
+	if len(data) > maxEvidenceSize {
+		return nil, fmt.Errorf("not storing evidence %s of %d bytes", b.ID(), len(data))
+	}
+	if err := e.reserve(); err != nil {
+		return nil, fmt.Errorf("not storing evidence %s: %w", b.ID(), err)
+	}
+	if err := e.store.Put(e.ctx, b.ID(), data); err != nil {
+		e.release()
+		return nil, err
+	}
+	equivocations.WithLabelValues(logID, string(b.Kind)).Inc()
+	log.Printf("%s: EQUIVOCATION (%s) detected from %s, evidence stored as %s", logID, b.Kind, source, b.ID())
+	e.alerts.Fire(AlertEquivocation, logID, "Log %s presented a checkpoint from %s that conflicts with the stored one (%s). Evidence is published as /equivocations/%s.", l.origin, source, b.Kind, b.ID())
+	return b, nil
+}
+
+// Capture wraps the witness API in next, checking every update that
+// omniwitness rejects as invalid for a conflict with the stored checkpoint.
+func (e *Equivocations) Capture(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", next)
+	mux.HandleFunc("PUT "+fmt.Sprintf(api.HTTPUpdate, "{logid}"), func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpdateSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("cannot read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// Inconsistent checkpoints and invalid proofs are rejected as bad requests.
+		if rec.status != http.StatusBadRequest {
+			return
+		}
+		var req api.UpdateRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return
+		}
+		if _, err := e.Check(r.PathValue("logid"), req.Checkpoint, req.Proof, "update"); err != nil {
+			log.Printf("Failed to check update for log %s for equivocation: %v", r.PathValue("logid"), err)
+		}
+	})
+	return mux
+}
+
+// Handler serves a JSON list of the IDs of all evidence at /, and each bundle at /{id}.
+func (e *Equivocations) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		ids, err := e.store.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ids)
+	})
+	mux.HandleFunc("GET /{id}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := e.store.Get(r.Context(), r.PathValue("id"))
+		if errors.Is(err, errNoEvidence) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	return mux
+}
+
+// Helper methods
+
+// Reports whether a proof may be fetched from logID, and if so, records that one is.
+func (e *Equivocations) allowProof(logID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if last, ok := e.lastProof[logID]; ok && now.Sub(last) < proofInterval {
+		return false
+	}
+	e.lastProof[logID] = now
+	return true
+}
+
+// Reserves room for another bundle, failing once the store holds maxEvidence.
+// The store is only listed the first time.
+func (e *Equivocations) reserve() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stored < 0 {
+		ids, err := e.store.List(e.ctx)
+		if err != nil {
+			return err
+		}
+		e.stored = len(ids)
+	}
+	if e.stored >= maxEvidence {
+		return fmt.Errorf("there are already %d bundles", e.stored)
+	}
+	e.stored++
+	return nil
+}
+
+// Releases the room reserved for a bundle that was not stored.
+func (e *Equivocations) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stored--
+}
+
+// Returns the consistency proof between the checkpoints in b, fetched from the log.
+func (e *Equivocations) proveFromLog(l witnessedLog, b *equivocation.Bundle) ([][]byte, error) {
+	stored, _, err := l.parse([]byte(b.Stored))
+	if err != nil {
+		return nil, err
+	}
+	conflicting, _, err := l.parse([]byte(b.Conflicting))
+	if err != nil {
+		return nil, err
+	}
+	smaller, larger := stored, conflicting
+	if smaller.Size > larger.Size {
+		smaller, larger = larger, smaller
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, proofTimeout)
+	defer cancel()
+	proof, err := l.consistencyProof(ctx, e.client, smaller, larger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch consistency proof from log: %w", err)
+	}
+	return proof, nil
+}
+
+// Records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
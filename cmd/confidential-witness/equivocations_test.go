@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/equivocation"
+	"github.com/transparency-dev/formats/log"
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/witness/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Serves the witness API of a witness that stored the checkpoint of l at size 4,
+// behind an omniwitness that rejects every update.
+func newTestEquivocations(t *testing.T, l *testLog, store EvidenceStore) (*Equivocations, *recordingSink, *httptest.Server) {
+	t.Helper()
+	p := NewPersistence()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "example.com/witness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := f_note.NewSignerForCosignatureV1(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := note.Open(l.checkpoint(t, 4), note.VerifierList(l.verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seedLog(p, local, l.id, n); err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	e := NewEquivocations(context.Background(), store, p, map[string]witnessedLog{l.id: l.witnessedLog}, http.DefaultClient, vkey, NewAlerter("test", []AlertSink{sink}, 0))
+	srv := httptest.NewServer(e.Capture(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rejected", http.StatusBadRequest)
+	})))
+	t.Cleanup(srv.Close)
+	return e, sink, srv
+}
+
+// Returns a checkpoint of l at size with a root hash that is not in its tree.
+func forkedCheckpoint(t *testing.T, l *testLog, size uint64) []byte {
+	t.Helper()
+	hash := sha256.Sum256([]byte(fmt.Sprintf("fork %d", size)))
+	cp := log.Checkpoint{Origin: l.origin, Size: size, Hash: hash[:]}
+	raw, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, l.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func sendUpdate(t *testing.T, srv *httptest.Server, l *testLog, body []byte) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, srv.URL+fmt.Sprintf(api.HTTPUpdate, l.id), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func updateBody(t *testing.T, raw []byte, proof [][]byte) []byte {
+	t.Helper()
+	body, err := json.Marshal(api.UpdateRequest{Checkpoint: raw, Proof: proof})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestEquivocationsCapture(t *testing.T) {
+	bogusProof := [][]byte{make([]byte, sha256.Size)}
+	for _, tc := range []struct {
+		name       string
+		checkpoint func(l *testLog) []byte
+		proof      [][]byte
+		// The kind of evidence that is stored, or empty if none is.
+		want equivocation.Kind
+	}{
+		{
+			name:       "fork",
+			checkpoint: func(l *testLog) []byte { return forkedCheckpoint(t, l, 4) },
+			want:       equivocation.Fork,
+		},
+		{
+			name:       "consistent checkpoint with invalid proof",
+			checkpoint: func(l *testLog) []byte { return l.checkpoint(t, 8) },
+			proof:      bogusProof,
+		},
+		{
+			name:       "consistent checkpoint without proof",
+			checkpoint: func(l *testLog) []byte { return l.checkpoint(t, 8) },
+		},
+		{
+			name:       "inconsistent checkpoint",
+			checkpoint: func(l *testLog) []byte { return forkedCheckpoint(t, l, 8) },
+			proof:      bogusProof,
+			want:       equivocation.InvalidProof,
+		},
+		{
+			name:       "checkpoint not signed by the log",
+			checkpoint: func(l *testLog) []byte { return newTestLog(t, 8).checkpoint(t, 8) },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newTestLog(t, 8)
+			e, sink, srv := newTestEquivocations(t, l, NewMemoryEvidenceStore())
+			if got := sendUpdate(t, srv, l, updateBody(t, tc.checkpoint(l), tc.proof)); got != http.StatusBadRequest {
+				t.Fatalf("update returned %d, want %d", got, http.StatusBadRequest)
+			}
+			e.alerts.Wait()
+
+			ids, err := e.store.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" {
+				if len(ids) != 0 || len(sink.Alerts()) != 0 {
+					t.Errorf("stored evidence %v and sent %d alerts, want none", ids, len(sink.Alerts()))
+				}
+				return
+			}
+			if len(ids) != 1 {
+				t.Fatalf("stored evidence %v, want one bundle", ids)
+			}
+			data, err := e.store.Get(context.Background(), ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b equivocation.Bundle
+			if err := json.Unmarshal(data, &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.Kind != tc.want {
+				t.Errorf("stored evidence of kind %q, want %q", b.Kind, tc.want)
+			}
+			if err := b.Verify(); err != nil {
+				t.Errorf("stored evidence does not verify: %v", err)
+			}
+			if got := len(sink.Alerts()); got != 1 {
+				t.Errorf("sent %d alerts, want 1", got)
+			}
+		})
+	}
+}
+
+func TestEquivocationsStoresOnce(t *testing.T) {
+	l := newTestLog(t, 8)
+	e, sink, srv := newTestEquivocations(t, l, NewMemoryEvidenceStore())
+	body := updateBody(t, forkedCheckpoint(t, l, 4), nil)
+	for range 3 {
+		sendUpdate(t, srv, l, body)
+	}
+	e.alerts.Wait()
+
+	if ids, err := e.store.List(context.Background()); err != nil || len(ids) != 1 {
+		t.Errorf("stored evidence %v, %v, want one bundle", ids, err)
+	}
+	if got := len(sink.Alerts()); got != 1 {
+		t.Errorf("sent %d alerts for the same conflict, want 1", got)
+	}
+}
+
+func TestEquivocationsLimits(t *testing.T) {
+	l := newTestLog(t, 8)
+	store := NewMemoryEvidenceStore()
+	e, sink, srv := newTestEquivocations(t, l, store)
+
+	// Oversized updates are rejected before they reach omniwitness.
+	body := updateBody(t, forkedCheckpoint(t, l, 4), [][]byte{make([]byte, maxUpdateSize)})
+	if got := sendUpdate(t, srv, l, body); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized update returned %d, want %d", got, http.StatusRequestEntityTooLarge)
+	}
+
+	// Once the store is full, no more evidence is added.
+	for i := range maxEvidence {
+		if err := store.Put(context.Background(), fmt.Sprint(i), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := e.Check(l.id, forkedCheckpoint(t, l, 4), nil, "test"); err == nil {
+		t.Errorf("Check() with a full store = %v, want an error", b)
+	}
+	e.alerts.Wait()
+	if ids, err := store.List(context.Background()); err != nil || len(ids) != maxEvidence {
+		t.Errorf("store holds %d bundles, %v, want %d", len(ids), err, maxEvidence)
+	}
+	if got := len(sink.Alerts()); got != 0 {
+		t.Errorf("sent %d alerts, want none", got)
+	}
+}
+
+// An evidence store that counts how often it is listed.
+type countingEvidenceStore struct {
+	EvidenceStore
+	lists atomic.Int32
+}
+
+func (s *countingEvidenceStore) List(ctx context.Context) ([]string, error) {
+	s.lists.Add(1)
+	return s.EvidenceStore.List(ctx)
+}
+
+func TestEquivocationsProofFetches(t *testing.T) {
+	l := newTestLog(t, 8)
+	var fetches atomic.Int32
+	logHandler := l.srv.Config.Handler
+	l.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		logHandler.ServeHTTP(w, r)
+	})
+	store := &countingEvidenceStore{EvidenceStore: NewMemoryEvidenceStore()}
+	e, sink, srv := newTestEquivocations(t, l, store)
+	bogusProof := [][]byte{make([]byte, sha256.Size)}
+
+	// Replaying a genuine checkpoint with a bogus proof fetches from the log
+	// at most once every proofInterval.
+	genuine := updateBody(t, l.checkpoint(t, 8), bogusProof)
+	for range 3 {
+		sendUpdate(t, srv, l, genuine)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("replayed updates fetched from the log %d times, want 1", got)
+	}
+
+	// Evidence that is already stored is found before anything is fetched.
+	e.lastProof = make(map[string]time.Time)
+	forked := updateBody(t, forkedCheckpoint(t, l, 8), bogusProof)
+	sendUpdate(t, srv, l, forked)
+	fetched := fetches.Load()
+	e.lastProof = make(map[string]time.Time)
+	for range 3 {
+		sendUpdate(t, srv, l, forked)
+	}
+	if got := fetches.Load(); got != fetched {
+		t.Errorf("replayed evidence fetched from the log %d more times", got-fetched)
+	}
+	e.alerts.Wait()
+	if ids, err := store.EvidenceStore.List(context.Background()); err != nil || len(ids) != 1 {
+		t.Errorf("stored evidence %v, %v, want one bundle", ids, err)
+	}
+	if got := len(sink.Alerts()); got != 1 {
+		t.Errorf("sent %d alerts, want 1", got)
+	}
+	// The store is only listed once, to count the stored bundles.
+	if got := store.lists.Load(); got != 1 {
+		t.Errorf("store listed %d times, want 1", got)
+	}
+}
@@ -0,0 +1,225 @@
+// Implements storage for equivocation evidence, on the local filesystem, in a
+// GCS bucket, or in memory when neither is configured.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	gcs "google.golang.org/api/storage/v1"
+)
+
+var errNoEvidence = errors.New("no evidence with that name")
+
+// Stores evidence by name. Evidence is only ever added, never replaced.
+type EvidenceStore interface {
+	// Put stores data under name, unless something is already stored under it.
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns the data under name, or errNoEvidence.
+	Get(ctx context.Context, name string) ([]byte, error)
+	List(ctx context.Context) ([]string, error)
+}
+
+// NewFileEvidenceStore returns a store that keeps each piece of evidence as a file in dir.
+func NewFileEvidenceStore(dir string) EvidenceStore {
+	return &fileEvidenceStore{dir: dir}
+}
+
+type fileEvidenceStore struct {
+	dir string
+}
+
+func (s *fileEvidenceStore) Put(ctx context.Context, name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create evidence directory: %w", err)
+	}
+
+	// Written to a temporary file first, so that evidence is never partially visible.
+	f, err := os.CreateTemp(s.dir, name+"*"+tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create evidence file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write evidence file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync evidence file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close evidence file: %w", err)
+	}
+	// A link fails instead of replacing evidence that already exists.
+	if err := os.Link(f.Name(), path); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to store evidence file: %w", err)
+	}
+
+	// Sync the directory so that the link itself is durable.
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open evidence directory: %w", err)
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *fileEvidenceStore) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, errNoEvidence
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoEvidence
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read evidence file: %w", err)
+	}
+	return data, nil
+}
+
+func (s *fileEvidenceStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list evidence directory: %w", err)
+	}
+	res := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), tmpSuffix) {
+			res = append(res, e.Name())
+		}
+	}
+	return res, nil
+}
+
+// Helper methods
+
+func (s *fileEvidenceStore) path(name string) (string, error) {
+	if name == "" || !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) || strings.HasSuffix(name, tmpSuffix) {
+		return "", fmt.Errorf("invalid evidence name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// NewGCSEvidenceStore returns a store that keeps each piece of evidence as an
+// object named prefix+name in bucket.
+func NewGCSEvidenceStore(service *gcs.Service, bucket string, prefix string) EvidenceStore {
+	return &gcsEvidenceStore{
+		service: service,
+		bucket:  bucket,
+		prefix:  prefix,
+	}
+}
+
+type gcsEvidenceStore struct {
+	service *gcs.Service
+	bucket  string
+	prefix  string
+}
+
+func (s *gcsEvidenceStore) Put(ctx context.Context, name string, data []byte) error {
+	obj := &gcs.Object{
+		Name:        s.prefix + name,
+		ContentType: "application/json",
+	}
+	// A generation of 0 means that the object must not exist yet.
+	_, err := s.service.Objects.Insert(s.bucket, obj).
+		IfGenerationMatch(0).
+		Media(bytes.NewReader(data)).
+		Context(ctx).
+		Do()
+	if err != nil && !isStatus(err, http.StatusPreconditionFailed) {
+		return fmt.Errorf("failed to store evidence: %w", err)
+	}
+	return nil
+}
+
+func (s *gcsEvidenceStore) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.service.Objects.Get(s.bucket, s.prefix+name).Context(ctx).Download()
+	if isStatus(err, http.StatusNotFound) {
+		return nil, errNoEvidence
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read evidence: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read evidence: %w", err)
+	}
+	return data, nil
+}
+
+func (s *gcsEvidenceStore) List(ctx context.Context) ([]string, error) {
+	res := []string{}
+	err := s.service.Objects.List(s.bucket).Prefix(s.prefix).Pages(ctx, func(objs *gcs.Objects) error {
+		for _, obj := range objs.Items {
+			res = append(res, strings.TrimPrefix(obj.Name, s.prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list evidence: %w", err)
+	}
+	return res, nil
+}
+
+// NewMemoryEvidenceStore returns a store that keeps evidence in memory, so that
+// it is lost when the witness restarts.
+func NewMemoryEvidenceStore() EvidenceStore {
+	return &memoryEvidenceStore{evidence: make(map[string][]byte)}
+}
+
+type memoryEvidenceStore struct {
+	mu       sync.RWMutex
+	evidence map[string][]byte
+}
+
+func (s *memoryEvidenceStore) Put(ctx context.Context, name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.evidence[name]; !ok {
+		s.evidence[name] = bytes.Clone(data)
+	}
+	return nil
+}
+
+func (s *memoryEvidenceStore) Get(ctx context.Context, name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.evidence[name]
+	if !ok {
+		return nil, errNoEvidence
+	}
+	return data, nil
+}
+
+func (s *memoryEvidenceStore) List(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]string, 0, len(s.evidence))
+	for name := range s.evidence {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res, nil
+}
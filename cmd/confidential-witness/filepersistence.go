@@ -0,0 +1,205 @@
+// Implements a persistence object that stores checkpoints on the local filesystem.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/transparency-dev/witness/omniwitness"
+)
+
+// Suffix of files that are still being written and not yet renamed into place.
+const tmpSuffix = ".tmp"
+
+// NewFilePersistence returns a persistence object that stores the latest
+// checkpoint for each log as a file in dir. Files are replaced atomically,
+// so a crash never leaves a partially written checkpoint behind.
+func NewFilePersistence(dir string) omniwitness.LogStatePersistence {
+	return &filePersistence{
+		dir: dir,
+	}
+}
+
+type filePersistence struct {
+	dir string
+
+	// mu allows checkpoints to be read concurrently, but
+	// exclusively locked for writing.
+	mu sync.RWMutex
+
+	// Interrupted writes are only cleaned up once, before any write of this
+	// process, so that a later Init can never remove a write in progress.
+	initOnce sync.Once
+	initErr  error
+}
+
+func (p *filePersistence) Init() error {
+	p.initOnce.Do(func() {
+		p.initErr = p.init()
+	})
+	return p.initErr
+}
+
+func (p *filePersistence) Logs() ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state directory: %w", err)
+	}
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), tmpSuffix) {
+			res = append(res, e.Name())
+		}
+	}
+	return res, nil
+}
+
+func (p *filePersistence) ReadOps(logID string) (omniwitness.LogStateReadOps, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cp, err := p.read(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{
+		read: cp,
+	}, nil
+}
+
+func (p *filePersistence) WriteOps(logID string) (omniwitness.LogStateWriteOps, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cp, err := p.read(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{
+		write: func(old *checkpointState, new checkpointState) error {
+			return p.expectAndWrite(logID, old, new)
+		},
+		read: cp,
+	}, nil
+}
+
+func (p *filePersistence) expectAndWrite(logID string, old *checkpointState, new checkpointState) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	got, err := p.read(logID)
+	if err != nil {
+		return err
+	}
+
+	// Detect the possible conflicts
+	if old != nil {
+		if got == nil {
+			return fmt.Errorf("expected old state %v but no state found when updating log %s", *old, logID)
+		}
+		if !bytes.Equal(old.rawChkpt, got.rawChkpt) {
+			return fmt.Errorf("expected old state %v but got %s when updating log %s", *old, *got, logID)
+		}
+	} else {
+		if got != nil {
+			return fmt.Errorf("expected no state but found %v when updating log %s", *got, logID)
+		}
+	}
+
+	return p.write(logID, new.rawChkpt)
+}
+
+// Helper methods
+
+// Creates the state directory and removes any writes that were interrupted
+// before being renamed into place.
+func (p *filePersistence) init() error {
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	// Remove any writes that were interrupted before being renamed into place.
+	tmps, err := filepath.Glob(filepath.Join(p.dir, "*"+tmpSuffix))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return fmt.Errorf("failed to remove interrupted write: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns the stored state for logID, or nil if there is none.
+func (p *filePersistence) read(logID string) (*checkpointState, error) {
+	path, err := p.path(logID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint for log %s: %w", logID, err)
+	}
+	return &checkpointState{rawChkpt: raw}, nil
+}
+
+// Atomically replaces the stored state for logID with data.
+func (p *filePersistence) write(logID string, data []byte) error {
+	path, err := p.path(logID)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Returns the file that holds the state for logID.
+func (p *filePersistence) path(logID string) (string, error) {
+	// Log IDs are hex encoded hashes, but never let one escape the state directory.
+	if logID == "" || !filepath.IsLocal(logID) || strings.ContainsAny(logID, `/\`) || strings.HasSuffix(logID, tmpSuffix) {
+		return "", fmt.Errorf("invalid log ID %q", logID)
+	}
+	return filepath.Join(p.dir, logID), nil
+}
+
+/// Helper functions
+
+// Atomically and durably replaces the file at path with data.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilePersistence(t *testing.T) {
+	dir := t.TempDir()
+	p := NewFilePersistence(dir)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	write, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := write.GetLatest(); status.Code(err) != codes.NotFound {
+		t.Fatalf("GetLatest() of a new log = %v, want NotFound", err)
+	}
+	if err := write.Set([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer that read before the first write must not overwrite it.
+	stale, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Set([]byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Set([]byte("three")); err == nil {
+		t.Error("Set() with stale state succeeded")
+	}
+
+	// State survives reopening the directory.
+	p = NewFilePersistence(dir)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	read, err := p.ReadOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read.GetLatest(); err != nil || string(got) != "two" {
+		t.Errorf("GetLatest() = %q, %v, want %q", got, err, "two")
+	}
+	if logs, err := p.Logs(); err != nil || len(logs) != 1 || logs[0] != "log" {
+		t.Errorf("Logs() = %v, %v, want [log]", logs, err)
+	}
+
+	if _, err := p.WriteOps("../escape"); err == nil {
+		t.Error("WriteOps() accepted a log ID outside the directory")
+	}
+}
+
+// Interrupted writes are removed by the first Init only, as later calls can
+// race with writes in progress.
+func TestFilePersistenceInitOnce(t *testing.T) {
+	dir := t.TempDir()
+	interrupted := filepath.Join(dir, "a"+tmpSuffix)
+	if err := os.WriteFile(interrupted, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewFilePersistence(dir)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(interrupted); !os.IsNotExist(err) {
+		t.Fatalf("interrupted write was not removed: %v", err)
+	}
+
+	inProgress := filepath.Join(dir, "b"+tmpSuffix)
+	if err := os.WriteFile(inProgress, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Fatalf("second Init() removed a write in progress: %v", err)
+	}
+}
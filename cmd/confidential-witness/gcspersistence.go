@@ -0,0 +1,150 @@
+// Implements a persistence object that stores checkpoints in a GCS bucket.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"google.golang.org/api/googleapi"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// NewGCSPersistence returns a persistence object that stores the latest
+// checkpoint for each log as an object named prefix+logID in bucket.
+//
+// Each object's generation number is used as the precondition for writes,
+// so a write fails if the object changed since it was read, whether due to a
+// concurrent writer or an older snapshot being restored.
+//
+// The service can point at a local fake GCS server with option.WithEndpoint.
+func NewGCSPersistence(ctx context.Context, service *gcs.Service, bucket string, prefix string) omniwitness.LogStatePersistence {
+	return &gcsPersistence{
+		service: service,
+		bucket:  bucket,
+		prefix:  prefix,
+		ctx:     ctx,
+	}
+}
+
+type gcsPersistence struct {
+	service *gcs.Service
+	bucket  string
+	prefix  string
+	ctx     context.Context
+}
+
+func (p *gcsPersistence) Init() error {
+	if _, err := p.service.Buckets.Get(p.bucket).Context(p.ctx).Do(); err != nil {
+		return fmt.Errorf("failed to access state bucket: %w", err)
+	}
+	return nil
+}
+
+func (p *gcsPersistence) Logs() ([]string, error) {
+	res := []string{}
+	err := p.service.Objects.List(p.bucket).Prefix(p.prefix).Pages(p.ctx, func(objs *gcs.Objects) error {
+		for _, obj := range objs.Items {
+			res = append(res, strings.TrimPrefix(obj.Name, p.prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state bucket: %w", err)
+	}
+	return res, nil
+}
+
+func (p *gcsPersistence) ReadOps(logID string) (omniwitness.LogStateReadOps, error) {
+	cp, _, err := p.read(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{
+		read: cp,
+	}, nil
+}
+
+func (p *gcsPersistence) WriteOps(logID string) (omniwitness.LogStateWriteOps, error) {
+	cp, generation, err := p.read(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{
+		// The generation that was read stands in for the old state,
+		// so the old checkpoint itself does not need to be compared.
+		write: func(_ *checkpointState, new checkpointState) error {
+			return p.expectAndWrite(logID, generation, new)
+		},
+		read: cp,
+	}, nil
+}
+
+// Writes new only if the object for logID is still at generation.
+// A generation of 0 means that the object must not exist.
+func (p *gcsPersistence) expectAndWrite(logID string, generation int64, new checkpointState) error {
+	obj := &gcs.Object{
+		Name:        p.name(logID),
+		ContentType: "text/plain",
+	}
+	_, err := p.service.Objects.Insert(p.bucket, obj).
+		IfGenerationMatch(generation).
+		Media(bytes.NewReader(new.rawChkpt)).
+		Context(p.ctx).
+		Do()
+	if isStatus(err, http.StatusPreconditionFailed) {
+		if generation == 0 {
+			return fmt.Errorf("expected no state but found a checkpoint when updating log %s", logID)
+		}
+		return fmt.Errorf("expected old state at generation %d but it changed when updating log %s", generation, logID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint for log %s: %w", logID, err)
+	}
+	return nil
+}
+
+// Helper methods
+
+// Returns the stored state for logID and its generation, or nil and 0 if there is none.
+func (p *gcsPersistence) read(logID string) (*checkpointState, int64, error) {
+	attrs, err := p.service.Objects.Get(p.bucket, p.name(logID)).Context(p.ctx).Do()
+	if isStatus(err, http.StatusNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read checkpoint for log %s: %w", logID, err)
+	}
+
+	// Download exactly the generation that was just described,
+	// so the contents always match the generation used as the precondition.
+	resp, err := p.service.Objects.Get(p.bucket, p.name(logID)).Generation(attrs.Generation).Context(p.ctx).Download()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read checkpoint for log %s: %w", logID, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read checkpoint for log %s: %w", logID, err)
+	}
+	return &checkpointState{rawChkpt: raw}, attrs.Generation, nil
+}
+
+func (p *gcsPersistence) name(logID string) string {
+	return p.prefix + logID
+}
+
+/// Helper functions
+
+// Reports whether err is a GCS API error with the HTTP status code.
+func isStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
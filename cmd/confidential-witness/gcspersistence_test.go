@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aditsachde/confidential-witness/internal/fakegcs"
+	"github.com/transparency-dev/witness/omniwitness"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testBucket = "witness-state"
+
+// Starts a fake GCS server with an empty state bucket, returning a backend for it.
+func newFakeGCSPersistence(t *testing.T) (*fakegcs.Server, omniwitness.LogStatePersistence) {
+	t.Helper()
+	srv := fakegcs.New(testBucket)
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+	service, err := srv.Service(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewGCSPersistence(ctx, service, testBucket, "checkpoints/")
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, p
+}
+
+func TestGCSPersistenceInitMissingBucket(t *testing.T) {
+	srv := fakegcs.New()
+	defer srv.Close()
+	ctx := context.Background()
+	service, err := srv.Service(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGCSPersistence(ctx, service, testBucket, "").Init(); err == nil {
+		t.Error("Init() with a missing bucket succeeded")
+	}
+}
+
+func TestGCSPersistenceFirstWrite(t *testing.T) {
+	srv, p := newFakeGCSPersistence(t)
+
+	read, err := p.ReadOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read.GetLatest(); status.Code(err) != codes.NotFound {
+		t.Fatalf("GetLatest() of a new log = %v, want NotFound", err)
+	}
+
+	write, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set([]byte("one")); err != nil {
+		t.Fatalf("first Set() = %v", err)
+	}
+	if got, ok := srv.Get(testBucket, "checkpoints/log"); !ok || string(got) != "one" {
+		t.Errorf("stored object = %q, %v, want %q", got, ok, "one")
+	}
+
+	// A second writer that also saw no state must not overwrite the first write.
+	srv.Delete(testBucket, "checkpoints/log")
+	racing, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Put(testBucket, "checkpoints/log", []byte("other"))
+	if err := racing.Set([]byte("two")); err == nil {
+		t.Error("Set() over a concurrently created object succeeded")
+	}
+}
+
+func TestGCSPersistenceGenerationConflict(t *testing.T) {
+	srv, p := newFakeGCSPersistence(t)
+	srv.Put(testBucket, "checkpoints/log", []byte("one"))
+
+	stale, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := stale.GetLatest(); err != nil || string(got) != "one" {
+		t.Fatalf("GetLatest() = %q, %v, want %q", got, err, "one")
+	}
+
+	next, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Set([]byte("two")); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	if err := stale.Set([]byte("three")); err == nil {
+		t.Error("Set() with a stale generation succeeded")
+	}
+
+	// Restoring an older snapshot creates a new generation, so writers that
+	// read before the restore also fail.
+	before, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Put(testBucket, "checkpoints/log", []byte("one"))
+	if err := before.Set([]byte("four")); err == nil {
+		t.Error("Set() across a restore succeeded")
+	}
+	if got, _ := srv.Get(testBucket, "checkpoints/log"); string(got) != "one" {
+		t.Errorf("stored object = %q, want %q", got, "one")
+	}
+}
+
+func TestGCSPersistenceLogs(t *testing.T) {
+	srv, p := newFakeGCSPersistence(t)
+	srv.Put(testBucket, "checkpoints/a", []byte("a"))
+	srv.Put(testBucket, "checkpoints/b", []byte("b"))
+	srv.Put(testBucket, "evidence/c", []byte("c"))
+
+	logs, err := p.Logs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0] != "a" || logs[1] != "b" {
+		t.Errorf("Logs() = %v, want [a b]", logs)
+	}
+}
@@ -0,0 +1,143 @@
+// Implements liveness and readiness endpoints for the instance group health check.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/transparency-dev/witness/api"
+	"github.com/transparency-dev/witness/omniwitness"
+)
+
+// A few failed canary signatures are tolerated before the witness is considered broken.
+const canaryMaxAge = 3 * canaryInterval
+
+type Health struct {
+	canary *Canary
+	client *http.Client
+
+	mu               sync.RWMutex
+	witnessURL       string
+	persistenceReady func() error
+}
+
+func NewHealth(canary *Canary) *Health {
+	return &Health{
+		canary: canary,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Sets the address the omniwitness listener is bound to, so that readiness can probe it.
+func (h *Health) SetWitnessAddr(addr net.Addr) {
+	_, port, _ := net.SplitHostPort(addr.String())
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.witnessURL = "http://" + net.JoinHostPort("localhost", port) + api.HTTPGetLogs
+}
+
+// Sets the function reporting why persistence is not ready, if it is not.
+func (h *Health) SetPersistenceReady(ready func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.persistenceReady = ready
+}
+
+// Reports that the process is alive. This is what auto-healing checks, so it
+// depends on nothing outside the process: replacing the instance does not fix
+// a KMS outage, and bootstrap can legitimately take longer than the instance
+// group allows for startup.
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	respond(w, nil)
+}
+
+// Reports whether the witness is able to serve and cosign checkpoints: it can
+// sign, is serving the witness API, and persistence is initialized and bootstrapped.
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	problems := h.serving(r.Context())
+	h.mu.RLock()
+	persistenceReady := h.persistenceReady
+	h.mu.RUnlock()
+	if persistenceReady == nil {
+		problems = append(problems, "persistence: not initialized")
+	} else if err := persistenceReady(); err != nil {
+		problems = append(problems, fmt.Sprintf("persistence: %v", err))
+	}
+	respond(w, problems)
+}
+
+// Helper methods
+
+// Returns the reasons the witness cannot sign or serve the witness API, if any.
+func (h *Health) serving(ctx context.Context) []string {
+	lastSuccess, lastErr := h.canary.Last()
+	h.mu.RLock()
+	witnessURL := h.witnessURL
+	h.mu.RUnlock()
+
+	var problems []string
+	if lastSuccess.IsZero() || time.Since(lastSuccess) > canaryMaxAge {
+		problem := "signing: no recent successful canary signature"
+		if lastErr != nil {
+			problem += fmt.Sprintf(", last error: %v", lastErr)
+		}
+		problems = append(problems, problem)
+	}
+
+	if witnessURL == "" {
+		problems = append(problems, "witness: not listening")
+	} else if err := h.probe(ctx, witnessURL); err != nil {
+		problems = append(problems, fmt.Sprintf("witness: %v", err))
+	}
+	return problems
+}
+
+func (h *Health) probe(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+/// Helper functions
+
+// Returns a readiness check that lists the logs in p, so that a backend that can
+// no longer be reached is reported, and that done reports true, unless it is nil.
+func persistenceReady(p omniwitness.LogStatePersistence, done func() bool) func() error {
+	return func() error {
+		if done != nil && !done() {
+			return errors.New("not bootstrapped")
+		}
+		if _, err := p.Logs(); err != nil {
+			return fmt.Errorf("backend unavailable: %w", err)
+		}
+		return nil
+	}
+}
+
+func respond(w http.ResponseWriter, problems []string) {
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
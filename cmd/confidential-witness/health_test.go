@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/witness/omniwitness"
+)
+
+// A persistence whose backend cannot be reached.
+type unavailablePersistence struct {
+	omniwitness.LogStatePersistence
+}
+
+func (unavailablePersistence) Logs() ([]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHealthReadyz(t *testing.T) {
+	canary := NewCanary(newTestNoteKms(t), time.Minute)
+	canary.check()
+	h := NewHealth(canary)
+	witness := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer witness.Close()
+	h.SetWitnessAddr(witness.Listener.Addr())
+
+	bootstrapped := false
+	for _, tc := range []struct {
+		name  string
+		ready func() error
+		want  string
+	}{
+		{"uninitialized", nil, "not initialized"},
+		{"ready", persistenceReady(NewPersistence(), nil), ""},
+		{"unavailable", persistenceReady(unavailablePersistence{}, nil), "backend unavailable"},
+		{"bootstrapping", persistenceReady(NewPersistence(), func() bool { return bootstrapped }), "not bootstrapped"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h.SetPersistenceReady(tc.ready)
+			rec := httptest.NewRecorder()
+			h.Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if tc.want == "" {
+				if rec.Code != http.StatusOK {
+					t.Errorf("Readyz() = %d %q, want OK", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), tc.want) {
+				t.Errorf("Readyz() = %d %q, want %q", rec.Code, rec.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestHealthReadyzServing(t *testing.T) {
+	witness := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer witness.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	for _, tc := range []struct {
+		name    string
+		signed  bool
+		witness *httptest.Server
+		want    string
+	}{
+		{"no canary signature", false, witness, "signing"},
+		{"not listening", true, nil, "witness: not listening"},
+		{"witness failing", true, failing, "witness"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			canary := NewCanary(newTestNoteKms(t), time.Minute)
+			if tc.signed {
+				canary.check()
+			}
+			h := NewHealth(canary)
+			if tc.witness != nil {
+				h.SetWitnessAddr(tc.witness.Listener.Addr())
+			}
+			h.SetPersistenceReady(persistenceReady(NewPersistence(), nil))
+			rec := httptest.NewRecorder()
+			h.Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), tc.want) {
+				t.Errorf("Readyz() = %d %q, want %q", rec.Code, rec.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestHealthHealthz(t *testing.T) {
+	// Liveness depends on nothing outside the process: not on signing,
+	// the witness API or persistence.
+	h := NewHealth(NewCanary(newTestNoteKms(t), time.Minute))
+	h.SetPersistenceReady(persistenceReady(unavailablePersistence{}, func() bool { return false }))
+	rec := httptest.NewRecorder()
+	h.Healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("Healthz() = %d %q, want OK", rec.Code, rec.Body)
+	}
+}
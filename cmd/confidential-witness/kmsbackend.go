@@ -0,0 +1,126 @@
+// Implements the SigningBackend interface for Ed25519 keys stored in GCP KMS.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type KmsBackend struct {
+	gcpclient  *kms.KeyManagementClient
+	gcpkeyname string
+}
+
+// NewKmsBackend constructs a SigningBackend for the Ed25519 key
+// version (EC_SIGN_ED25519) kmskeyname stored in GCP KMS.
+func NewKmsBackend(client *kms.KeyManagementClient, kmskeyname string) *KmsBackend {
+	return &KmsBackend{
+		gcpclient:  client,
+		gcpkeyname: kmskeyname,
+	}
+}
+
+func (k *KmsBackend) PublicKey(ctx context.Context) (ed25519.PublicKey, error) {
+	publicKey, err := k.gcpclient.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{
+		Name: k.gcpkeyname,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	// Perform the same integrity verification as on signatures.
+	if publicKey.Name != k.gcpkeyname {
+		return nil, fmt.Errorf("GetPublicKey: request corrupted in-transit")
+	}
+	if int64(crc32c([]byte(publicKey.Pem))) != publicKey.GetPemCrc32C().GetValue() {
+		kmsCrcFailures.WithLabelValues("GetPublicKey").Inc()
+		return nil, fmt.Errorf("GetPublicKey: response corrupted in-transit")
+	}
+	if publicKey.Algorithm != kmspb.CryptoKeyVersion_EC_SIGN_ED25519 {
+		return nil, fmt.Errorf("invalid key algorithm %s, not EC_SIGN_ED25519", publicKey.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(publicKey.Pem))
+	if block == nil {
+		return nil, errors.New("failed to decode public key pem")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	pubkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid public key, not ed25519")
+	}
+
+	return pubkey, nil
+}
+
+func (k *KmsBackend) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	sig, err := k.sign(ctx, msg)
+	if err != nil {
+		kmsSignErrors.Inc()
+	}
+	return sig, err
+}
+
+// Helper methods
+
+func (k *KmsBackend) sign(ctx context.Context, msg []byte) ([]byte, error) {
+	// Build the signing request.
+	//
+	// Note: Key algorithms will require a varying hash function. For example,
+	// EC_SIGN_P384_SHA384 requires SHA-384.
+	req := &kmspb.AsymmetricSignRequest{
+		Name:       k.gcpkeyname,
+		Data:       msg,
+		DataCrc32C: wrapperspb.Int64(int64(crc32c(msg))),
+	}
+
+	// Call the API.
+	start := time.Now()
+	result, err := k.gcpclient.AsymmetricSign(ctx, req)
+	observeSince(kmsSignLatency, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign digest: %w", err)
+	}
+
+	// Optional, but recommended: perform integrity verification on result.
+	// For more details on ensuring E2E in-transit integrity to and from Cloud KMS visit:
+	// https://cloud.google.com/kms/docs/data-integrity-guidelines
+	if result.VerifiedDataCrc32C == false {
+		kmsCrcFailures.WithLabelValues("AsymmetricSign").Inc()
+		return nil, fmt.Errorf("AsymmetricSign: request corrupted in-transit 1")
+	}
+	if result.Name != req.Name {
+		return nil, fmt.Errorf("AsymmetricSign: request corrupted in-transit 2")
+	}
+	if int64(crc32c(result.Signature)) != result.GetSignatureCrc32C().GetValue() {
+		kmsCrcFailures.WithLabelValues("AsymmetricSign").Inc()
+		return nil, fmt.Errorf("AsymmetricSign: response corrupted in-transit 3")
+	}
+
+	return result.Signature, nil
+}
+
+var _ SigningBackend = (*KmsBackend)(nil)
+
+/// Helper functions
+
+// Calculate the CRC32C checksum of the data.
+func crc32c(data []byte) uint32 {
+	t := crc32.MakeTable(crc32.Castagnoli)
+	return crc32.Checksum(data, t)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/aditsachde/confidential-witness/internal/fakekms"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testKeyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+
+// Starts a fake KMS with a single key, returning a backend for it and its public key.
+func newFakeKmsBackend(t *testing.T) (*fakekms.Server, *KmsBackend, ed25519.PublicKey) {
+	t.Helper()
+	srv, err := fakekms.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	pub, err := srv.AddKey(testKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := srv.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return srv, NewKmsBackend(client, testKeyName), pub
+}
+
+func TestKmsBackendPublicKey(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		faults  fakekms.Faults
+		keyName string
+		wantErr string
+	}{
+		{name: "ok"},
+		{name: "unknown key", keyName: testKeyName + "0", wantErr: "failed to get public key"},
+		{name: "wrong name", faults: fakekms.Faults{WrongName: true}, wantErr: "request corrupted in-transit"},
+		{name: "crc mismatch", faults: fakekms.Faults{CorruptPemCRC: true}, wantErr: "response corrupted in-transit"},
+		{name: "wrong algorithm", faults: fakekms.Faults{WrongAlgorithm: true}, wantErr: "invalid key algorithm"},
+		{name: "nil pem", faults: fakekms.Faults{InvalidPem: true}, wantErr: "failed to decode public key pem"},
+		{name: "transport error", faults: fakekms.Faults{Err: status.Error(codes.PermissionDenied, "denied")}, wantErr: "failed to get public key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, backend, want := newFakeKmsBackend(t)
+			srv.SetFaults(tc.faults)
+			if tc.keyName != "" {
+				backend.gcpkeyname = tc.keyName
+			}
+
+			got, err := backend.PublicKey(context.Background())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("PublicKey() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PublicKey() = %v", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("PublicKey() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestKmsBackendSign(t *testing.T) {
+	msg := []byte("cosignature/v1\ntime 1\nexample.com/log\n1\nhash\n")
+	for _, tc := range []struct {
+		name    string
+		faults  fakekms.Faults
+		wantErr string
+	}{
+		{name: "ok"},
+		{name: "unverified data crc", faults: fakekms.Faults{UnverifiedDataCRC: true}, wantErr: "request corrupted in-transit 1"},
+		{name: "wrong name", faults: fakekms.Faults{WrongName: true}, wantErr: "request corrupted in-transit 2"},
+		{name: "crc mismatch", faults: fakekms.Faults{CorruptSignatureCRC: true}, wantErr: "response corrupted in-transit 3"},
+		{name: "transport error", faults: fakekms.Faults{Err: status.Error(codes.PermissionDenied, "denied")}, wantErr: "failed to sign digest"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, backend, pub := newFakeKmsBackend(t)
+			srv.SetFaults(tc.faults)
+
+			sig, err := backend.Sign(context.Background(), msg)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Sign() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Sign() = %v", err)
+			}
+			if !ed25519.Verify(pub, msg, sig) {
+				t.Error("signature does not verify")
+			}
+		})
+	}
+}
+
+// A signature that passes the CRC32C checks but was corrupted is caught by NoteKms.
+func TestNoteKmsRejectsCorruptSignature(t *testing.T) {
+	srv, backend, _ := newFakeKmsBackend(t)
+	n, err := NewNoteKms(context.Background(), backend, "example.com/witness", NewClock(ClockClamp, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("example.com/log\n1\nhash\n")
+	if _, err := n.Sign(msg); err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+
+	srv.SetFaults(fakekms.Faults{CorruptSignature: true})
+	if _, err := n.Sign(msg); err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Fatalf("Sign() with a corrupt signature = %v, want verification error", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Helpers for the logs witnessed by omniwitness.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// A log that omniwitness is configured to witness
+type witnessedLog struct {
+	id       string
+	origin   string
+	vkey     string
+	verifier note.Verifier
+
+	// Where and how omniwitness feeds the log, which is also
+	// where consistency proofs for it are fetched from.
+	url    string
+	feeder omniwitness.Feeder
+}
+
+// Returns the logs configured in omniwitness, keyed by log ID
+func getLogs() (map[string]witnessedLog, error) {
+	logCfg := omniwitness.LogConfig{}
+	if err := yaml.Unmarshal(omniwitness.ConfigLogs, &logCfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal witness config: %w", err)
+	}
+	logMap, err := logCfg.AsLogMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert witness config to map: %w", err)
+	}
+
+	// The log map only keeps the parsed verifier, but evidence needs the key itself.
+	infos := make(map[string]omniwitness.LogInfo, len(logCfg.Logs))
+	for _, l := range logCfg.Logs {
+		infos[l.Origin] = l
+	}
+
+	logs := make(map[string]witnessedLog, len(logMap))
+	for id, l := range logMap {
+		logs[id] = witnessedLog{
+			id:       id,
+			origin:   l.Origin,
+			vkey:     infos[l.Origin].PublicKey,
+			verifier: l.SigV,
+			url:      infos[l.Origin].URL,
+			feeder:   infos[l.Origin].Feeder,
+		}
+	}
+	return logs, nil
+}
+
+// Parses a checkpoint for l, returning the note with only the signatures from
+// l and the witnesses that were verified.
+func (l witnessedLog) parse(raw []byte, witnesses ...note.Verifier) (*log.Checkpoint, *note.Note, error) {
+	cp, _, n, err := log.ParseCheckpoint(raw, l.origin, l.verifier, witnesses...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cp, n, nil
+}
+
+// Returns the latest checkpoint for l stored in p, or nil if there is none.
+func (l witnessedLog) latest(p omniwitness.LogStatePersistence, witnesses ...note.Verifier) (*log.Checkpoint, *note.Note, error) {
+	read, err := p.ReadOps(l.id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ReadOps(): %w", err)
+	}
+	raw, err := read.GetLatest()
+	if status.Code(err) == codes.NotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("GetLatest(): %w", err)
+	}
+	return l.parse(raw, witnesses...)
+}
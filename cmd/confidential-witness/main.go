@@ -1,74 +1,320 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/transparency-dev/witness/monitoring"
+	"github.com/transparency-dev/witness/monitoring/prometheus"
 	"github.com/transparency-dev/witness/omniwitness"
 	"golang.org/x/mod/sumdb/note"
 	"google.golang.org/api/option"
+	gcs "google.golang.org/api/storage/v1"
 )
 
 func main() {
+	started := time.Now()
 	o_ctx, cancel := context.WithTimeout(context.Background(), 22*time.Hour)
 	defer cancel()
 	meta := getMetadata(o_ctx)
 
 	// Keygen
-	// The key is seeded by a fixed seed. See getSeed for details.
-	client, err := getClient(o_ctx, meta)
+	var backend SigningBackend
+	if meta.devMode {
+		log.Println("WARNING: running in insecure dev mode, the signing key is not protected by KMS")
+		devBackend, err := NewDevBackend(meta.key)
+		if err != nil {
+			log.Fatalln("Failed to create dev signer:", err)
+		}
+		backend = devBackend
+	} else {
+		client, err := getClient(o_ctx, meta)
+		if err != nil {
+			log.Fatalln("Failed to create KMS client:", err)
+		}
+		defer client.Close()
+		backend = NewKmsBackend(client, meta.key)
+	}
+
+	// Alerts
+	// Sent to every configured sink, for events that need an operator.
+	var sinks []AlertSink
+	for _, s := range meta.alertSinks {
+		sink, err := ParseAlertSink(s, &http.Client{})
+		if err != nil {
+			log.Fatalln("Invalid WITNESS_ALERT_SINKS:", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	alerts := NewAlerter(getName(meta), sinks, meta.alertInterval)
+
+	// Every call to the backend gets its own deadline, instead of the 22 hour one.
+	backend, err := NewRetryingBackend(backend, meta.sign, alerts)
 	if err != nil {
-		log.Fatalln("Failed to create KMS client:", err)
+		log.Fatalln("Invalid signing configuration:", err)
+	}
+
+	// Trusted time
+	// Signing is blocked unless the clock agrees with the Roughtime servers, if configured.
+	var timeCheck *TimeCheck
+	if len(meta.timeCheck.Servers) > 0 {
+		timeCheck, err = NewTimeCheck(meta.timeCheck)
+		if err != nil {
+			log.Fatalln("Invalid time verification configuration:", err)
+		}
+		if err := timeCheck.CheckOnce(o_ctx); err != nil {
+			log.Println("Initial time verification failed:", err)
+		}
+		go timeCheck.Run(o_ctx)
 	}
-	defer client.Close()
 
-	noteKms, err := NewNoteKms(o_ctx, client, meta.key, meta.name)
+	clock := NewClock(meta.clockPolicy, timeCheck)
+	noteKms, err := NewNoteKms(o_ctx, backend, meta.name, clock, nil)
 	if err != nil {
 		log.Fatalln("Failed to create NoteKms:", err)
 	}
 
+	// The key material behind WITNESS_KEY is not covered by the launch policy,
+	// so refuse to sign under any identity other than the pinned one.
+	if meta.vkey != "" && noteKms.PublicKey() != meta.vkey {
+		log.Fatalf("Verifier key %s does not match WITNESS_VKEY %s", noteKms.PublicKey(), meta.vkey)
+	}
+
+	// Storage
+	// A state bucket keeps the cosignature log, state and evidence across VMs.
+	var storageClient *gcs.Service
+	if meta.stateBucket != "" {
+		storageClient, err = getStorageClient(o_ctx, meta)
+		if err != nil {
+			log.Fatalln("Failed to create storage client:", err)
+		}
+	}
+
+	// Cosignature log
+	// Every cosignature is appended to a log that continues across restarts,
+	// served on port 8080. Its checkpoints are sealed with the witness key.
+	var mirror *SigLogMirror
+	if meta.stateBucket != "" {
+		mirror = NewSigLogMirror(storageClient, meta.stateBucket, "cosignatures/"+getName(meta)+"/")
+	}
+	sigLog, err := NewSigLog(o_ctx, meta.cosigLogDir, noteKms.SigLogSealer(getName(meta)+"/cosignatures"), mirror)
+	if err != nil {
+		log.Fatalln("Failed to open cosignature log:", err)
+	}
+	noteKms.SetSigLog(sigLog)
+	// Cosignature timestamps continue from the highest one ever released, as
+	// recorded by the cosignature log, which covers every cosignature.
+	clock.Observe(sigLog.Issued())
+
+	// Canary
+	// Signs a test note on an interval, so that signing failures show up in
+	// metrics and readiness before clients see invalid cosignatures.
+	canary := NewCanary(noteKms, canaryInterval)
+	go canary.Run(o_ctx)
+
+	// Health
+	// Liveness requires a recent canary signature, so that broken instances get replaced.
+	health := NewHealth(canary)
+
 	// Serve the public key on port 8080 so that it is actually accessible somewhere.
 	// Confidential spaces disable logs on production workloads.
 	revision, modified := getRevision()
 	publicKey := noteKms.PublicKey()
+	if meta.devMode {
+		publicKey = devModeBanner + "\n\n" + publicKey
+	}
+	attester, err := NewAttester(meta.launcherSocket, meta.attestationAudience, meta.audience, noteKms.PublicKey())
+	if err != nil {
+		log.Fatalln("Invalid WITNESS_ATTESTATION_AUDIENCE:", err)
+	}
 	go func() {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, publicKey+"\n\n"+revision+"\n"+modified)
 		})
+		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/healthz", health.Healthz)
+		http.HandleFunc("/readyz", health.Readyz)
+		http.Handle("/cosignatures/", http.StripPrefix("/cosignatures", sigLog.Handler(unloggedSigner{noteKms})))
+		http.Handle("/attestation", attester)
 		http.ListenAndServe(":8080", nil)
 	}()
 
+	// Cosignatures are reused for unchanged checkpoints, instead of signing them again with KMS.
+	var o_signer note.Signer = noteKms
+	if meta.cosigCacheWindow > 0 {
+		o_signer = NewCachingSigner(noteKms, meta.cosigCacheWindow)
+	}
+
 	o_operatorConfig := omniwitness.OperatorConfig{
-		WitnessKeys:     []note.Signer{noteKms},
+		WitnessKeys:     []note.Signer{o_signer},
 		WitnessVerifier: noteKms,
 		FeedInterval:    time.Minute,
 	}
 
-	// Persistence
-	// TOFU on startup
-	o_p := NewPersistence()
+	// Outbound
+	var o_httpClient *http.Client = &http.Client{}
+
+	logs, err := getLogs()
+	if err != nil {
+		log.Fatalln("Failed to load log config:", err)
+	}
 
 	// Listener
+	// omniwitness only listens locally, behind a proxy on port 80 that
+	// captures evidence from the updates it rejects. The public listener is
+	// served before state is loaded, so that restarting peers can fetch their sealed heads.
 	var o_httpListener net.Listener
-	o_httpListener, err = net.Listen("tcp", ":80")
+	o_httpListener, err = net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		log.Fatalln("Failed to start listener:", err)
 	}
+	publicListener, err := net.Listen("tcp", ":80")
+	if err != nil {
+		log.Fatalln("Failed to start listener:", err)
+	}
+	publicMux := http.NewServeMux()
+	go func() {
+		log.Println("Witness proxy exited:", http.Serve(publicListener, publicMux))
+	}()
 
-	// Outbound
-	var o_httpClient *http.Client = &http.Client{}
+	// Persistence
+	// TOFU on startup, unless a state bucket or directory survives restarts.
+	var o_p omniwitness.LogStatePersistence
+	if meta.stateBucket != "" {
+		o_p = NewGCSPersistence(o_ctx, storageClient, meta.stateBucket, "checkpoints/")
+	} else if meta.stateDir != "" {
+		o_p = NewFilePersistence(meta.stateDir)
+	} else {
+		o_p = NewPersistence()
+	}
+
+	// Durable state is sealed with the witness key, so that whoever controls
+	// the disk or bucket can neither forge it nor roll it back undetected.
+	// Rollbacks are detected with the newest sealed head held by peers, which
+	// keep the heads of other instances next to their own state. State that
+	// no peer vouches for is seeded again from distributors, or must be empty.
+	if meta.stateBucket != "" || meta.stateDir != "" {
+		if len(meta.peers) == 0 && len(meta.bootstrap.Distributors) == 0 {
+			log.Fatalln("Durable state requires WITNESS_PEERS or WITNESS_BOOTSTRAP_DISTRIBUTORS, as rollbacks cannot be detected otherwise")
+		}
+		var headStore omniwitness.LogStatePersistence
+		if meta.stateBucket != "" {
+			headStore = NewGCSPersistence(o_ctx, storageClient, meta.stateBucket, "sealed-heads/")
+		} else {
+			headStore = NewFilePersistence(filepath.Join(meta.stateDir, "sealed-heads"))
+		}
+		heads, err := NewSealHeads(getName(meta), noteKms.Sealer(), meta.peers, o_httpClient, headStore)
+		if err != nil {
+			log.Fatalln("Failed to load sealed heads:", err)
+		}
+		unproven := AcceptEmpty
+		if len(meta.bootstrap.Distributors) > 0 {
+			unproven = Reseed
+		}
+		sealed := NewSealedPersistence(o_p, noteKms.Sealer(), getName(meta), func() (map[string]uint64, error) {
+			return heads.Known(o_ctx)
+		}, unproven)
+		publicMux.Handle("/sealed/", http.StripPrefix("/sealed", heads.Handler(sealed.Head)))
+		if len(meta.peers) > 0 {
+			go func() {
+				if err := heads.Run(o_ctx, meta.peerInterval); err != nil {
+					log.Println("Sealed head exchange exited:", err)
+				}
+			}()
+		}
+		o_p = sealed
+	}
+	if err := o_p.Init(); err != nil {
+		log.Fatalln("Failed to initialize persistence:", err)
+	}
+	// And from the highest one in the stored state, in case the cosignature log
+	// was lost while the state was not.
+	highest, err := highestCosignature(o_p, logs, noteKms)
+	if err != nil {
+		log.Fatalln("Failed to read cosignature timestamps:", err)
+	}
+	clock.Observe(highest)
+	health.SetPersistenceReady(persistenceReady(o_p, nil))
+
+	// Equivocations
+	// Evidence is kept alongside the state, unless a directory is given for it.
+	// Without durable state, it is only kept in memory.
+	var evidence EvidenceStore
+	switch {
+	case meta.equivocationDir != "":
+		evidence = NewFileEvidenceStore(meta.equivocationDir)
+	case meta.stateBucket != "":
+		evidence = NewGCSEvidenceStore(storageClient, meta.stateBucket, "equivocations/")
+	case meta.stateDir != "":
+		evidence = NewFileEvidenceStore(filepath.Join(meta.stateDir, "equivocations"))
+	default:
+		evidence = NewMemoryEvidenceStore()
+	}
+	equivocations := NewEquivocations(o_ctx, evidence, o_p, logs, o_httpClient, noteKms.PublicKey(), alerts)
+	http.Handle("/equivocations/", http.StripPrefix("/equivocations", equivocations.Handler()))
+
+	// Witness proxy
+	// Registered once evidence can be captured, the witness API is not served before.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: o_httpListener.Addr().String()})
+	publicMux.Handle("/", equivocations.Capture(proxy))
+	health.SetWitnessAddr(publicListener.Addr())
+
+	// Peer sync
+	// Recover state from other instances of this witness before feeding starts,
+	// and afterwards advance it through the proxy like any other update.
+	if len(meta.peers) > 0 {
+		_, port, _ := net.SplitHostPort(publicListener.Addr().String())
+		witnessURL := "http://" + net.JoinHostPort("localhost", port)
+		peerSync := NewPeerSync(o_p, noteKms, logs, meta.peers, meta.peerInterval, o_httpClient, getName(meta), witnessURL, equivocations)
+		if err := peerSync.Recover(o_ctx); err != nil {
+			log.Println("Initial peer sync failed:", err)
+		}
+		go func() {
+			if err := peerSync.Run(o_ctx); err != nil {
+				log.Println("Peer sync exited:", err)
+			}
+		}()
+	}
+
+	// Bootstrap
+	// Seed persistence from distributors instead of pure TOFU, if configured.
+	if len(meta.bootstrap.Distributors) > 0 {
+		bootstrap, err := NewBootstrap(o_p, noteKms, logs, meta.bootstrap, o_httpClient, alerts)
+		if err != nil {
+			log.Fatalln("Failed to create bootstrap:", err)
+		}
+		o_p = bootstrap.Persistence()
+		health.SetPersistenceReady(persistenceReady(o_p, bootstrap.Done))
+		go func() {
+			if err := bootstrap.Run(o_ctx); err != nil {
+				log.Println("Bootstrap exited:", err)
+			}
+		}()
+	}
+
+	// Status
+	// Registered once persistence is final, alongside the public key on port 8080.
+	deadline, _ := o_ctx.Deadline()
+	http.Handle("/status", NewStatusHandler(meta, noteKms, o_p, logs, started, deadline))
 
 	// Metrics
-	monitoring.SetMetricFactory(monitoring.InertMetricFactory{})
+	// Served on port 8080 alongside the public key.
+	monitoring.SetMetricFactory(prometheus.MetricFactory{})
 
 	// Start
 	log.Println("starting server...")
@@ -77,12 +323,58 @@ func main() {
 
 }
 
+const devModeBanner = "INSECURE DEV MODE: this witness is not running in a confidential space and its signing key is not protected by KMS"
+
 // Witness metadata
 type Meta struct {
 	region   string
 	name     string
 	key      string
 	audience string
+
+	// Optional verifier key the signing key is expected to have.
+	vkey string
+
+	// Deadlines, retries and circuit breaker for the signing backend.
+	sign RetryConfig
+
+	// How long a cosignature is reused for the same checkpoint, zero disables the cache.
+	cosigCacheWindow time.Duration
+
+	// What to do when the clock is earlier than the last cosignature.
+	clockPolicy ClockPolicy
+
+	// Optional Roughtime servers to verify the clock against.
+	timeCheck TimeCheckConfig
+
+	// Directory to keep the log of cosignatures in, or a copy of it with a state bucket.
+	cosigLogDir string
+
+	// Optional directory to keep equivocation evidence in, instead of alongside the state.
+	equivocationDir string
+
+	// Audience of attestation tokens, and the socket of the launcher that issues them.
+	attestationAudience string
+	launcherSocket      string
+
+	// URLs of the sinks to send alerts to, and the minimum interval between similar alerts.
+	alertSinks    []string
+	alertInterval time.Duration
+
+	// In dev mode, key is the path to a local private key file instead of a KMS key.
+	devMode bool
+
+	// Optional GCS bucket or directory to persist checkpoints in.
+	// If both are empty, state is only kept in memory.
+	stateBucket string
+	stateDir    string
+
+	// Optional distributors to seed persistence from on startup.
+	bootstrap BootstrapConfig
+
+	// Optional other instances of this witness to recover state from.
+	peers        []Peer
+	peerInterval time.Duration
 }
 
 // Returns metadata from the environment
@@ -104,6 +396,72 @@ func getMetadata(ctx context.Context) Meta {
 		log.Fatalln("WITNESS_NAME not set")
 	}
 
+	meta.vkey = os.Getenv("WITNESS_VKEY")
+
+	meta.sign.Timeout = getDurationEnv("WITNESS_SIGN_TIMEOUT", 10*time.Second)
+	meta.sign.Attempts = getIntEnv("WITNESS_SIGN_ATTEMPTS", 3)
+	meta.sign.Backoff = getDurationEnv("WITNESS_SIGN_BACKOFF", 250*time.Millisecond)
+	meta.sign.BreakerThreshold = getIntEnv("WITNESS_SIGN_BREAKER_THRESHOLD", 5)
+	meta.sign.BreakerCooldown = getDurationEnv("WITNESS_SIGN_BREAKER_COOLDOWN", 30*time.Second)
+	meta.cosigCacheWindow = getDurationEnv("WITNESS_COSIG_CACHE_WINDOW", time.Minute)
+
+	clockPolicy, err := ParseClockPolicy(cmp.Or(os.Getenv("WITNESS_CLOCK_POLICY"), string(ClockClamp)))
+	if err != nil {
+		log.Fatalln("Invalid WITNESS_CLOCK_POLICY:", err)
+	}
+	meta.clockPolicy = clockPolicy
+
+	for _, s := range splitList(os.Getenv("WITNESS_ROUGHTIME_SERVERS")) {
+		server, err := ParseRoughtimeServer(s)
+		if err != nil {
+			log.Fatalln("Invalid WITNESS_ROUGHTIME_SERVERS:", err)
+		}
+		meta.timeCheck.Servers = append(meta.timeCheck.Servers, server)
+	}
+	meta.timeCheck.Threshold = getDurationEnv("WITNESS_ROUGHTIME_THRESHOLD", 10*time.Second)
+	meta.timeCheck.Interval = getDurationEnv("WITNESS_ROUGHTIME_INTERVAL", 5*time.Minute)
+
+	meta.equivocationDir = os.Getenv("WITNESS_EQUIVOCATION_DIR")
+
+	meta.attestationAudience = cmp.Or(os.Getenv("WITNESS_ATTESTATION_AUDIENCE"), "confidential-witness")
+	meta.launcherSocket = cmp.Or(os.Getenv("WITNESS_LAUNCHER_SOCKET"), launcherSocket)
+
+	meta.alertSinks = splitList(os.Getenv("WITNESS_ALERT_SINKS"))
+	meta.alertInterval = getDurationEnv("WITNESS_ALERT_INTERVAL", 15*time.Minute)
+
+	meta.stateBucket = os.Getenv("WITNESS_STATE_BUCKET")
+	meta.stateDir = os.Getenv("WITNESS_STATE_DIR")
+
+	// The cosignature log is kept with the state. With a state bucket, the
+	// directory only holds a copy of the log, so it need not survive the VM.
+	meta.cosigLogDir = os.Getenv("WITNESS_COSIGNATURE_LOG_DIR")
+	if meta.cosigLogDir == "" && meta.stateDir != "" {
+		meta.cosigLogDir = filepath.Join(meta.stateDir, "cosignatures")
+	} else if meta.cosigLogDir == "" {
+		meta.cosigLogDir = filepath.Join(os.TempDir(), "confidential-witness-cosignatures")
+	}
+
+	meta.bootstrap.Distributors = splitList(os.Getenv("WITNESS_BOOTSTRAP_DISTRIBUTORS"))
+	meta.bootstrap.Witnesses = splitList(os.Getenv("WITNESS_BOOTSTRAP_WITNESSES"))
+	meta.bootstrap.Quorum = getIntEnv("WITNESS_BOOTSTRAP_QUORUM", 1)
+	meta.bootstrap.Timeout = getDurationEnv("WITNESS_BOOTSTRAP_TIMEOUT", 30*time.Minute)
+
+	for _, p := range splitList(os.Getenv("WITNESS_PEERS")) {
+		peer, err := ParsePeer(p)
+		if err != nil {
+			log.Fatalln("Invalid WITNESS_PEERS:", err)
+		}
+		meta.peers = append(meta.peers, peer)
+	}
+	meta.peerInterval = getDurationEnv("WITNESS_PEER_INTERVAL", 5*time.Minute)
+
+	// Dev mode must be explicitly opted into, it is never enabled by a missing variable.
+	if os.Getenv("WITNESS_INSECURE_DEV_MODE") == "true" {
+		meta.devMode = true
+		meta.key = os.Getenv("WITNESS_DEV_KEY_FILE")
+		return meta
+	}
+
 	meta.key = os.Getenv("WITNESS_KEY")
 	if meta.key == "" {
 		log.Fatalf("Environment variable WITNESS_KEY is not set or is empty")
@@ -123,8 +481,8 @@ func getName(meta Meta) string {
 	return meta.name + "-" + meta.region
 }
 
-// Create a new Cloud KMS Client
-func getClient(ctx context.Context, meta Meta) (*kms.KeyManagementClient, error) {
+// Credentials derived from the confidential space attestation token
+func getCredentials(meta Meta) option.ClientOption {
 	// this token is managed by the confidential space runner
 	attestation_token_path := "/run/container_launcher/attestation_verifier_claims_token"
 
@@ -138,14 +496,34 @@ func getClient(ctx context.Context, meta Meta) (*kms.KeyManagementClient, error)
 	}
 	}`, meta.audience, attestation_token_path)
 
+	return option.WithCredentialsJSON([]byte(creds))
+}
+
+// Create a new Cloud KMS Client
+func getClient(ctx context.Context, meta Meta) (*kms.KeyManagementClient, error) {
 	// Create the client.
-	client, err := kms.NewKeyManagementClient(ctx, option.WithCredentialsJSON([]byte(creds)))
+	client, err := kms.NewKeyManagementClient(ctx, getCredentials(meta))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create kms client: %w", err)
 	}
 	return client, nil
 }
 
+// Create a new Cloud Storage Client
+func getStorageClient(ctx context.Context, meta Meta) (*gcs.Service, error) {
+	// Dev mode uses the default credentials, as there is no attestation token.
+	var opts []option.ClientOption
+	if !meta.devMode {
+		opts = append(opts, getCredentials(meta))
+	}
+
+	client, err := gcs.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	return client, nil
+}
+
 // Current Git commit hash and if the repository is modified
 func getRevision() (revision string, modified string) {
 	info, _ := debug.ReadBuildInfo()
@@ -158,3 +536,40 @@ func getRevision() (revision string, modified string) {
 	}
 	return
 }
+
+// Splits a comma separated list, ignoring empty entries
+func splitList(s string) []string {
+	var res []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Returns the integer in the environment variable key, or def if it is not set
+func getIntEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not an integer: %v", key, err)
+	}
+	return i
+}
+
+// Returns the duration in the environment variable key, or def if it is not set
+func getDurationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a duration: %v", key, err)
+	}
+	return d
+}
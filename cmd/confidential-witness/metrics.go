@@ -0,0 +1,128 @@
+// Prometheus metrics specific to this witness, in addition to those of omniwitness.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kmsSignLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "confidential_witness_kms_sign_latency_seconds",
+		Help:    "Latency of AsymmetricSign requests to KMS",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	kmsSignErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_kms_sign_errors_total",
+		Help: "Number of KMS signing requests that failed, including integrity failures",
+	})
+	kmsCrcFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_kms_crc_failures_total",
+		Help: "Number of KMS responses that failed CRC32C integrity verification",
+	}, []string{"rpc"})
+	cosignatures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_cosignatures_total",
+		Help: "Number of cosignatures produced for the log ID",
+	}, []string{"logid"})
+	signatureVerifyFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_signature_verify_failures_total",
+		Help: "Number of signatures from the signing backend that did not verify under the witness public key",
+	})
+	canarySuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_canary_success",
+		Help: "Whether the last canary signature succeeded and verified",
+	})
+	canaryLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_canary_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful canary signature",
+	})
+	canaryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "confidential_witness_canary_latency_seconds",
+		Help:    "Latency of canary signatures, including local verification",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	canaryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_canary_errors_total",
+		Help: "Number of canary signatures that failed or did not verify",
+	})
+	cosignatureCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_cosignature_cache_hits_total",
+		Help: "Number of cosignatures served from the cache or shared with a concurrent request",
+	})
+	clockAnomalies = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_clock_anomalies_total",
+		Help: "Number of cosignatures for which the clock was earlier than the highest issued timestamp",
+	})
+	clockBehind = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_clock_behind_seconds",
+		Help: "How far the clock was behind the highest issued timestamp at the last cosignature",
+	})
+	lastCosignatureTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_last_cosignature_timestamp_seconds",
+		Help: "Highest timestamp of any cosignature issued by the witness",
+	})
+	roughtimeOffset = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_roughtime_offset_seconds",
+		Help: "How far the local clock was ahead of the Roughtime servers at the last verification",
+	})
+	roughtimeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_roughtime_errors_total",
+		Help: "Number of Roughtime queries that failed or returned an invalid response",
+	}, []string{"server"})
+	untrustedTimeRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_untrusted_time_rejections_total",
+		Help: "Number of cosignatures refused because the local clock could not be verified",
+	})
+	cosignatureLogErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_cosignature_log_errors_total",
+		Help: "Number of cosignatures withheld because they could not be appended to the cosignature log",
+	})
+	signRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_sign_retries_total",
+		Help: "Number of calls to the signing backend that were retried after a transient failure",
+	})
+	signBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "confidential_witness_sign_breaker_open",
+		Help: "Whether the signing circuit breaker is open after consecutive failures",
+	})
+	signBreakerRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_sign_breaker_rejections_total",
+		Help: "Number of signatures rejected without calling the backend because the breaker was open",
+	})
+	equivocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_equivocations_total",
+		Help: "Number of conflicting checkpoints detected for the log ID, by kind of evidence",
+	}, []string{"logid", "kind"})
+	alertsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_alerts_sent_total",
+		Help: "Number of alerts delivered to a sink, by kind of alert",
+	}, []string{"kind"})
+	alertsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_alerts_suppressed_total",
+		Help: "Number of alerts not sent because of the rate limit, by kind of alert",
+	}, []string{"kind"})
+	attestationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "confidential_witness_attestation_errors_total",
+		Help: "Number of attestation tokens that could not be obtained from the launcher",
+	})
+	alertErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confidential_witness_alert_errors_total",
+		Help: "Number of alerts that could not be delivered, by kind of sink",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(kmsSignLatency, kmsSignErrors, kmsCrcFailures, cosignatures)
+	prometheus.MustRegister(signatureVerifyFailures, canarySuccess, canaryLastSuccess, canaryLatency, canaryErrors)
+	prometheus.MustRegister(signRetries, signBreakerOpen, signBreakerRejections, cosignatureCacheHits)
+	prometheus.MustRegister(clockAnomalies, clockBehind, lastCosignatureTimestamp)
+	prometheus.MustRegister(roughtimeOffset, roughtimeErrors, untrustedTimeRejections, cosignatureLogErrors)
+	prometheus.MustRegister(equivocations, alertsSent, alertsSuppressed, alertErrors, attestationErrors)
+}
+
+// Observes the time since start on h
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
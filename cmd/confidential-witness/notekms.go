@@ -1,4 +1,4 @@
-// Implements the note.Signer interface for Ed25519 keys stored in GCP KMS.
+// Implements the note.Signer interface for Ed25519 keys held by a SigningBackend.
 
 package main
 
@@ -7,22 +7,16 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"strings"
-	"time"
 	"unicode"
 	"unicode/utf8"
 
-	kms "cloud.google.com/go/kms/apiv1"
-	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/transparency-dev/formats/log"
 	"golang.org/x/mod/sumdb/note"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const (
@@ -37,32 +31,48 @@ const (
 	timestampSize = 8
 )
 
+// SigningBackend is a store for a single Ed25519 private key.
+// The cosignature/v1 formatting is done by NoteKms, so a backend
+// only needs to produce raw Ed25519 signatures over the message it is given.
+type SigningBackend interface {
+	// PublicKey returns the public half of the signing key.
+	PublicKey(ctx context.Context) (ed25519.PublicKey, error)
+	// Sign returns an Ed25519 signature over msg.
+	Sign(ctx context.Context, msg []byte) ([]byte, error)
+}
+
 type NoteKms struct {
-	gcpclient  *kms.KeyManagementClient
-	gcpkeyname string
-	gcpctx     context.Context
+	backend SigningBackend
+	ctx     context.Context
 
-	name string
+	name  string
+	clock *Clock
+	// Optional log that every cosignature is appended to before it is released,
+	// or whose checkpoint it is, which records the highest timestamp released.
+	siglog *SigLog
 
 	pubkey  ed25519.PublicKey
 	keyhash uint32
 }
 
 // NewNoteKms constructs a new Signer that produces timestamped
-// cosignature/v1 signatures from a Ed25519 key (EC_SIGN_ED25519) stored in GCP KMS.
-func NewNoteKms(ctx context.Context, client *kms.KeyManagementClient, kmskeyname string, name string) (*NoteKms, error) {
+// cosignature/v1 signatures from a Ed25519 key held by backend,
+// such as a EC_SIGN_ED25519 key stored in GCP KMS. Timestamps are taken from clock,
+// and cosignatures are appended to siglog, unless it is nil.
+func NewNoteKms(ctx context.Context, backend SigningBackend, name string, clock *Clock, siglog *SigLog) (*NoteKms, error) {
 	if !isValidName(name) {
 		return nil, errors.New("invalid name")
 	}
 
 	n := &NoteKms{
-		gcpclient:  client,
-		gcpkeyname: kmskeyname,
-		gcpctx:     ctx,
-		name:       name,
+		backend: backend,
+		ctx:     ctx,
+		name:    name,
+		clock:   clock,
+		siglog:  siglog,
 	}
 
-	pubkey, err := n.getPublicKey()
+	pubkey, err := backend.PublicKey(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -79,26 +89,11 @@ func (n *NoteKms) PublicKey() string {
 		base64.StdEncoding.EncodeToString(
 			// The algorithm byte is expected to be algEd25519, not algEd25519CosignatureV1.
 			append([]byte{algEd25519}, n.pubkey...)))
-			
+
 }
 
 func (n *NoteKms) Sign(msg []byte) ([]byte, error) {
-	t := uint64(time.Now().Unix())
-	m, err := formatCosignatureV1(t, msg)
-	if err != nil {
-		return nil, err
-	}
-
-	signature, err := n.signMsg(m)
-	if err != nil {
-		return nil, err
-	}
-
-	// The signature itself is encoded as timestamp || signature.
-	sig := make([]byte, 0, timestampSize+ed25519.SignatureSize)
-	sig = binary.BigEndian.AppendUint64(sig, t)
-	sig = append(sig, signature...)
-	return sig, nil
+	return n.sign(msg, true)
 }
 
 // https://github.com/transparency-dev/formats/blob/a07008fc07298aaf8d9d46ebd31b7031c4b4841d/note/note_cosigv1.go#L131
@@ -118,59 +113,64 @@ func (n *NoteKms) Verify(msg, sig []byte) bool {
 
 // Helper methods
 
-func (n *NoteKms) getPublicKey() (ed25519.PublicKey, error) {
-	publicKey, err := n.gcpclient.GetPublicKey(n.gcpctx, &kmspb.GetPublicKeyRequest{
-		Name: n.gcpkeyname,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get public key: %w", err)
-	}
-
-	block, _ := pem.Decode([]byte(publicKey.Pem))
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+// Signs msg with the backend, only releasing signatures that verify under the
+// public key the witness was started with. This catches a backend that returns
+// garbage, or whose key was disabled, destroyed or swapped since startup.
+func (n *NoteKms) signMsg(msg []byte) ([]byte, error) {
+	sig, err := n.backend.Sign(n.ctx, msg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return nil, err
 	}
-
-	pubkey, ok := key.(ed25519.PublicKey)
-	if !ok {
-		return nil, errors.New("invalid public key, not ed25519")
+	if !ed25519.Verify(n.pubkey, msg, sig) {
+		signatureVerifyFailures.Inc()
+		return nil, errors.New("signature does not verify under the witness public key")
 	}
-
-	return pubkey, nil
+	return sig, nil
 }
 
-func (n *NoteKms) signMsg(msg []byte) ([]byte, error) {
-	// Build the signing request.
-	//
-	// Note: Key algorithms will require a varying hash function. For example,
-	// EC_SIGN_P384_SHA384 requires SHA-384.
-	req := &kmspb.AsymmetricSignRequest{
-		Name:       n.gcpkeyname,
-		Data:       msg,
-		DataCrc32C: wrapperspb.Int64(int64(crc32c(msg))),
+// Produces a cosignature over msg, appending it to the log if logged is set.
+func (n *NoteKms) sign(msg []byte, logged bool) ([]byte, error) {
+	t, err := n.clock.Next()
+	if err != nil {
+		return nil, err
 	}
-
-	// Call the API.
-	result, err := n.gcpclient.AsymmetricSign(n.gcpctx, req)
+	m, err := formatCosignatureV1(t, msg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign digest: %w", err)
+		return nil, err
 	}
 
-	// Optional, but recommended: perform integrity verification on result.
-	// For more details on ensuring E2E in-transit integrity to and from Cloud KMS visit:
-	// https://cloud.google.com/kms/docs/data-integrity-guidelines
-	if result.VerifiedDataCrc32C == false {
-		return nil, fmt.Errorf("AsymmetricSign: request corrupted in-transit 1")
-	}
-	if result.Name != req.Name {
-		return nil, fmt.Errorf("AsymmetricSign: request corrupted in-transit 2")
+	signature, err := n.signMsg(m)
+	if err != nil {
+		return nil, err
 	}
-	if int64(crc32c(result.Signature)) != result.SignatureCrc32C.Value {
-		return nil, fmt.Errorf("AsymmetricSign: response corrupted in-transit 3")
+
+	// The signature itself is encoded as timestamp || signature.
+	sig := make([]byte, 0, timestampSize+ed25519.SignatureSize)
+	sig = binary.BigEndian.AppendUint64(sig, t)
+	sig = append(sig, signature...)
+
+	if n.siglog != nil {
+		if logged {
+			err = n.siglog.Append(n.ctx, n, msg, sig)
+		} else {
+			err = n.siglog.Observe(n.ctx, t)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+	cosignatures.WithLabelValues(logID(msg)).Inc()
+	return sig, nil
+}
 
-	return result.Signature, nil
+// Returns the Sealer named name for messages prefixed with prefix.
+func (n *NoteKms) sealer(name, prefix string) Sealer {
+	return Sealer{
+		n:       n,
+		name:    name,
+		prefix:  prefix,
+		keyhash: keyHashEd25519(name, append([]byte(prefix), n.pubkey...)),
+	}
 }
 
 // Interface implementations
@@ -180,14 +180,64 @@ func (n *NoteKms) KeyHash() uint32 { return n.keyhash }
 var _ note.Verifier = (*NoteKms)(nil)
 var _ note.Signer = (*NoteKms)(nil)
 
-/// Helper functions
+// Cosigns without appending to the cosignature log, for the checkpoints of that log itself.
+type unloggedSigner struct{ *NoteKms }
+
+func (u unloggedSigner) Sign(msg []byte) ([]byte, error) { return u.sign(msg, false) }
+
+// Prefixes of the messages signed as seals, for state and for the checkpoints of
+// the cosignature log. Every other message the witness key signs starts with
+// "cosignature/v1", so a seal does not verify as a cosignature over any note,
+// nor a cosignature as a seal, nor a seal in one context as one in another.
+const (
+	sealContext   = "confidential-witness/seal/v1\n"
+	sigLogContext = "confidential-witness/cosignature-log/v1\n"
+)
 
-// Calculate the CRC32C checksum of the data.
-func crc32c(data []byte) uint32 {
-	t := crc32.MakeTable(crc32.Castagnoli)
-	return crc32.Checksum(data, t)
+// Sealer returns a signer and verifier for records that only the witness itself
+// reads back, such as its sealed state. Seals are plain Ed25519 signatures over
+// sealContext and the message, without a timestamp. They do not take time from
+// the clock, and are neither logged nor counted as cosignatures.
+func (n *NoteKms) Sealer() Sealer {
+	return n.sealer(n.name, sealContext)
 }
 
+// SigLogSealer returns the Sealer that signs the checkpoints of the cosignature
+// log with the given origin, which are only trusted once they are cosigned.
+// Its name is the origin, as tessera takes the origin from the signer.
+func (n *NoteKms) SigLogSealer(origin string) Sealer {
+	return n.sealer(origin, sigLogContext)
+}
+
+// SetSigLog makes every cosignature be appended to siglog from now on.
+// It must be called before the first cosignature.
+func (n *NoteKms) SetSigLog(siglog *SigLog) {
+	n.siglog = siglog
+}
+
+type Sealer struct {
+	n       *NoteKms
+	name    string
+	prefix  string
+	keyhash uint32
+}
+
+func (s Sealer) Name() string    { return s.name }
+func (s Sealer) KeyHash() uint32 { return s.keyhash }
+
+func (s Sealer) Sign(msg []byte) ([]byte, error) {
+	return s.n.signMsg(append([]byte(s.prefix), msg...))
+}
+
+func (s Sealer) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(s.n.pubkey, append([]byte(s.prefix), msg...), sig)
+}
+
+var _ note.Verifier = Sealer{}
+var _ note.Signer = Sealer{}
+
+/// Helper functions
+
 // https://github.com/transparency-dev/formats/blob/a07008fc07298aaf8d9d46ebd31b7031c4b4841d/note/note_cosigv1.go#L146
 func formatCosignatureV1(t uint64, msg []byte) ([]byte, error) {
 	// The signed message is in the following format
@@ -213,6 +263,12 @@ func formatCosignatureV1(t uint64, msg []byte) ([]byte, error) {
 	return []byte(fmt.Sprintf("cosignature/v1\ntime %d\n%s", t, msg)), nil
 }
 
+// Returns the ID of the log whose checkpoint body is msg, derived from the origin line.
+func logID(msg []byte) string {
+	origin, _, _ := bytes.Cut(msg, []byte("\n"))
+	return log.ID(string(origin))
+}
+
 // https://github.com/transparency-dev/formats/blob/a07008fc07298aaf8d9d46ebd31b7031c4b4841d/note/note_cosigv1.go#L199
 // isValidName reports whether name is valid.
 // It must be non-empty and not have any Unicode spaces or pluses.
@@ -0,0 +1,244 @@
+// Shares state between witness instances, such as the same witness running in different regions.
+//
+// Each instance periodically fetches the latest cosigned checkpoints of its peers
+// through the standard witness API. A restarted instance without state for a log
+// recovers it from a peer instead of trusting the first checkpoint it sees.
+// A peer checkpoint that is newer than the stored one advances the state through
+// the witness update API, with a consistency proof fetched from the log, so the
+// peer is never trusted for more than pointing at the checkpoint.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/witness/api"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A witness instance to sync with
+type Peer struct {
+	URL      string
+	Verifier note.Verifier
+}
+
+// ParsePeer parses a peer in the form vkey@url.
+func ParsePeer(s string) (Peer, error) {
+	vkey, url, ok := strings.Cut(s, "@")
+	if !ok {
+		return Peer{}, fmt.Errorf("peer %q is not in the form vkey@url", s)
+	}
+	v, err := f_note.NewVerifierForCosignatureV1(vkey)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer key %q: %w", vkey, err)
+	}
+	return Peer{URL: strings.TrimSuffix(url, "/"), Verifier: v}, nil
+}
+
+type PeerSync struct {
+	p        omniwitness.LogStatePersistence
+	signer   note.Signer
+	logs     map[string]witnessedLog
+	peers    []Peer
+	client   *http.Client
+	interval time.Duration
+
+	// The region-suffixed name of this instance, sent to peers.
+	instance string
+
+	// Base URL of the witness API that newer checkpoints are submitted to.
+	witnessURL string
+
+	// Receives checkpoints from peers that conflict with the stored ones.
+	equivocations *Equivocations
+}
+
+// NewPeerSync constructs a syncer that recovers and advances state for logs in p
+// from peers. instance identifies this witness instance to its peers, and
+// newer checkpoints are submitted to the witness API at witnessURL.
+func NewPeerSync(p omniwitness.LogStatePersistence, signer note.Signer, logs map[string]witnessedLog, peers []Peer, interval time.Duration, client *http.Client, instance string, witnessURL string, equivocations *Equivocations) *PeerSync {
+	return &PeerSync{
+		p:             p,
+		signer:        signer,
+		logs:          logs,
+		peers:         peers,
+		client:        client,
+		interval:      interval,
+		instance:      instance,
+		witnessURL:    witnessURL,
+		equivocations: equivocations,
+	}
+}
+
+// Run syncs with all peers on every interval until ctx is done.
+func (s *PeerSync) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-time.After(s.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := s.SyncOnce(ctx); err != nil {
+			log.Println("Peer sync failed:", err)
+		}
+	}
+}
+
+// Recover fetches the latest checkpoint for every log from every peer, but
+// only stores it for logs without state. Unlike SyncOnce, it does not need
+// the witness API to be serving.
+func (s *PeerSync) Recover(ctx context.Context) error {
+	return s.sync(ctx, false)
+}
+
+// SyncOnce fetches the latest checkpoint for every log from every peer,
+// storing it for logs without state and advancing the state to it otherwise.
+func (s *PeerSync) SyncOnce(ctx context.Context) error {
+	return s.sync(ctx, true)
+}
+
+// Helper methods
+
+func (s *PeerSync) sync(ctx context.Context, advance bool) error {
+	numErrs := 0
+	for _, peer := range s.peers {
+		for _, l := range s.logs {
+			if err := s.syncLog(ctx, peer, l, advance); err != nil {
+				log.Printf("Peer sync of log %s from %s failed: %v", l.id, peer.URL, err)
+				numErrs++
+			}
+		}
+	}
+	if numErrs > 0 {
+		return fmt.Errorf("failed to sync %d out of %d logs", numErrs, len(s.peers)*len(s.logs))
+	}
+	return nil
+}
+
+func (s *PeerSync) syncLog(ctx context.Context, peer Peer, l witnessedLog, advance bool) error {
+	raw, err := s.get(ctx, peer.URL+fmt.Sprintf(api.HTTPGetCheckpoint, l.id))
+	if errors.Is(err, errNoCheckpoint) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	peerCp, peerNote, err := l.parse(raw, peer.Verifier)
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	if !hasSig(peerNote, peer.Verifier) {
+		return errors.New("checkpoint is not cosigned by the peer")
+	}
+
+	read, err := s.p.ReadOps(l.id)
+	if err != nil {
+		return fmt.Errorf("ReadOps(): %w", err)
+	}
+	localRaw, err := read.GetLatest()
+	if status.Code(err) == codes.NotFound {
+		log.Printf("Recovering log %s at size %d from peer %s", l.id, peerCp.Size, peer.URL)
+		return seedLog(s.p, s.signer, l.id, &note.Note{Text: peerNote.Text, Sigs: logSigs(peerNote, l)})
+	}
+	if err != nil {
+		return fmt.Errorf("GetLatest(): %w", err)
+	}
+
+	localCp, _, err := l.parse(localRaw)
+	if err != nil {
+		return fmt.Errorf("couldn't parse stored checkpoint: %w", err)
+	}
+	if localCp.Size == peerCp.Size && !bytes.Equal(localCp.Hash, peerCp.Hash) {
+		log.Printf("%s: INCONSISTENT CHECKPOINTS FROM PEER %s!:\n%s\n%s", l.id, peer.URL, localRaw, raw)
+		if _, err := s.equivocations.Check(l.id, raw, nil, "peer "+peer.URL); err != nil {
+			log.Printf("Failed to store evidence for log %s: %v", l.id, err)
+		}
+		return fmt.Errorf("peer has a different checkpoint at size %d", peerCp.Size)
+	}
+	if !advance || peerCp.Size <= localCp.Size {
+		return nil
+	}
+
+	proof, err := l.consistencyProof(ctx, s.client, localCp, peerCp)
+	if err != nil {
+		return fmt.Errorf("failed to fetch consistency proof from %d to %d: %w", localCp.Size, peerCp.Size, err)
+	}
+	log.Printf("Advancing log %s from size %d to %d from peer %s", l.id, localCp.Size, peerCp.Size, peer.URL)
+	// Only the log signature is submitted, the witness cosigns the checkpoint itself.
+	logNote, err := note.Sign(&note.Note{Text: peerNote.Text, Sigs: logSigs(peerNote, l)})
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	return s.update(ctx, l.id, logNote, proof)
+}
+
+// Submits a checkpoint and its consistency proof to the witness, which
+// verifies both against the stored state before storing and cosigning it.
+func (s *PeerSync) update(ctx context.Context, logID string, cp []byte, proof [][]byte) error {
+	body, err := json.Marshal(api.UpdateRequest{Checkpoint: cp, Proof: proof})
+	if err != nil {
+		return fmt.Errorf("failed to encode update: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.witnessURL+fmt.Sprintf(api.HTTPUpdate, logID), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	// A conflict means the witness already has a newer checkpoint, as the
+	// feeder got there first, which is not a failure.
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("witness rejected update (%s): %q", resp.Status, respBody)
+	}
+	return nil
+}
+
+var errNoCheckpoint = errors.New("peer has no checkpoint")
+
+func (s *PeerSync) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "confidential-witness/"+s.instance)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoCheckpoint
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status response (%s): %q", resp.Status, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/merkle/testonly"
+	"github.com/transparency-dev/witness/api"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// A log served with the Rekor API, so that consistency proofs can be fetched from it.
+type testLog struct {
+	witnessedLog
+	signer note.Signer
+	tree   *testonly.Tree
+	srv    *httptest.Server
+}
+
+func newTestLog(t *testing.T, size int) *testLog {
+	t.Helper()
+	const origin = "example.com/log"
+	skey, vkey, err := note.GenerateKey(rand.Reader, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &testLog{signer: signer, tree: testonly.New(rfc6962.DefaultHasher)}
+	for i := range size {
+		l.tree.AppendData([]byte(strconv.Itoa(i)))
+	}
+	l.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first, _ := strconv.ParseUint(r.URL.Query().Get("firstSize"), 10, 64)
+		last, _ := strconv.ParseUint(r.URL.Query().Get("lastSize"), 10, 64)
+		p, err := l.tree.ConsistencyProof(first, last)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var res struct {
+			Hashes []string `json:"hashes"`
+		}
+		for _, h := range p {
+			res.Hashes = append(res.Hashes, hex.EncodeToString(h))
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(l.srv.Close)
+
+	l.witnessedLog = witnessedLog{
+		id:       log.ID(origin),
+		origin:   origin,
+		vkey:     vkey,
+		verifier: verifier,
+		url:      l.srv.URL + "/?treeID=1",
+		feeder:   omniwitness.Rekor,
+	}
+	return l
+}
+
+// Returns the checkpoint of the log at size, signed by the log and the witnesses.
+func (l *testLog) checkpoint(t *testing.T, size uint64, witnesses ...note.Signer) []byte {
+	t.Helper()
+	cp := log.Checkpoint{Origin: l.origin, Size: size, Hash: l.tree.HashAt(size)}
+	raw, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, append([]note.Signer{l.signer}, witnesses...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func newTestCosigner(t *testing.T, name string) (note.Signer, note.Verifier) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := f_note.NewSignerForCosignatureV1(skey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := f_note.NewVerifierForCosignatureV1(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, verifier
+}
+
+// A witness API that verifies updates against the stored checkpoint, as omniwitness does.
+type testWitness struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	updates []uint64
+}
+
+func newTestWitness(t *testing.T, l *testLog, p omniwitness.LogStatePersistence) *testWitness {
+	w := &testWitness{}
+	w.srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != fmt.Sprintf(api.HTTPUpdate, l.id) {
+			http.NotFound(rw, r)
+			return
+		}
+		var req api.UpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next, _, err := l.parse(req.Checkpoint)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prev, _, err := l.latest(p)
+		if err != nil || prev == nil {
+			http.Error(rw, fmt.Sprintf("no stored checkpoint: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := proof.VerifyConsistency(rfc6962.DefaultHasher, prev.Size, next.Size, req.Proof, prev.Hash, next.Hash); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.updates = append(w.updates, next.Size)
+	}))
+	t.Cleanup(w.srv.Close)
+	return w
+}
+
+func (w *testWitness) Updates() []uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.updates
+}
+
+// Starts a peer serving the checkpoint of the log at size, cosigned by the peer.
+func newTestPeer(t *testing.T, l *testLog, size uint64) Peer {
+	t.Helper()
+	signer, verifier := newTestCosigner(t, "example.com/peer")
+	raw := l.checkpoint(t, size, signer)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf(api.HTTPGetCheckpoint, l.id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(raw)
+	}))
+	t.Cleanup(srv.Close)
+	return Peer{URL: srv.URL, Verifier: verifier}
+}
+
+func newTestPeerSync(t *testing.T, l *testLog, p omniwitness.LogStatePersistence, peer Peer, witnessURL string) *PeerSync {
+	t.Helper()
+	signer, verifier := newTestCosigner(t, "example.com/witness")
+	logs := map[string]witnessedLog{l.id: l.witnessedLog}
+	equivocations := NewEquivocations(context.Background(), NewFileEvidenceStore(t.TempDir()), p, logs, http.DefaultClient, verifier.Name(), NewAlerter("test", nil, time.Minute))
+	return NewPeerSync(p, signer, logs, []Peer{peer}, time.Minute, http.DefaultClient, "test", witnessURL, equivocations)
+}
+
+func TestPeerSyncRecoversMissingState(t *testing.T) {
+	l := newTestLog(t, 8)
+	p := NewPersistence()
+	w := newTestWitness(t, l, p)
+	s := newTestPeerSync(t, l, p, newTestPeer(t, l, 8), w.srv.URL)
+
+	if err := s.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() = %v", err)
+	}
+	cp, _, err := l.latest(p)
+	if err != nil || cp == nil || cp.Size != 8 {
+		t.Fatalf("stored checkpoint = %v, %v, want size 8", cp, err)
+	}
+	if got := w.Updates(); len(got) != 0 {
+		t.Errorf("Recover() sent updates %v for a log without state", got)
+	}
+}
+
+func TestPeerSyncAdvancesWithProof(t *testing.T) {
+	l := newTestLog(t, 8)
+	p := NewPersistence()
+	local, _ := newTestCosigner(t, "example.com/witness")
+	n, err := note.Open(l.checkpoint(t, 4), note.VerifierList(l.verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seedLog(p, local, l.id, n); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWitness(t, l, p)
+	s := newTestPeerSync(t, l, p, newTestPeer(t, l, 8), w.srv.URL)
+
+	// Before the witness API serves, existing state is left alone.
+	if err := s.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() = %v", err)
+	}
+	if got := w.Updates(); len(got) != 0 {
+		t.Fatalf("Recover() sent updates %v", got)
+	}
+
+	if err := s.SyncOnce(context.Background()); err != nil {
+		t.Fatalf("SyncOnce() = %v", err)
+	}
+	if got := w.Updates(); len(got) != 1 || got[0] != 8 {
+		t.Errorf("updates = %v, want [8]", got)
+	}
+}
+
+func TestPeerSyncIgnoresOlderCheckpoint(t *testing.T) {
+	l := newTestLog(t, 8)
+	p := NewPersistence()
+	local, _ := newTestCosigner(t, "example.com/witness")
+	n, err := note.Open(l.checkpoint(t, 8), note.VerifierList(l.verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seedLog(p, local, l.id, n); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWitness(t, l, p)
+	s := newTestPeerSync(t, l, p, newTestPeer(t, l, 4), w.srv.URL)
+
+	if err := s.SyncOnce(context.Background()); err != nil {
+		t.Fatalf("SyncOnce() = %v", err)
+	}
+	if got := w.Updates(); len(got) != 0 {
+		t.Errorf("SyncOnce() sent updates %v for an older checkpoint", got)
+	}
+}
@@ -0,0 +1,171 @@
+// Fetches consistency proofs from the logs witnessed by omniwitness.
+//
+// Proofs are fetched the same way as by the omniwitness feeder for each log,
+// so that checkpoints learned from elsewhere, such as from peers, can be
+// submitted to the witness through its update API like any other update.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/rfc6962"
+	sl_client "github.com/transparency-dev/serverless-log/client"
+	ts_client "github.com/transparency-dev/trillian-tessera/client"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Tile heights of the tlog tile based logs.
+const (
+	sumDBTileHeight = 8
+	pixelTileHeight = 1
+)
+
+// Returns a proof that the tree at to is an extension of the tree at from,
+// fetched from the log itself.
+func (l witnessedLog) consistencyProof(ctx context.Context, client *http.Client, from, to *log.Checkpoint) ([][]byte, error) {
+	if from.Size == 0 {
+		return [][]byte{}, nil
+	}
+	base, err := url.Parse(l.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log URL %q: %w", l.url, err)
+	}
+	fetch := func(ctx context.Context, path string) ([]byte, error) {
+		return fetchLog(ctx, client, base, path)
+	}
+
+	switch l.feeder {
+	case omniwitness.Serverless:
+		pb, err := sl_client.NewProofBuilder(ctx, *to, rfc6962.DefaultHasher.HashChildren, fetch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create proof builder: %w", err)
+		}
+		return pb.ConsistencyProof(ctx, from.Size, to.Size)
+	case omniwitness.Tiles:
+		f, err := ts_client.NewHTTPFetcher(base, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fetcher: %w", err)
+		}
+		pb, err := ts_client.NewProofBuilder(ctx, *to, f.ReadTile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create proof builder: %w", err)
+		}
+		return pb.ConsistencyProof(ctx, from.Size, to.Size)
+	case omniwitness.SumDB:
+		return proveTree(from, to, tileReader{ctx: ctx, height: sumDBTileHeight, fetch: fetch, path: tlog.Tile.Path})
+	case omniwitness.Pixel:
+		return proveTree(from, to, tileReader{ctx: ctx, height: pixelTileHeight, fetch: fetch, path: pixelTilePath})
+	case omniwitness.Rekor:
+		return rekorProof(ctx, client, base, from, to)
+	default:
+		return nil, fmt.Errorf("no consistency proofs available for log %s", l.origin)
+	}
+}
+
+// Reads the hash tiles of a tlog tile based log.
+type tileReader struct {
+	ctx    context.Context
+	height int
+	fetch  func(ctx context.Context, path string) ([]byte, error)
+	path   func(t tlog.Tile) string
+}
+
+func (r tileReader) Height() int { return r.height }
+
+func (r tileReader) SaveTiles([]tlog.Tile, [][]byte) {}
+
+func (r tileReader) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	res := make([][]byte, 0, len(tiles))
+	for _, t := range tiles {
+		data, err := r.fetch(r.ctx, r.path(t))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch tile %s: %w", r.path(t), err)
+		}
+		res = append(res, data)
+	}
+	return res, nil
+}
+
+/// Helper functions
+
+func proveTree(from, to *log.Checkpoint, r tileReader) ([][]byte, error) {
+	tree := tlog.Tree{N: int64(to.Size)}
+	copy(tree.Hash[:], to.Hash)
+	proof, err := tlog.ProveTree(int64(to.Size), int64(from.Size), tlog.TileHashReader(tree, r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prove tree: %w", err)
+	}
+	res := make([][]byte, 0, len(proof))
+	for _, h := range proof {
+		res = append(res, h[:])
+	}
+	return res, nil
+}
+
+// Pixel logs do not split tile indices into path elements, unlike sumdb.
+func pixelTilePath(t tlog.Tile) string {
+	path := fmt.Sprintf("tile/%d/%d/%03d", t.H, t.L, t.N)
+	if t.W < 1<<t.H {
+		path += fmt.Sprintf(".p/%d", t.W)
+	}
+	return path
+}
+
+func rekorProof(ctx context.Context, client *http.Client, base *url.URL, from, to *log.Checkpoint) ([][]byte, error) {
+	treeID := base.Query().Get("treeID")
+	if treeID == "" {
+		return nil, errors.New("log URL does not contain a treeID")
+	}
+	raw, err := fetchLog(ctx, client, base, fmt.Sprintf("api/v1/log/proof?firstSize=%d&lastSize=%d&treeID=%s", from.Size, to.Size, treeID))
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode proof: %w", err)
+	}
+	proof := make([][]byte, len(res.Hashes))
+	for i, h := range res.Hashes {
+		if proof[i], err = hex.DecodeString(h); err != nil {
+			return nil, fmt.Errorf("invalid proof hash %d: %w", i, err)
+		}
+	}
+	return proof, nil
+}
+
+// Fetches path relative to the log URL, returning os.ErrNotExist if it is not found.
+func fetchLog(ctx context.Context, client *http.Client, base *url.URL, path string) ([]byte, error) {
+	u, err := base.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", u, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status response (%s) from %s", resp.Status, u)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,169 @@
+// Implements a SigningBackend wrapper that bounds every call to the backend
+// with a deadline, retries transient failures, and fails fast while the
+// backend is down.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RetryConfig struct {
+	// Deadline for a single call to the backend.
+	Timeout time.Duration
+	// Maximum number of calls per signature, including the first.
+	Attempts int
+	// Delay before the first retry, doubled on every further retry.
+	Backoff time.Duration
+	// Number of consecutive failed signatures after which the breaker opens.
+	BreakerThreshold int
+	// How long the breaker stays open before another signature is attempted.
+	BreakerCooldown time.Duration
+}
+
+type RetryingBackend struct {
+	inner  SigningBackend
+	cfg    RetryConfig
+	alerts *Alerter
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// Whether the single signature allowed once the cooldown passed is in flight.
+	probing bool
+}
+
+// NewRetryingBackend wraps inner, and alerts every time the breaker opens.
+func NewRetryingBackend(inner SigningBackend, cfg RetryConfig, alerts *Alerter) (*RetryingBackend, error) {
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	if cfg.Attempts < 1 {
+		return nil, errors.New("attempts must be at least 1")
+	}
+	if cfg.BreakerThreshold < 1 {
+		return nil, errors.New("breaker threshold must be at least 1")
+	}
+	return &RetryingBackend{
+		inner:  inner,
+		cfg:    cfg,
+		alerts: alerts,
+	}, nil
+}
+
+// PublicKey is only called on startup, so it is retried but not subject to the breaker.
+func (r *RetryingBackend) PublicKey(ctx context.Context) (ed25519.PublicKey, error) {
+	var pubkey ed25519.PublicKey
+	err := r.retry(ctx, func(ctx context.Context) (err error) {
+		pubkey, err = r.inner.PublicKey(ctx)
+		return err
+	})
+	return pubkey, err
+}
+
+func (r *RetryingBackend) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	ok, probe := r.allow()
+	if !ok {
+		signBreakerRejections.Inc()
+		return nil, status.Error(codes.Unavailable, "signing circuit breaker is open")
+	}
+
+	var sig []byte
+	err := r.retry(ctx, func(ctx context.Context) (err error) {
+		sig, err = r.inner.Sign(ctx, msg)
+		return err
+	})
+	r.record(err, probe)
+	return sig, err
+}
+
+// Helper methods
+
+// Calls f with a per-call deadline until it succeeds, fails permanently,
+// or the attempts run out.
+func (r *RetryingBackend) retry(ctx context.Context, f func(context.Context) error) error {
+	backoff := r.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+		err := f(callCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= r.cfg.Attempts || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		signRetries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		}
+		backoff *= 2
+	}
+}
+
+// Reports whether a signature may be attempted. Once the cooldown has passed,
+// a single signature is attempted as a probe, and every other one is rejected
+// until it succeeds, which closes the breaker, or fails, which reopens it.
+// It also reports whether the signature is that probe.
+func (r *RetryingBackend) allow() (ok, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures < r.cfg.BreakerThreshold {
+		return true, false
+	}
+	if time.Now().Before(r.openUntil) || r.probing {
+		return false, false
+	}
+	r.probing = true
+	return true, true
+}
+
+// Records the result of a signature. Only the probe itself ends probing, as
+// signatures allowed before the breaker opened may complete while it is in flight.
+func (r *RetryingBackend) record(err error, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if probe {
+		r.probing = false
+	}
+	if err == nil {
+		r.failures = 0
+		signBreakerOpen.Set(0)
+		return
+	}
+	r.failures++
+	if r.failures >= r.cfg.BreakerThreshold {
+		r.openUntil = time.Now().Add(r.cfg.BreakerCooldown)
+		signBreakerOpen.Set(1)
+		r.alerts.Fire(AlertSigningFailures, "", "%d consecutive signatures failed, signing is paused for %s. Last error: %v", r.failures, r.cfg.BreakerCooldown, err)
+	}
+}
+
+/// Helper functions
+
+// Reports whether err is worth retrying. Per-call deadlines count as transient,
+// as a hung call says nothing about the next one. Internal errors are not, as
+// they are as likely to be caused by the request as by the backend.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+var _ SigningBackend = (*RetryingBackend)(nil)
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A backend that fails with err, blocking every call until release is closed.
+type stubBackend struct {
+	err     error
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (b *stubBackend) PublicKey(ctx context.Context) (ed25519.PublicKey, error) {
+	return nil, b.err
+}
+
+func (b *stubBackend) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	b.calls.Add(1)
+	if b.release != nil {
+		<-b.release
+	}
+	return nil, b.err
+}
+
+func newTestRetryingBackend(t *testing.T, inner SigningBackend, attempts int) *RetryingBackend {
+	t.Helper()
+	r, err := NewRetryingBackend(inner, RetryConfig{
+		Timeout:          time.Second,
+		Attempts:         attempts,
+		Backoff:          time.Millisecond,
+		BreakerThreshold: 1,
+		BreakerCooldown:  10 * time.Millisecond,
+	}, NewAlerter("test", nil, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRetryingBackendRetries(t *testing.T) {
+	for _, tc := range []struct {
+		code codes.Code
+		want int32
+	}{
+		{codes.Unavailable, 3},
+		{codes.ResourceExhausted, 3},
+		{codes.Internal, 1},
+		{codes.PermissionDenied, 1},
+	} {
+		t.Run(tc.code.String(), func(t *testing.T) {
+			inner := &stubBackend{err: status.Error(tc.code, "failed")}
+			r := newTestRetryingBackend(t, inner, 3)
+			if _, err := r.Sign(context.Background(), nil); status.Code(err) != tc.code {
+				t.Errorf("Sign() = %v, want %v", err, tc.code)
+			}
+			if got := inner.calls.Load(); got != tc.want {
+				t.Errorf("backend called %d times, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryingBackendHalfOpen(t *testing.T) {
+	inner := &stubBackend{err: status.Error(codes.PermissionDenied, "failed")}
+	r := newTestRetryingBackend(t, inner, 1)
+	r.Sign(context.Background(), nil)
+	if _, err := r.Sign(context.Background(), nil); err == nil || inner.calls.Load() != 1 {
+		t.Fatalf("Sign() with the breaker open = %v after %d calls", err, inner.calls.Load())
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Once the cooldown passed, a single probe reaches the backend.
+	inner.release = make(chan struct{})
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Sign(context.Background(), nil)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+	if got := inner.calls.Load(); got != 2 {
+		t.Errorf("backend called %d times in half-open state, want a single probe", got-1)
+	}
+
+	// The failed probe reopens the breaker.
+	if _, err := r.Sign(context.Background(), nil); status.Code(err) != codes.Unavailable {
+		t.Errorf("Sign() after a failed probe = %v, want Unavailable", err)
+	}
+
+	// A successful probe closes it.
+	time.Sleep(20 * time.Millisecond)
+	inner.err = nil
+	for range 3 {
+		if _, err := r.Sign(context.Background(), nil); err != nil {
+			t.Errorf("Sign() after a successful probe = %v", err)
+		}
+	}
+}
+
+func TestRetryingBackendProbeInFlight(t *testing.T) {
+	r := newTestRetryingBackend(t, &stubBackend{}, 1)
+	failed := status.Error(codes.Unavailable, "failed")
+	r.record(failed, false)
+	time.Sleep(20 * time.Millisecond)
+	if ok, probe := r.allow(); !ok || !probe {
+		t.Fatalf("allow() after the cooldown = %v, %v, want a probe", ok, probe)
+	}
+
+	// A signature allowed before the breaker opened completes while the probe is in flight.
+	r.record(failed, false)
+	time.Sleep(20 * time.Millisecond)
+	if ok, _ := r.allow(); ok {
+		t.Error("allow() admitted a second probe while the first is in flight")
+	}
+
+	// Only the probe completing allows another.
+	r.record(failed, true)
+	time.Sleep(20 * time.Millisecond)
+	if ok, probe := r.allow(); !ok || !probe {
+		t.Errorf("allow() after the probe failed and the cooldown = %v, %v, want a probe", ok, probe)
+	}
+}
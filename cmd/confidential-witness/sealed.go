@@ -0,0 +1,377 @@
+// Implements a persistence object that seals the state of another one with the witness key.
+//
+// Every checkpoint is stored inside a record sealed by the witness, together with
+// the name of the instance that wrote it and a monotonically increasing epoch.
+// An operator with access to the underlying disk or bucket cannot forge records,
+// and restoring an older snapshot is detected by comparing the epochs on load
+// with the newest head of sealed state that this instance published to its peers.
+// State that no peer can vouch for is refused, or set aside to be seeded again.
+// Cosignatures are never used for this, as peers share the witness key and their
+// cosignatures say nothing about the state of this instance.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// First lines of a sealed record and of a sealed head, so that neither can be
+// opened as the other. Both are signed by a Sealer, not as cosignatures.
+const (
+	sealedHeader     = "confidential-witness/sealed-state/v2"
+	sealedHeadHeader = "confidential-witness/sealed-head/v1"
+)
+
+// What to do with stored state when minEpochs fails with errNoSealedHead,
+// so that nothing says how new the state must be.
+type UnprovenState int
+
+const (
+	// Refuse to load the state.
+	RefuseUnproven UnprovenState = iota
+	// Load the state only if it is empty.
+	AcceptEmpty
+	// Treat every stored log as missing, so that it is seeded again from distributors.
+	Reseed
+)
+
+// NewSealedPersistence returns a persistence object that stores state in inner
+// inside records sealed by sealer for instance. On Init, every record must verify
+// under sealer and belong to instance, and the record for each log must not be
+// older than the epoch returned by minEpochs for that log. If minEpochs cannot
+// tell, the state is handled as unproven says.
+func NewSealedPersistence(inner omniwitness.LogStatePersistence, sealer Sealer, instance string, minEpochs func() (map[string]uint64, error), unproven UnprovenState) *SealedPersistence {
+	return &SealedPersistence{
+		inner:     inner,
+		sealer:    sealer,
+		instance:  instance,
+		minEpochs: minEpochs,
+		unproven:  unproven,
+		epochs:    make(map[string]uint64),
+		stale:     make(map[string]bool),
+	}
+}
+
+type SealedPersistence struct {
+	inner     omniwitness.LogStatePersistence
+	sealer    Sealer
+	instance  string
+	minEpochs func() (map[string]uint64, error)
+	unproven  UnprovenState
+
+	// mu guards epoch, the newest epoch that was loaded or handed out,
+	// epochs, the epoch of the newest stored record of each log,
+	// and stale, the logs whose stored record is not trusted until written again.
+	mu     sync.Mutex
+	loaded bool
+	epoch  uint64
+	epochs map[string]uint64
+	stale  map[string]bool
+
+	// headMu guards the last signed head and its text, so that it is
+	// only signed again once the state changed.
+	headMu   sync.Mutex
+	head     []byte
+	headText string
+
+	// Init is called by every user of the persistence, but state is only verified once.
+	initOnce sync.Once
+	initErr  error
+}
+
+func (p *SealedPersistence) Init() error {
+	p.initOnce.Do(func() {
+		p.initErr = p.load()
+	})
+	return p.initErr
+}
+
+func (p *SealedPersistence) Logs() ([]string, error) {
+	return p.inner.Logs()
+}
+
+func (p *SealedPersistence) ReadOps(logID string) (omniwitness.LogStateReadOps, error) {
+	read, err := p.inner.ReadOps(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReadWriter{
+		p:     p,
+		logID: logID,
+		read:  read,
+	}, nil
+}
+
+func (p *SealedPersistence) WriteOps(logID string) (omniwitness.LogStateWriteOps, error) {
+	write, err := p.inner.WriteOps(logID)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReadWriter{
+		p:     p,
+		logID: logID,
+		read:  write,
+		write: write,
+	}, nil
+}
+
+// Head returns the sealed head of the state: the newest epoch of every log,
+// as written by this instance. It fails until the state has been loaded.
+func (p *SealedPersistence) Head() ([]byte, error) {
+	p.mu.Lock()
+	if !p.loaded {
+		p.mu.Unlock()
+		return nil, errors.New("sealed state is not loaded yet")
+	}
+	h := sealHead{instance: p.instance, epoch: p.epoch, logs: make(map[string]uint64, len(p.epochs))}
+	for id, epoch := range p.epochs {
+		h.logs[id] = epoch
+	}
+	p.mu.Unlock()
+
+	p.headMu.Lock()
+	defer p.headMu.Unlock()
+	text := h.text()
+	if p.head != nil && p.headText == text {
+		return p.head, nil
+	}
+	raw, err := note.Sign(&note.Note{Text: text}, p.sealer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal head: %w", err)
+	}
+	p.head, p.headText = raw, text
+	return raw, nil
+}
+
+// Helper methods
+
+// Verifies every record in inner, and that none is older than its minimum epoch.
+func (p *SealedPersistence) load() error {
+	if err := p.inner.Init(); err != nil {
+		return err
+	}
+
+	known, err := p.minEpochs()
+	unproven := errors.Is(err, errNoSealedHead)
+	if err != nil && !unproven {
+		return fmt.Errorf("failed to determine minimum epochs: %w", err)
+	}
+
+	logs, err := p.inner.Logs()
+	if err != nil {
+		return err
+	}
+	if unproven {
+		switch {
+		case p.unproven == RefuseUnproven:
+			return fmt.Errorf("failed to determine minimum epochs: %w", err)
+		case p.unproven == AcceptEmpty && len(logs) > 0:
+			return fmt.Errorf("rejecting state of %d logs: %w", len(logs), err)
+		}
+	}
+
+	var newest uint64
+	epochs := make(map[string]uint64, len(logs))
+	stale := make(map[string]bool)
+	for _, id := range logs {
+		read, err := p.inner.ReadOps(id)
+		if err != nil {
+			return fmt.Errorf("ReadOps(): %w", err)
+		}
+		raw, err := read.GetLatest()
+		if err != nil {
+			return fmt.Errorf("GetLatest(): %w", err)
+		}
+		epoch, _, err := p.unseal(id, raw)
+		if err != nil {
+			return fmt.Errorf("rejecting state for log %s: %w", id, err)
+		}
+		if epoch < known[id] {
+			return fmt.Errorf("rejecting state for log %s at epoch %d, this instance already wrote it at epoch %d", id, epoch, known[id])
+		}
+		// Later writes must still be newer than any record that was stored.
+		newest = max(newest, epoch)
+		if unproven {
+			log.Printf("State for log %s at epoch %d is not vouched for by any peer, seeding it again", id, epoch)
+			stale[id] = true
+			continue
+		}
+		epochs[id] = epoch
+	}
+
+	// A record that was deleted is rolled back as much as one that was replaced.
+	for id, epoch := range known {
+		if _, ok := epochs[id]; !ok && epoch > 0 {
+			return fmt.Errorf("rejecting state without log %s, this instance already wrote it at epoch %d", id, epoch)
+		}
+		newest = max(newest, epoch)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.epoch = max(p.epoch, newest)
+	p.epochs = epochs
+	p.stale = stale
+	p.loaded = true
+	return nil
+}
+
+// Reports whether the stored record of logID is set aside until it is written again.
+func (p *SealedPersistence) isStale(logID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stale[logID]
+}
+
+// Returns the epoch for the next write.
+func (p *SealedPersistence) nextEpoch() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.epoch++
+	return p.epoch
+}
+
+// Records that the state of logID was durably written at epoch.
+func (p *SealedPersistence) written(logID string, epoch uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.epochs[logID] = max(p.epochs[logID], epoch)
+	delete(p.stale, logID)
+}
+
+func (p *SealedPersistence) seal(logID string, epoch uint64, chkpt []byte) ([]byte, error) {
+	text := fmt.Sprintf("%s\n%s\n%s\n%d\n%s\n", sealedHeader, p.instance, logID, epoch, base64.StdEncoding.EncodeToString(chkpt))
+	return note.Sign(&note.Note{Text: text}, p.sealer)
+}
+
+func (p *SealedPersistence) unseal(logID string, raw []byte) (uint64, []byte, error) {
+	n, err := note.Open(raw, note.VerifierList(p.sealer))
+	if err != nil {
+		return 0, nil, fmt.Errorf("record is not sealed by the witness: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(n.Text, "\n"), "\n")
+	if len(lines) != 5 || lines[0] != sealedHeader {
+		return 0, nil, errors.New("malformed record")
+	}
+	// Records are bound to their instance and log, so they cannot be
+	// copied from another instance or swapped between logs.
+	if lines[1] != p.instance {
+		return 0, nil, fmt.Errorf("record was written by instance %s", lines[1])
+	}
+	if lines[2] != logID {
+		return 0, nil, fmt.Errorf("record is for log %s", lines[2])
+	}
+	epoch, err := strconv.ParseUint(lines[3], 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed epoch: %w", err)
+	}
+	chkpt, err := base64.StdEncoding.DecodeString(lines[4])
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed checkpoint: %w", err)
+	}
+	return epoch, chkpt, nil
+}
+
+type sealedReadWriter struct {
+	p     *SealedPersistence
+	logID string
+
+	read  omniwitness.LogStateReadOps
+	write omniwitness.LogStateWriteOps
+}
+
+func (rw *sealedReadWriter) GetLatest() ([]byte, error) {
+	if rw.p.isStale(rw.logID) {
+		return nil, status.Errorf(codes.NotFound, "state for log %s is being seeded again", rw.logID)
+	}
+	raw, err := rw.read.GetLatest()
+	if err != nil {
+		return nil, err
+	}
+	_, chkpt, err := rw.p.unseal(rw.logID, raw)
+	if err != nil {
+		return nil, status.Errorf(codes.DataLoss, "invalid state for log %s: %v", rw.logID, err)
+	}
+	return chkpt, nil
+}
+
+func (rw *sealedReadWriter) Set(c []byte) error {
+	epoch := rw.p.nextEpoch()
+	sealed, err := rw.p.seal(rw.logID, epoch, c)
+	if err != nil {
+		return fmt.Errorf("failed to seal checkpoint: %w", err)
+	}
+	if err := rw.write.Set(sealed); err != nil {
+		return err
+	}
+	rw.p.written(rw.logID, epoch)
+	return nil
+}
+
+func (rw *sealedReadWriter) Close() error {
+	return rw.write.Close()
+}
+
+// The newest epoch of an instance, and of every log it stores.
+type sealHead struct {
+	instance string
+	epoch    uint64
+	logs     map[string]uint64
+}
+
+func (h sealHead) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%d\n", sealedHeadHeader, h.instance, h.epoch)
+	ids := make([]string, 0, len(h.logs))
+	for id := range h.logs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%s %d\n", id, h.logs[id])
+	}
+	return b.String()
+}
+
+/// Helper functions
+
+// Verifies and parses a sealed head.
+func openSealHead(raw []byte, v note.Verifier) (*sealHead, error) {
+	n, err := note.Open(raw, note.VerifierList(v))
+	if err != nil {
+		return nil, fmt.Errorf("head is not sealed by the witness: %w", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(n.Text, "\n"), "\n")
+	if len(lines) < 3 || lines[0] != sealedHeadHeader {
+		return nil, errors.New("malformed head")
+	}
+	h := &sealHead{instance: lines[1], logs: make(map[string]uint64, len(lines)-3)}
+	if h.epoch, err = strconv.ParseUint(lines[2], 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed epoch: %w", err)
+	}
+	for _, line := range lines[3:] {
+		id, e, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, errors.New("malformed head")
+		}
+		epoch, err := strconv.ParseUint(e, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed epoch for log %s: %w", id, err)
+		}
+		h.logs[id] = epoch
+	}
+	return h, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestNoteKms(t *testing.T) *NoteKms {
+	t.Helper()
+	backend, err := NewDevBackend("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNoteKms(context.Background(), backend, "example.com/witness", NewClock(ClockClamp, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Returns the epochs of every log in the head of p.
+func sealedEpochs(t *testing.T, p *SealedPersistence, v note.Verifier) map[string]uint64 {
+	t.Helper()
+	raw, err := p.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := openSealHead(raw, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.logs
+}
+
+func TestSealedPersistence(t *testing.T) {
+	n := newTestNoteKms(t)
+	inner := NewFilePersistence(t.TempDir())
+	noEpochs := func() (map[string]uint64, error) { return nil, nil }
+	p := NewSealedPersistence(inner, n.Sealer(), "a", noEpochs, RefuseUnproven)
+	if _, err := p.Head(); err == nil {
+		t.Error("Head() before Init() succeeded")
+	}
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []string{"one", "two"} {
+		write, err := p.WriteOps("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write.Set([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+		write.Close()
+	}
+	read, err := p.ReadOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read.GetLatest(); err != nil || string(got) != "two" {
+		t.Errorf("GetLatest() = %q, %v, want %q", got, err, "two")
+	}
+	if got := sealedEpochs(t, p, n.Sealer()); got["log"] != 2 {
+		t.Errorf("head epochs = %v, want log at 2", got)
+	}
+
+	// Seals are neither cosignatures, nor take time from the clock.
+	innerRead, err := inner.ReadOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := innerRead.GetLatest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := note.Open(raw, note.VerifierList(n)); err == nil {
+		t.Error("sealed record opens as a cosigned note")
+	}
+	if n.Sealer().KeyHash() == n.KeyHash() {
+		t.Error("seals and cosignatures share a key hash")
+	}
+	if s := n.clock.Status(); s.LastIssued != nil {
+		t.Errorf("sealing advanced the clock to %v", s.LastIssued)
+	}
+	msg := []byte("example.com/log\n1\nAAAA\n")
+	sig, err := n.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Sealer().Verify(msg, sig) || n.Sealer().Verify(msg, sig[timestampSize:]) {
+		t.Error("cosignature verifies as a seal")
+	}
+
+	// The state reloads, but only for the instance that sealed it.
+	if err := NewSealedPersistence(inner, n.Sealer(), "a", noEpochs, RefuseUnproven).Init(); err != nil {
+		t.Errorf("Init() of sealed state = %v", err)
+	}
+	if err := NewSealedPersistence(inner, n.Sealer(), "b", noEpochs, RefuseUnproven).Init(); err == nil {
+		t.Error("Init() of state sealed by another instance succeeded")
+	}
+	if err := NewSealedPersistence(inner, newTestNoteKms(t).Sealer(), "a", noEpochs, RefuseUnproven).Init(); err == nil {
+		t.Error("Init() of state sealed by another key succeeded")
+	}
+}
+
+func TestSealedPersistenceRejectsSwappedLog(t *testing.T) {
+	n := newTestNoteKms(t)
+	inner := NewPersistence()
+	p := NewSealedPersistence(inner, n.Sealer(), "a", func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	write, err := p.WriteOps("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set([]byte("checkpoint")); err != nil {
+		t.Fatal(err)
+	}
+
+	innerRead, err := inner.ReadOps("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := innerRead.GetLatest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerWrite, err := inner.WriteOps("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := innerWrite.Set(raw); err != nil {
+		t.Fatal(err)
+	}
+	read, err := p.ReadOps("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read.GetLatest(); status.Code(err) != codes.DataLoss {
+		t.Errorf("GetLatest() of a record for another log = %v, want DataLoss", err)
+	}
+}
+
+func TestSealedPersistenceRejectsRollback(t *testing.T) {
+	n := newTestNoteKms(t)
+	inner := NewFilePersistence(t.TempDir())
+	p := NewSealedPersistence(inner, n.Sealer(), "a", func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot []byte
+	for _, c := range []string{"one", "two"} {
+		write, err := p.WriteOps("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write.Set([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+		write.Close()
+		if snapshot == nil {
+			read, err := inner.ReadOps("log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot, err = read.GetLatest(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	known := sealedEpochs(t, p, n.Sealer())
+
+	// Restore the snapshot taken after the first write.
+	write, err := inner.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	err = NewSealedPersistence(inner, n.Sealer(), "a", func() (map[string]uint64, error) { return known, nil }, RefuseUnproven).Init()
+	if err == nil || !strings.Contains(err.Error(), "already wrote it") {
+		t.Errorf("Init() of a rolled back snapshot = %v", err)
+	}
+
+	// Deleting the log entirely is a rollback too.
+	known["deleted"] = 1
+	err = NewSealedPersistence(NewPersistence(), n.Sealer(), "a", func() (map[string]uint64, error) { return known, nil }, RefuseUnproven).Init()
+	if err == nil {
+		t.Error("Init() without a known log succeeded")
+	}
+}
+
+func TestSealHeadsKnown(t *testing.T) {
+	n := newTestNoteKms(t)
+	sealer := n.Sealer()
+
+	// Returns a peer serving the heads in h, with the head of instance "b".
+	newPeer := func(t *testing.T, h *SealHeads) Peer {
+		t.Helper()
+		p := NewSealedPersistence(NewPersistence(), sealer, "b", func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(http.StripPrefix("/sealed", h.Handler(p.Head)))
+		t.Cleanup(srv.Close)
+		return Peer{URL: srv.URL}
+	}
+	sealA := func(t *testing.T, epochs map[string]uint64) *SealedPersistence {
+		t.Helper()
+		p := NewSealedPersistence(NewPersistence(), sealer, "a", func() (map[string]uint64, error) { return epochs, nil }, RefuseUnproven)
+		for id := range epochs {
+			write, err := p.inner.WriteOps(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := p.seal(id, epochs[id], []byte("checkpoint"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := write.Set(raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// Without peers, nothing is known, which fails closed.
+	if _, err := newTestSealHeads(t, "a", sealer, nil, NewPersistence()).Known(context.Background()); !errors.Is(err, errNoSealedHead) {
+		t.Errorf("Known() without peers = %v, want errNoSealedHead", err)
+	}
+
+	// Peers that cannot be reached fail closed.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	if _, err := newTestSealHeads(t, "a", sealer, []Peer{{URL: down.URL}}, NewPersistence()).Known(context.Background()); !errors.Is(err, errNoSealedHead) {
+		t.Errorf("Known() with unreachable peers = %v, want errNoSealedHead", err)
+	}
+
+	// A peer that has not seen this instance is no better than an unreachable one,
+	// as anyone on the network can answer that it has not.
+	peerStore := NewPersistence()
+	peerHeads := newTestSealHeads(t, "b", sealer, nil, peerStore)
+	peer := newPeer(t, peerHeads)
+	heads := newTestSealHeads(t, "a", sealer, []Peer{peer, {URL: down.URL}}, NewPersistence())
+	if _, err := heads.Known(context.Background()); !errors.Is(err, errNoSealedHead) {
+		t.Errorf("Known() before the peer saw this instance = %v, want errNoSealedHead", err)
+	}
+
+	// Once the peer fetched the head of this instance, it is returned.
+	a := sealA(t, map[string]uint64{"log": 3})
+	own := httptest.NewServer(http.StripPrefix("/sealed", heads.Handler(a.Head)))
+	defer own.Close()
+	peerHeads.peers = []Peer{{URL: own.URL}}
+	peerHeads.FetchOnce(context.Background())
+	if got, err := heads.Known(context.Background()); err != nil || got["log"] != 3 {
+		t.Errorf("Known() = %v, %v, want log at 3", got, err)
+	}
+
+	// An older head does not replace a newer one.
+	old := sealA(t, map[string]uint64{"log": 1})
+	raw, err := old.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerHeads.observe(raw); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := heads.Known(context.Background()); err != nil || got["log"] != 3 {
+		t.Errorf("Known() after an older head = %v, %v, want log at 3", got, err)
+	}
+
+	// The peer keeps the newest head across restarts.
+	peerHeads = newTestSealHeads(t, "b", sealer, nil, peerStore)
+	heads.peers = []Peer{newPeer(t, peerHeads)}
+	if got, err := heads.Known(context.Background()); err != nil || got["log"] != 3 {
+		t.Errorf("Known() after the peer restarted = %v, %v, want log at 3", got, err)
+	}
+
+	// Heads that are not sealed by the witness are ignored.
+	if err := peerHeads.observe([]byte("confidential-witness/sealed-head/v1\na\n9\n\n— example.com/witness AAAA\n")); err == nil {
+		t.Error("observe() of an unsealed head succeeded")
+	}
+}
+
+func newTestSealHeads(t *testing.T, instance string, sealer Sealer, peers []Peer, store omniwitness.LogStatePersistence) *SealHeads {
+	t.Helper()
+	h, err := NewSealHeads(instance, sealer, peers, http.DefaultClient, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestSealHeadsLoad(t *testing.T) {
+	n := newTestNoteKms(t)
+	sealer := n.Sealer()
+	head := func(t *testing.T, instance string) []byte {
+		t.Helper()
+		p := NewSealedPersistence(NewPersistence(), sealer, instance, func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := p.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	store := NewPersistence()
+	for id, raw := range map[string][]byte{
+		headID("a"):     head(t, "a"),
+		headID("b"):     head(t, "b"),
+		headID("other"): head(t, "c"),
+		headID("d"):     []byte("not a head"),
+	} {
+		write, err := store.WriteOps(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write.Set(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only valid heads of other instances, stored under their own ID, are loaded.
+	h := newTestSealHeads(t, "a", sealer, nil, store)
+	if len(h.heads) != 1 || h.heads["b"].raw == nil {
+		t.Errorf("loaded heads of %v, want only b", h.heads)
+	}
+}
+
+func TestSealedPersistenceUnproven(t *testing.T) {
+	n := newTestNoteKms(t)
+	sealer := n.Sealer()
+	unknown := func() (map[string]uint64, error) { return nil, errNoSealedHead }
+
+	empty := NewPersistence()
+	stored := NewPersistence()
+	p := NewSealedPersistence(stored, sealer, "a", func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	write, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set([]byte("checkpoint")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		inner    omniwitness.LogStatePersistence
+		unproven UnprovenState
+		wantErr  bool
+	}{
+		{"refuse empty", empty, RefuseUnproven, true},
+		{"refuse stored", stored, RefuseUnproven, true},
+		{"accept empty", empty, AcceptEmpty, false},
+		{"accept empty with stored", stored, AcceptEmpty, true},
+		{"reseed empty", empty, Reseed, false},
+		{"reseed stored", stored, Reseed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewSealedPersistence(tc.inner, sealer, "a", unknown, tc.unproven).Init()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Init() = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	// Other failures to determine the epochs are never accepted.
+	failing := func() (map[string]uint64, error) { return nil, errors.New("failed") }
+	if err := NewSealedPersistence(empty, sealer, "a", failing, Reseed).Init(); err == nil {
+		t.Error("Init() with failing minimum epochs succeeded")
+	}
+}
+
+func TestSealedPersistenceReseed(t *testing.T) {
+	n := newTestNoteKms(t)
+	sealer := n.Sealer()
+	inner := NewPersistence()
+	p := NewSealedPersistence(inner, sealer, "a", func() (map[string]uint64, error) { return nil, nil }, RefuseUnproven)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	write, err := p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	before := sealedEpochs(t, p, sealer)
+
+	p = NewSealedPersistence(inner, sealer, "a", func() (map[string]uint64, error) { return nil, errNoSealedHead }, Reseed)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// The stored log reads as missing, and is left out of the head, until it is seeded again.
+	if found, err := hasState(p, "log"); err != nil || found {
+		t.Errorf("hasState() of a stale log = %v, %v", found, err)
+	}
+	if got := sealedEpochs(t, p, sealer); len(got) != 0 {
+		t.Errorf("head epochs = %v, want none", got)
+	}
+	write, err = p.WriteOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write.Set([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	read, err := p.ReadOps("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read.GetLatest(); err != nil || string(got) != "new" {
+		t.Errorf("GetLatest() = %q, %v, want %q", got, err, "new")
+	}
+	// Epochs keep increasing past the stale record.
+	if got := sealedEpochs(t, p, sealer); got["log"] <= before["log"] {
+		t.Errorf("head epochs = %v, want log after %d", got, before["log"])
+	}
+}
@@ -0,0 +1,229 @@
+// Exchanges the heads of sealed state between instances of the witness.
+//
+// Each instance serves its sealed head, which lists the newest epoch it wrote
+// for every log, next to its witness API. Peers fetch it on an interval and keep
+// the newest head they have seen from every instance, durably so that it survives
+// their own restarts. An instance that restarts asks its peers for its own newest
+// head, and refuses state that is older, so whoever controls its disk or bucket
+// cannot roll it back to an older snapshot.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Path of the URL to the newest sealed head of an instance, relative to the witness API.
+// With an empty instance, the peer serves its own head.
+const httpSealedHead = "/sealed/%s"
+
+type SealHeads struct {
+	instance string
+	verifier note.Verifier
+	peers    []Peer
+	client   *http.Client
+	// Where the newest head of every other instance is kept, by headID.
+	store omniwitness.LogStatePersistence
+
+	mu    sync.Mutex
+	heads map[string]seenHead
+}
+
+type seenHead struct {
+	raw   []byte
+	epoch uint64
+}
+
+// NewSealHeads constructs an exchange of sealed heads between instance and
+// peers, that only accepts heads sealed by verifier. The heads of other
+// instances are kept in store, and loaded from it.
+func NewSealHeads(instance string, verifier note.Verifier, peers []Peer, client *http.Client, store omniwitness.LogStatePersistence) (*SealHeads, error) {
+	h := &SealHeads{
+		instance: instance,
+		verifier: verifier,
+		peers:    peers,
+		client:   client,
+		store:    store,
+		heads:    make(map[string]seenHead),
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Known returns the epoch of every log in the newest head of this instance
+// held by any peer. It fails with errNoSealedHead unless at least one peer
+// returns a valid head of this instance. A peer answering that it has none
+// is unauthenticated, so it counts as unreachable: otherwise, whoever controls
+// the network could answer so for every peer and roll the state back.
+func (h *SealHeads) Known(ctx context.Context) (map[string]uint64, error) {
+	var newest *sealHead
+	for _, peer := range h.peers {
+		raw, err := httpGet(ctx, h.client, peer.URL+fmt.Sprintf(httpSealedHead, url.PathEscape(h.instance)))
+		if err != nil {
+			log.Printf("Failed to fetch sealed head from %s: %v", peer.URL, err)
+			continue
+		}
+		head, err := openSealHead(raw, h.verifier)
+		if err == nil && head.instance != h.instance {
+			err = fmt.Errorf("head is for instance %s", head.instance)
+		}
+		if err != nil {
+			log.Printf("Peer %s returned an invalid sealed head: %v", peer.URL, err)
+			continue
+		}
+		if newest == nil || head.epoch > newest.epoch {
+			newest = head
+		}
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("%w from any of the %d peers", errNoSealedHead, len(h.peers))
+	}
+	return newest.logs, nil
+}
+
+var errNoSealedHead = errors.New("no sealed head of this instance")
+
+// Run fetches the head of every peer on every interval until ctx is done.
+func (h *SealHeads) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		h.FetchOnce(ctx)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// FetchOnce fetches the head of every peer, keeping it if it is newer than
+// the one already seen for that instance.
+func (h *SealHeads) FetchOnce(ctx context.Context) {
+	for _, peer := range h.peers {
+		raw, err := httpGet(ctx, h.client, peer.URL+fmt.Sprintf(httpSealedHead, ""))
+		if err != nil {
+			log.Printf("Failed to fetch sealed head from %s: %v", peer.URL, err)
+			continue
+		}
+		if err := h.observe(raw); err != nil {
+			log.Printf("Peer %s returned an invalid sealed head: %v", peer.URL, err)
+		}
+	}
+}
+
+// Handler serves the head returned by own at /, and the newest head seen for
+// each instance at /{instance}.
+func (h *SealHeads) Handler(own func() ([]byte, error)) http.Handler {
+	serveOwn := func(w http.ResponseWriter, r *http.Request) {
+		raw, err := own()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(raw)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", serveOwn)
+	mux.HandleFunc("GET /{instance}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("instance") == h.instance {
+			serveOwn(w, r)
+			return
+		}
+		h.mu.Lock()
+		head, ok := h.heads[r.PathValue("instance")]
+		h.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(head.raw)
+	})
+	return mux
+}
+
+// Helper methods
+
+// Loads the heads kept in the store. Heads that are invalid are skipped,
+// as the newest head of each instance is fetched again from its peer.
+func (h *SealHeads) load() error {
+	if err := h.store.Init(); err != nil {
+		return fmt.Errorf("failed to initialize sealed head store: %w", err)
+	}
+	ids, err := h.store.Logs()
+	if err != nil {
+		return fmt.Errorf("failed to list sealed heads: %w", err)
+	}
+	for _, id := range ids {
+		read, err := h.store.ReadOps(id)
+		if err != nil {
+			return fmt.Errorf("ReadOps(): %w", err)
+		}
+		raw, err := read.GetLatest()
+		if err != nil {
+			return fmt.Errorf("GetLatest(): %w", err)
+		}
+		head, err := openSealHead(raw, h.verifier)
+		if err == nil && (head.instance == h.instance || headID(head.instance) != id) {
+			err = fmt.Errorf("head of instance %s stored as %s", head.instance, id)
+		}
+		if err != nil {
+			log.Printf("Ignoring stored sealed head %s: %v", id, err)
+			continue
+		}
+		h.heads[head.instance] = seenHead{raw: raw, epoch: head.epoch}
+	}
+	return nil
+}
+
+func (h *SealHeads) observe(raw []byte) error {
+	head, err := openSealHead(raw, h.verifier)
+	if err != nil {
+		return err
+	}
+	// This instance knows its own head best, a peer claiming it is misconfigured.
+	if head.instance == h.instance {
+		return fmt.Errorf("peer claims to be instance %s", h.instance)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seen, ok := h.heads[head.instance]; ok && head.epoch <= seen.epoch {
+		return nil
+	}
+	// Kept in memory even if storing it fails, it is stored again with the next newer head.
+	h.heads[head.instance] = seenHead{raw: raw, epoch: head.epoch}
+	if err := h.keep(head.instance, raw); err != nil {
+		return fmt.Errorf("failed to store sealed head of %s: %w", head.instance, err)
+	}
+	return nil
+}
+
+// Replaces the stored head of instance with raw.
+func (h *SealHeads) keep(instance string, raw []byte) error {
+	write, err := h.store.WriteOps(headID(instance))
+	if err != nil {
+		return fmt.Errorf("WriteOps(): %w", err)
+	}
+	defer write.Close()
+	return write.Set(raw)
+}
+
+/// Helper functions
+
+// Returns the ID the head of instance is stored under, which is safe to use as a file or object name.
+func headID(instance string) string {
+	h := sha256.Sum256([]byte(instance))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,232 @@
+// Implements a transparency log of every cosignature issued by the witness,
+// so that auditors can check that it never cosigned two conflicting views of a log.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	tessera "github.com/transparency-dev/trillian-tessera"
+	"github.com/transparency-dev/trillian-tessera/api/layout"
+	"github.com/transparency-dev/trillian-tessera/storage/posix"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// File in the log directory that holds the highest timestamp of the cosignatures
+// in the log and on its checkpoints. It is written before any of them is released.
+const sigLogIssuedFile = "issued"
+
+// File in the log directory where tessera keeps the size and root of the tree.
+var sigLogTreeState = filepath.Join(".state", "treeState")
+
+type SigLog struct {
+	origin   string
+	dir      string
+	storage  *posix.Storage
+	verifier note.Verifier
+	// Optional mirror that every file of the log is uploaded to before a cosignature is released.
+	mirror *SigLogMirror
+
+	mu           sync.Mutex
+	lastRaw      []byte
+	lastCosigned []byte
+
+	issuedMu sync.Mutex
+	issued   uint64
+}
+
+// NewSigLog opens the log named by sealer in a directory under dir,
+// creating it if it does not exist. If mirror is not nil, a log that does not
+// exist in dir is restored from it, and every change is uploaded to it.
+//
+// Its checkpoints are signed by sealer, under the witness key, so that the log
+// continues across restarts. They are trusted because the witness cosigns them.
+func NewSigLog(ctx context.Context, dir string, sealer Sealer, mirror *SigLogMirror) (*SigLog, error) {
+	origin := sealer.Name()
+	// The origin is unique to this log, so it names the directory too.
+	logDir := filepath.Join(dir, strings.NewReplacer("/", "_", "\\", "_").Replace(origin))
+	exists, err := sigLogExists(logDir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && mirror != nil {
+		if err := mirror.Restore(ctx, logDir); err != nil {
+			return nil, err
+		}
+		if exists, err = sigLogExists(logDir); err != nil {
+			return nil, err
+		}
+	}
+	storage, err := posix.New(ctx, logDir, !exists, tessera.WithCheckpointSigner(sealer))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log storage: %w", err)
+	}
+
+	l := &SigLog{
+		origin:   origin,
+		dir:      logDir,
+		storage:  storage,
+		verifier: sealer,
+		mirror:   mirror,
+	}
+	if err := l.readIssued(); err != nil {
+		return nil, err
+	}
+	if err := l.sync(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append adds the cosignature sig by signer over msg to the log, and waits
+// until it is integrated. The entry is msg as a note carrying only the cosignature.
+func (l *SigLog) Append(ctx context.Context, signer note.Signer, msg, sig []byte) error {
+	line := binary.BigEndian.AppendUint32(nil, signer.KeyHash())
+	line = append(line, sig...)
+
+	var entry bytes.Buffer
+	entry.Write(msg)
+	fmt.Fprintf(&entry, "\n— %s %s\n", signer.Name(), base64.StdEncoding.EncodeToString(line))
+
+	if _, err := l.storage.Add(ctx, tessera.NewEntry(entry.Bytes()))(); err != nil {
+		cosignatureLogErrors.Inc()
+		return fmt.Errorf("failed to append cosignature to log: %w", err)
+	}
+	if err := l.recordIssued(binary.BigEndian.Uint64(sig)); err != nil {
+		return err
+	}
+	return l.sync(ctx)
+}
+
+// Observe durably records that a cosignature with timestamp t is about to be
+// released, for cosignatures that are not appended, such as on the checkpoints
+// of the log itself.
+func (l *SigLog) Observe(ctx context.Context, t uint64) error {
+	if err := l.recordIssued(t); err != nil {
+		return err
+	}
+	return l.sync(ctx)
+}
+
+// Issued returns the highest timestamp of the cosignatures in the log and on
+// its checkpoints, including those released before the witness restarted.
+func (l *SigLog) Issued() uint64 {
+	l.issuedMu.Lock()
+	defer l.issuedMu.Unlock()
+	return l.issued
+}
+
+// Handler serves the log read-only, with its checkpoint cosigned by cosigner.
+// Cosigning the checkpoint must not append to the log itself.
+func (l *SigLog) Handler(cosigner note.Signer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /"+layout.CheckpointPath, func(w http.ResponseWriter, r *http.Request) {
+		cp, err := l.checkpoint(cosigner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(cp)
+	})
+	// Only tiles and entry bundles are served from the log directory, not its internal state.
+	mux.Handle("GET /tile/", http.FileServer(http.Dir(l.dir)))
+	return mux
+}
+
+// Helper methods
+
+// Returns the latest checkpoint, cosigned by cosigner. Unchanged checkpoints
+// are not cosigned again, so that polling does not cost signatures.
+func (l *SigLog) checkpoint(cosigner note.Signer) ([]byte, error) {
+	raw, err := l.storage.ReadCheckpoint(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bytes.Equal(raw, l.lastRaw) {
+		return l.lastCosigned, nil
+	}
+
+	n, err := note.Open(raw, note.VerifierList(l.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	if origin, _, _ := strings.Cut(n.Text, "\n"); origin != l.origin {
+		return nil, fmt.Errorf("checkpoint is for log %q", origin)
+	}
+	cosigned, err := note.Sign(n, cosigner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cosign checkpoint: %w", err)
+	}
+	l.lastRaw, l.lastCosigned = raw, cosigned
+	return cosigned, nil
+}
+
+func (l *SigLog) recordIssued(t uint64) error {
+	l.issuedMu.Lock()
+	defer l.issuedMu.Unlock()
+	if t <= l.issued {
+		return nil
+	}
+	if err := writeFileAtomic(filepath.Join(l.dir, sigLogIssuedFile), []byte(strconv.FormatUint(t, 10))); err != nil {
+		cosignatureLogErrors.Inc()
+		return fmt.Errorf("failed to record cosignature timestamp: %w", err)
+	}
+	l.issued = t
+	return nil
+}
+
+// Uploads the log to the mirror, if there is one.
+func (l *SigLog) sync(ctx context.Context) error {
+	if l.mirror == nil {
+		return nil
+	}
+	if err := l.mirror.Sync(ctx, l.dir); err != nil {
+		cosignatureLogErrors.Inc()
+		return err
+	}
+	return nil
+}
+
+func (l *SigLog) readIssued() error {
+	raw, err := os.ReadFile(filepath.Join(l.dir, sigLogIssuedFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cosignature timestamp: %w", err)
+	}
+	l.issued, err = strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed cosignature timestamp: %w", err)
+	}
+	return nil
+}
+
+/// Helper functions
+
+// Reports whether there is a log in dir.
+func sigLogExists(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, sigLogTreeState))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open log directory: %w", err)
+	}
+	return true, nil
+}
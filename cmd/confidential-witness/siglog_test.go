@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aditsachde/confidential-witness/internal/fakegcs"
+	"golang.org/x/mod/sumdb/note"
+)
+
+const testSigLogOrigin = "example.com/witness/cosignatures"
+
+// Opens the log in dir, with every cosignature by n appended to it.
+func openTestSigLog(t *testing.T, n *NoteKms, dir string, mirror *SigLogMirror) *SigLog {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	l, err := NewSigLog(ctx, dir, n.SigLogSealer(testSigLogOrigin), mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetSigLog(l)
+	return l
+}
+
+// Returns the size of the tree tessera stored for l.
+func sigLogSize(t *testing.T, l *SigLog) uint64 {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join(l.dir, sigLogTreeState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state struct{ Size uint64 }
+	if err := json.Unmarshal(raw, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state.Size
+}
+
+func TestSigLog(t *testing.T) {
+	dir := t.TempDir()
+	n := newTestNoteKms(t)
+	l := openTestSigLog(t, n, dir, nil)
+
+	if _, err := n.Sign([]byte("example.com/log\n1\nAAAA\n")); err != nil {
+		t.Fatal(err)
+	}
+	logged := l.Issued()
+	if logged == 0 {
+		t.Fatal("Issued() = 0 after a logged cosignature")
+	}
+	if got := sigLogSize(t, l); got != 1 {
+		t.Errorf("log size = %d, want 1", got)
+	}
+
+	// Cosignatures that are not logged are recorded too.
+	n.clock.Observe(logged + 60)
+	if _, err := (unloggedSigner{n}).Sign([]byte(testSigLogOrigin + "\n1\nAAAA\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Issued(); got != logged+60 {
+		t.Errorf("Issued() = %d after an unlogged cosignature, want %d", got, logged+60)
+	}
+
+	// Seals do not end up in the log.
+	if _, err := n.Sealer().Sign([]byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	if got := sigLogSize(t, l); got != 1 {
+		t.Errorf("log size = %d after sealing, want 1", got)
+	}
+
+	// The log continues where it left off, under the same key.
+	l = openTestSigLog(t, n, dir, nil)
+	if got := l.Issued(); got != logged+60 {
+		t.Errorf("Issued() after reopening = %d, want %d", got, logged+60)
+	}
+	if _, err := n.Sign([]byte("example.com/log\n2\nAAAA\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := sigLogSize(t, l); got != 2 {
+		t.Errorf("log size after reopening = %d, want 2", got)
+	}
+
+	// A log sealed under another key is not served.
+	other := newTestNoteKms(t)
+	l = openTestSigLog(t, other, dir, nil)
+	if _, err := l.checkpoint(unloggedSigner{other}); err == nil {
+		t.Error("checkpoint() of a log sealed under another key succeeded")
+	}
+}
+
+func TestSigLogHandler(t *testing.T) {
+	n := newTestNoteKms(t)
+	l := openTestSigLog(t, n, t.TempDir(), nil)
+	srv := httptest.NewServer(l.Handler(unloggedSigner{n}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clients verify the checkpoint with the verifier key of the witness alone.
+	cp, err := note.Open(raw, note.VerifierList(n))
+	if err != nil {
+		t.Fatalf("checkpoint %q does not open with the witness key: %v", raw, err)
+	}
+	if !strings.HasPrefix(cp.Text, testSigLogOrigin+"\n") {
+		t.Errorf("checkpoint is for %q", cp.Text)
+	}
+}
+
+func TestSigLogMirror(t *testing.T) {
+	srv := fakegcs.New(testBucket)
+	defer srv.Close()
+	service, err := srv.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNoteKms(t)
+	l := openTestSigLog(t, n, t.TempDir(), NewSigLogMirror(service, testBucket, "cosignatures/"))
+	for _, size := range []string{"1", "2", "3"} {
+		if _, err := n.Sign([]byte("example.com/log\n" + size + "\nAAAA\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := srv.Get(testBucket, "cosignatures/"+sigLogIssuedFile); !ok {
+		t.Error("cosignature timestamp was not mirrored")
+	}
+	// Every entry bundle and tile tessera wrote is mirrored.
+	err = filepath.WalkDir(filepath.Join(l.dir, "tile"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		local, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if got, ok := srv.Get(testBucket, "cosignatures/"+filepath.ToSlash(rel)); !ok || !bytes.Equal(got, local) {
+			t.Errorf("%s is not mirrored", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new VM restores the log from the bucket and continues it.
+	restored := openTestSigLog(t, n, t.TempDir(), NewSigLogMirror(service, testBucket, "cosignatures/"))
+	if got, want := restored.Issued(), l.Issued(); got != want {
+		t.Errorf("Issued() after restoring = %d, want %d", got, want)
+	}
+	if got := sigLogSize(t, restored); got != 3 {
+		t.Fatalf("log size after restoring = %d, want 3", got)
+	}
+	if _, err := n.Sign([]byte("example.com/log\n4\nAAAA\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := sigLogSize(t, restored); got != 4 {
+		t.Errorf("log size after appending to the restored log = %d, want 4", got)
+	}
+
+	// The mirror fails closed when the bucket is gone.
+	broken := NewSigLogMirror(service, "missing", "cosignatures/")
+	if _, err := NewSigLog(context.Background(), t.TempDir(), n.SigLogSealer(testSigLogOrigin), broken); err == nil {
+		t.Error("NewSigLog() with an unreachable mirror succeeded")
+	}
+}
+
+func TestSigLogFiles(t *testing.T) {
+	for _, tc := range []struct {
+		from, to uint64
+		want     []string
+	}{
+		{0, 0, nil},
+		{3, 3, nil},
+		{0, 1, []string{"tile/entries/000.p/1", "tile/0/000.p/1"}},
+		{1, 3, []string{"tile/entries/000.p/3", "tile/0/000.p/3"}},
+		{255, 256, []string{"tile/entries/000", "tile/0/000", "tile/1/000.p/1"}},
+		{255, 257, []string{"tile/entries/000", "tile/entries/001.p/1", "tile/0/000", "tile/0/001.p/1", "tile/1/000.p/1"}},
+		{256, 300, []string{"tile/entries/001.p/44", "tile/0/001.p/44"}},
+		{65535, 65536, []string{"tile/entries/255", "tile/0/255", "tile/1/000", "tile/2/000.p/1"}},
+	} {
+		t.Run(fmt.Sprintf("%d-%d", tc.from, tc.to), func(t *testing.T) {
+			var want []string
+			for _, f := range tc.want {
+				want = append(want, filepath.FromSlash(f))
+			}
+			if got := sigLogFiles(tc.from, tc.to); !slices.Equal(got, want) {
+				t.Errorf("sigLogFiles() = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+// Implements a mirror of the cosignature log in a GCS bucket, so that the log
+// survives the loss of the VM it is stored on.
+//
+// The log is kept by tessera in a local directory. Every file it writes is
+// uploaded before the cosignature it holds is released, and a directory
+// without a log is restored from the bucket when the witness starts. The files
+// to upload follow from the size of the tree, so the directory is never walked.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/transparency-dev/trillian-tessera/api/layout"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// Number of entries in an entry bundle, and of hashes in a tile.
+const sigLogTileWidth = 256
+
+// Files that tessera replaces as the log grows, relative to its directory. They
+// are uploaded after every other file, so that the bucket never holds a tree
+// state whose tiles and entries are missing.
+var sigLogStateFiles = []string{
+	sigLogTreeState,
+	"checkpoint",
+	sigLogIssuedFile,
+}
+
+// NewSigLogMirror returns a mirror of the log to objects named prefix followed
+// by the path of each file in the log directory in bucket.
+func NewSigLogMirror(service *gcs.Service, bucket, prefix string) *SigLogMirror {
+	return &SigLogMirror{
+		service: service,
+		bucket:  bucket,
+		prefix:  prefix,
+		synced:  make(map[string]syncedFile),
+	}
+}
+
+type SigLogMirror struct {
+	service *gcs.Service
+	bucket  string
+	prefix  string
+
+	// mu serializes syncs, and guards the version of every state file that
+	// was uploaded, and the size of the tree whose tiles were uploaded.
+	mu     sync.Mutex
+	synced map[string]syncedFile
+	size   uint64
+}
+
+type syncedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// Restore downloads every file of the log into dir.
+func (m *SigLogMirror) Restore(ctx context.Context, dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	err := m.service.Objects.List(m.bucket).Prefix(m.prefix).Pages(ctx, func(objs *gcs.Objects) error {
+		for _, obj := range objs.Items {
+			names = append(names, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list cosignature log in bucket: %w", err)
+	}
+
+	for _, name := range names {
+		rel := filepath.FromSlash(strings.TrimPrefix(name, m.prefix))
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid object name %q in cosignature log", name)
+		}
+		resp, err := m.service.Objects.Get(m.bucket, name).Context(ctx).Download()
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", rel, err)
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+		if !slices.Contains(sigLogStateFiles, rel) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		m.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+	}
+
+	// The bucket holds no log when the witness first starts.
+	size, err := readSigLogSize(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	m.size = size
+	return nil
+}
+
+// Sync uploads the entry bundles and tiles that tessera wrote to the log in dir
+// since the last sync, and then every state file that changed.
+func (m *SigLogMirror) Sync(ctx context.Context, dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The state files are read in reverse, so that the checkpoint is never newer
+	// than the tree state, and the tiles and entries the tree state refers to
+	// are already on disk.
+	state := make(map[string][]byte, len(sigLogStateFiles))
+	stateInfo := make(map[string]fs.FileInfo, len(sigLogStateFiles))
+	for _, rel := range slices.Backward(sigLogStateFiles) {
+		info, err := os.Stat(filepath.Join(dir, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		state[rel], stateInfo[rel] = data, info
+	}
+
+	size := m.size
+	if raw, ok := state[sigLogTreeState]; ok {
+		var err error
+		if size, err = parseSigLogSize(raw); err != nil {
+			return err
+		}
+	}
+	for _, rel := range sigLogFiles(m.size, size) {
+		data, err := readSigLogFile(dir, rel)
+		if err != nil {
+			return fmt.Errorf("failed to mirror cosignature log: %w", err)
+		}
+		if err := m.upload(ctx, rel, data, nil); err != nil {
+			return fmt.Errorf("failed to mirror cosignature log: %w", err)
+		}
+	}
+	m.size = max(m.size, size)
+
+	for _, rel := range sigLogStateFiles {
+		if data, ok := state[rel]; ok && m.changed(rel, stateInfo[rel]) {
+			if err := m.upload(ctx, rel, data, stateInfo[rel]); err != nil {
+				return fmt.Errorf("failed to mirror cosignature log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Helper methods
+
+func (m *SigLogMirror) changed(rel string, info fs.FileInfo) bool {
+	synced, ok := m.synced[rel]
+	return !ok || synced.size != info.Size() || !synced.modTime.Equal(info.ModTime())
+}
+
+// Uploads data as the file rel, and records info as its uploaded version, unless it is nil.
+func (m *SigLogMirror) upload(ctx context.Context, rel string, data []byte, info fs.FileInfo) error {
+	obj := &gcs.Object{Name: m.prefix + filepath.ToSlash(rel)}
+	if _, err := m.service.Objects.Insert(m.bucket, obj).Media(bytes.NewReader(data)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", rel, err)
+	}
+	if info != nil {
+		m.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+	}
+	return nil
+}
+
+/// Helper functions
+
+// Returns the entry bundles and tiles, relative to the log directory, that
+// tessera writes as the tree grows from size from to size to.
+func sigLogFiles(from, to uint64) []string {
+	if to <= from {
+		return nil
+	}
+	var files []string
+	for i := from / sigLogTileWidth; i <= (to-1)/sigLogTileWidth; i++ {
+		files = append(files, filepath.FromSlash(layout.EntriesPath(i, to)))
+	}
+	// Tiles at each level hold the hashes of every 256 nodes of the level below.
+	for level := uint64(0); level < 8; level++ {
+		nodesFrom, nodesTo := from>>(8*level), to>>(8*level)
+		if nodesFrom == nodesTo {
+			break
+		}
+		for i := nodesFrom / sigLogTileWidth; i <= (nodesTo-1)/sigLogTileWidth; i++ {
+			files = append(files, filepath.FromSlash(layout.TilePath(level, i, to)))
+		}
+	}
+	return files
+}
+
+// Reads the file rel of the log in dir. Once a tile is full, tessera replaces its
+// partial versions with links to it, so they are cut back to the hashes they hold.
+func readSigLogFile(dir, rel string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, rel))
+	if err != nil {
+		return nil, err
+	}
+	slashed := filepath.ToSlash(rel)
+	if strings.HasPrefix(slashed, "tile/entries/") {
+		return data, nil
+	}
+	if _, width, ok := strings.Cut(slashed, ".p/"); ok {
+		w, err := strconv.ParseUint(width, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed partial tile %s: %w", rel, err)
+		}
+		if n := w * sha256.Size; uint64(len(data)) > n {
+			data = data[:n]
+		}
+	}
+	return data, nil
+}
+
+// Returns the size of the tree tessera stored in dir.
+func readSigLogSize(dir string) (uint64, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, sigLogTreeState))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read tree state: %w", err)
+	}
+	return parseSigLogSize(raw)
+}
+
+func parseSigLogSize(raw []byte) (uint64, error) {
+	var state struct {
+		Size uint64 `json:"size"`
+	}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return 0, fmt.Errorf("malformed tree state: %w", err)
+	}
+	return state.Size, nil
+}
@@ -0,0 +1,197 @@
+// Implements a JSON status endpoint for operators, served on port 8080.
+//
+// The endpoint is public, so the status of the logs, which is read from
+// storage, is cached rather than read again for every request.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+)
+
+type Status struct {
+	Name             string           `json:"name"`
+	VKey             string           `json:"vkey"`
+	KmsKey           string           `json:"kms_key,omitempty"`
+	Region           string           `json:"region"`
+	DevMode          bool             `json:"dev_mode"`
+	Build            BuildStatus      `json:"build"`
+	Started          time.Time        `json:"started"`
+	UptimeSeconds    int64            `json:"uptime_seconds"`
+	Deadline         time.Time        `json:"deadline"`
+	RemainingSeconds int64            `json:"remaining_seconds"`
+	Clock            ClockStatus      `json:"clock"`
+	TrustedTime      *TimeCheckStatus `json:"trusted_time,omitempty"`
+	Logs             []LogStatus      `json:"logs"`
+}
+
+type BuildStatus struct {
+	GoVersion string `json:"go_version"`
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Time      string `json:"time"`
+	Modified  bool   `json:"modified"`
+}
+
+// Latest checkpoint cosigned for a log. Logs without state have no size.
+type LogStatus struct {
+	ID         string     `json:"id"`
+	Origin     string     `json:"origin"`
+	Size       *uint64    `json:"size,omitempty"`
+	Hash       []byte     `json:"hash,omitempty"`
+	CosignedAt *time.Time `json:"cosigned_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// How long the status of the logs is served from the cache.
+const statusLogsTTL = 10 * time.Second
+
+type StatusHandler struct {
+	meta     Meta
+	signer   *NoteKms
+	p        omniwitness.LogStatePersistence
+	logs     map[string]witnessedLog
+	started  time.Time
+	deadline time.Time
+
+	// mu guards the cached status of the logs, and is held while it is
+	// read again, so that concurrent requests share a single read.
+	mu        sync.Mutex
+	logsAt    time.Time
+	logsCache []LogStatus
+}
+
+func NewStatusHandler(meta Meta, signer *NoteKms, p omniwitness.LogStatePersistence, logs map[string]witnessedLog, started, deadline time.Time) *StatusHandler {
+	return &StatusHandler{
+		meta:     meta,
+		signer:   signer,
+		p:        p,
+		logs:     logs,
+		started:  started,
+		deadline: deadline,
+	}
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	s := Status{
+		Name:             h.meta.name,
+		VKey:             h.signer.PublicKey(),
+		Region:           h.meta.region,
+		DevMode:          h.meta.devMode,
+		Build:            getBuildStatus(),
+		Started:          h.started.UTC(),
+		UptimeSeconds:    int64(now.Sub(h.started).Seconds()),
+		Deadline:         h.deadline.UTC(),
+		RemainingSeconds: int64(h.deadline.Sub(now).Seconds()),
+		Clock:            h.signer.clock.Status(),
+		Logs:             h.cachedLogs(now),
+	}
+	if trusted := h.signer.clock.trusted; trusted != nil {
+		ts := trusted.Status()
+		s.TrustedTime = &ts
+	}
+	// In dev mode, the key is a local file path rather than a KMS key version.
+	if !h.meta.devMode {
+		s.KmsKey = h.meta.key
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		log.Println("Failed to write status:", err)
+	}
+}
+
+// Helper methods
+
+// Returns the status of every log, read again if the cache is older than statusLogsTTL.
+func (h *StatusHandler) cachedLogs(now time.Time) []LogStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.logsCache != nil && now.Sub(h.logsAt) < statusLogsTTL {
+		return h.logsCache
+	}
+	logs := make([]LogStatus, 0, len(h.logs))
+	for _, l := range h.logs {
+		logs = append(logs, h.logStatus(l))
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Origin < logs[j].Origin })
+	h.logsAt, h.logsCache = now, logs
+	return logs
+}
+
+func (h *StatusHandler) logStatus(l witnessedLog) LogStatus {
+	ls := LogStatus{ID: l.id, Origin: l.origin}
+
+	cp, n, err := l.latest(h.p, h.signer)
+	if err != nil {
+		ls.Error = err.Error()
+		return ls
+	} else if cp == nil {
+		return ls
+	}
+	ls.Size = &cp.Size
+	ls.Hash = cp.Hash
+
+	t, err := cosignedAt(n, h.signer)
+	if err != nil {
+		ls.Error = err.Error()
+		return ls
+	}
+	ls.CosignedAt = &t
+	return ls
+}
+
+/// Helper functions
+
+var errNotCosigned = errors.New("checkpoint is not cosigned by this witness")
+
+// Returns the timestamp of the cosignature on n by v
+func cosignedAt(n *note.Note, v note.Verifier) (time.Time, error) {
+	for _, sig := range n.Sigs {
+		if sig.Name == v.Name() && sig.Hash == v.KeyHash() {
+			t, err := f_note.CoSigV1Timestamp(sig)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errNotCosigned
+}
+
+func getBuildStatus() BuildStatus {
+	var b BuildStatus
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.GoVersion = info.GoVersion
+	b.Path = info.Main.Path
+	b.Version = info.Main.Version
+	for _, i := range info.Settings {
+		switch i.Key {
+		case "vcs.revision":
+			b.Revision = i.Value
+		case "vcs.time":
+			b.Time = i.Value
+		case "vcs.modified":
+			b.Modified = i.Value == "true"
+		}
+	}
+	return b
+}
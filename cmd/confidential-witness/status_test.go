@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/witness/omniwitness"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// A persistence that counts how often the state of a log is read.
+type countingPersistence struct {
+	omniwitness.LogStatePersistence
+	reads atomic.Int64
+}
+
+func (p *countingPersistence) ReadOps(logID string) (omniwitness.LogStateReadOps, error) {
+	p.reads.Add(1)
+	return p.LogStatePersistence.ReadOps(logID)
+}
+
+func TestStatusHandler(t *testing.T) {
+	n := newTestNoteKms(t)
+	l := newTestLog(t, 8)
+	other := newTestLog(t, 8)
+	other.id, other.origin = "other", "example.com/other"
+	p := &countingPersistence{LogStatePersistence: NewPersistence()}
+	cp, err := note.Open(l.checkpoint(t, 5), note.VerifierList(l.verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seedLog(p, n, l.id, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now().Add(-time.Hour)
+	h := NewStatusHandler(Meta{name: "witness", region: "region", devMode: true, key: "/dev/key"}, n, p,
+		map[string]witnessedLog{l.id: l.witnessedLog, other.id: other.witnessedLog}, started, started.Add(22*time.Hour))
+	get := func(t *testing.T) Status {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ServeHTTP() = %d %q", rec.Code, rec.Body)
+		}
+		var s Status
+		if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := get(t)
+	if s.Name != "witness" || s.VKey != n.PublicKey() || !s.DevMode {
+		t.Errorf("status = %+v", s)
+	}
+	// In dev mode, the key is a local path and not shown.
+	if s.KmsKey != "" {
+		t.Errorf("status shows key %q in dev mode", s.KmsKey)
+	}
+	if s.UptimeSeconds < 3600 || s.RemainingSeconds <= 0 {
+		t.Errorf("uptime %d, remaining %d", s.UptimeSeconds, s.RemainingSeconds)
+	}
+	if len(s.Logs) != 2 {
+		t.Fatalf("status has %d logs, want 2", len(s.Logs))
+	}
+	// Logs are sorted by origin, and only those with state have a size.
+	if got := s.Logs[0]; got.ID != l.id || got.Size == nil || *got.Size != 5 || got.CosignedAt == nil || got.Error != "" {
+		t.Errorf("status of log = %+v, want size 5 cosigned", got)
+	}
+	if got := s.Logs[1]; got.ID != "other" || got.Size != nil || got.Error != "" {
+		t.Errorf("status of log without state = %+v", got)
+	}
+
+	// Further requests are served from the cache, until it expires.
+	reads := p.reads.Load()
+	get(t)
+	if got := p.reads.Load(); got != reads {
+		t.Errorf("cached status read state %d times", got-reads)
+	}
+	h.logsAt = h.logsAt.Add(-statusLogsTTL)
+	get(t)
+	if got := p.reads.Load(); got != reads+2 {
+		t.Errorf("expired status read state %d times, want 2", got-reads)
+	}
+}
@@ -0,0 +1,214 @@
+// Implements verification of the local clock against Roughtime servers, so
+// that whoever controls the host clock cannot pick cosignature timestamps.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/internal/roughtime"
+)
+
+const roughtimeQueryTimeout = 5 * time.Second
+
+// A Roughtime server and its long-term public key
+type RoughtimeServer struct {
+	Addr      string
+	PublicKey ed25519.PublicKey
+}
+
+// Parses a server in the form base64key@host:port
+func ParseRoughtimeServer(s string) (RoughtimeServer, error) {
+	key, addr, ok := strings.Cut(s, "@")
+	if !ok {
+		return RoughtimeServer{}, fmt.Errorf("roughtime server %q is not in the form key@host:port", s)
+	}
+	pubkey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pubkey) != ed25519.PublicKeySize {
+		return RoughtimeServer{}, fmt.Errorf("invalid roughtime server key %q", key)
+	}
+	return RoughtimeServer{Addr: addr, PublicKey: pubkey}, nil
+}
+
+type TimeCheckConfig struct {
+	Servers []RoughtimeServer
+	// Maximum deviation of the local clock before signing is blocked.
+	Threshold time.Duration
+	// How often the servers are queried.
+	Interval time.Duration
+}
+
+type TimeCheckStatus struct {
+	Verified           *time.Time `json:"verified,omitempty"`
+	OffsetSeconds      float64    `json:"offset_seconds"`
+	UncertaintySeconds float64    `json:"uncertainty_seconds"`
+	Error              string     `json:"error,omitempty"`
+}
+
+type TimeCheck struct {
+	cfg TimeCheckConfig
+
+	mu sync.RWMutex
+	// Local time of the last successful verification, with its monotonic reading.
+	verified time.Time
+	// How far the local clock was ahead of the servers at verified, give or
+	// take the uncertainty of the server response.
+	offset      time.Duration
+	uncertainty time.Duration
+	lastErr     error
+}
+
+func NewTimeCheck(cfg TimeCheckConfig) (*TimeCheck, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no roughtime servers")
+	}
+	if cfg.Threshold <= 0 || cfg.Interval <= 0 {
+		return nil, errors.New("threshold and interval must be positive")
+	}
+	return &TimeCheck{cfg: cfg}, nil
+}
+
+// Run verifies the clock every interval until ctx is done.
+func (t *TimeCheck) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-time.After(t.cfg.Interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := t.CheckOnce(ctx); err != nil {
+			log.Println("Time verification failed:", err)
+		}
+	}
+}
+
+// CheckOnce queries every server, and takes the response with the median
+// offset as the offset of the local clock. A minority of servers that report
+// the wrong time cannot move the median beyond the honest ones. The offset is
+// uncertain by the radius of the response and half its round trip, and the
+// clock is only verified if it is within the threshold despite that.
+func (t *TimeCheck) CheckOnce(ctx context.Context) error {
+	results := t.query(ctx)
+	if len(results) == 0 {
+		err := errors.New("no roughtime server returned a valid response")
+		t.fail(err)
+		return err
+	}
+	slices.SortFunc(results, func(a, b *roughtime.Result) int {
+		return cmp.Compare(a.Offset(), b.Offset())
+	})
+	median := results[len(results)/2]
+	offset, uncertainty := median.Offset(), median.Radius+median.RTT/2
+	roughtimeOffset.Set(offset.Seconds())
+
+	if offset.Abs()+uncertainty > t.cfg.Threshold {
+		err := fmt.Errorf("local clock is off by %s ± %s", offset, uncertainty)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// Signing is blocked until the clock is verified again.
+		t.verified = time.Time{}
+		t.lastErr = err
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.verified = time.Now()
+	t.offset = offset
+	t.uncertainty = uncertainty
+	t.lastErr = nil
+	return nil
+}
+
+// Check returns an error unless the clock was recently verified, and has not
+// been moved beyond the threshold since. Servers may be unreachable for a few
+// intervals before signing is blocked.
+func (t *TimeCheck) Check(now time.Time) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.verified.IsZero() {
+		return withCause(errors.New("time has not been verified"), t.lastErr)
+	}
+	// With monotonic readings, elapsed is unaffected by changes to the clock.
+	elapsed := now.Sub(t.verified)
+	if maxAge := 3 * t.cfg.Interval; elapsed > maxAge {
+		return withCause(fmt.Errorf("time was last verified %s ago", elapsed.Truncate(time.Second)), t.lastErr)
+	}
+	jump := now.Round(0).Sub(t.verified.Round(0)) - elapsed
+	if deviation := t.offset + jump; deviation.Abs()+t.uncertainty > t.cfg.Threshold {
+		return fmt.Errorf("local clock is off by %s ± %s", deviation, t.uncertainty)
+	}
+	return nil
+}
+
+func (t *TimeCheck) Status() TimeCheckStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := TimeCheckStatus{OffsetSeconds: t.offset.Seconds(), UncertaintySeconds: t.uncertainty.Seconds()}
+	if !t.verified.IsZero() {
+		v := t.verified.UTC()
+		s.Verified = &v
+	}
+	if t.lastErr != nil {
+		s.Error = t.lastErr.Error()
+	}
+	return s
+}
+
+// Helper methods
+
+// Returns the responses of the servers that returned a valid one.
+func (t *TimeCheck) query(ctx context.Context) []*roughtime.Result {
+	ctx, cancel := context.WithTimeout(ctx, roughtimeQueryTimeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []*roughtime.Result
+	)
+	for _, s := range t.cfg.Servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := roughtime.Query(ctx, s.Addr, s.PublicKey)
+			if err != nil {
+				log.Printf("Roughtime query to %s failed: %v", s.Addr, err)
+				roughtimeErrors.WithLabelValues(s.Addr).Inc()
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, res)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (t *TimeCheck) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastErr = err
+}
+
+/// Helper functions
+
+// Appends cause to err, if there is one.
+func withCause(err, cause error) error {
+	if cause == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", err, cause)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/internal/roughtime"
+)
+
+// Starts a Roughtime server for every offset, each claiming radius.
+func newTestTimeCheck(t *testing.T, radius time.Duration, offsets ...time.Duration) *TimeCheck {
+	t.Helper()
+	cfg := TimeCheckConfig{Threshold: 10 * time.Second, Interval: time.Minute}
+	for _, offset := range offsets {
+		s, err := roughtime.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		s.SetOffset(offset)
+		s.SetRadius(radius)
+		cfg.Servers = append(cfg.Servers, RoughtimeServer{Addr: s.Addr(), PublicKey: s.PublicKey()})
+	}
+	tc, err := NewTimeCheck(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestTimeCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		radius  time.Duration
+		offsets []time.Duration
+		want    string
+	}{
+		{"agree", time.Second, []time.Duration{0}, ""},
+		{"minority skewed", time.Second, []time.Duration{0, time.Second, time.Hour}, ""},
+		{"majority skewed", time.Second, []time.Duration{0, time.Hour, 2 * time.Hour}, "off by"},
+		{"beyond threshold", time.Second, []time.Duration{-20 * time.Second}, "off by"},
+		{"within radius of threshold", 5 * time.Second, []time.Duration{-7 * time.Second}, "off by"},
+		{"radius exceeds threshold", 11 * time.Second, []time.Duration{0}, "off by"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			check := newTestTimeCheck(t, tc.radius, tc.offsets...)
+			err := check.CheckOnce(context.Background())
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("CheckOnce() = %v", err)
+				}
+				if err := check.Check(time.Now()); err != nil {
+					t.Errorf("Check() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("CheckOnce() = %v, want %q", err, tc.want)
+			}
+			if err := check.Check(time.Now()); err == nil {
+				t.Error("Check() succeeded without verified time")
+			}
+		})
+	}
+}
+
+func TestTimeCheckUnreachable(t *testing.T) {
+	check := newTestTimeCheck(t, time.Second, 0)
+	if err := check.CheckOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Servers that go away do not block signing for a few intervals.
+	check.cfg.Servers[0].Addr = "127.0.0.1:1"
+	if err := check.CheckOnce(context.Background()); err == nil {
+		t.Fatal("CheckOnce() with unreachable servers succeeded")
+	}
+	if err := check.Check(time.Now()); err != nil {
+		t.Errorf("Check() right after a failed query = %v", err)
+	}
+	if err := check.Check(time.Now().Add(3*time.Minute + time.Second)); err == nil || !strings.Contains(err.Error(), "last verified") {
+		t.Errorf("Check() after three intervals = %v", err)
+	}
+}
+
+func TestTimeCheckWrongKey(t *testing.T) {
+	check := newTestTimeCheck(t, time.Second, 0)
+	other := newTestTimeCheck(t, time.Second, 0)
+	check.cfg.Servers[0].PublicKey = other.cfg.Servers[0].PublicKey
+	if err := check.CheckOnce(context.Background()); err == nil {
+		t.Error("CheckOnce() with a server signing under another key succeeded")
+	}
+}
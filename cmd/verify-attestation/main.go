@@ -0,0 +1,122 @@
+// Verifies a Confidential Space attestation token and checks its claims
+// against a policy, printing a report and exiting non-zero if any check fails.
+//
+// Usage: verify-attestation -policy policy.json [-jwks file|url] [-vkey vkey] (-token file | -witness url)
+//
+// With -witness, a fresh token is requested from the /attestation endpoint of
+// a witness with a random nonce, which the token must then carry. With -vkey,
+// the token must also be bound to that witness verifier key.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/attestation"
+)
+
+func main() {
+	policyPath := flag.String("policy", "", "path to the JSON policy to check the token against")
+	jwksSource := flag.String("jwks", attestation.JWKSURL, "path or URL of the JWKS to verify the token with")
+	tokenPath := flag.String("token", "", "path to the token, or - for stdin")
+	witness := flag.String("witness", "", "base URL of port 8080 of a witness to request a fresh token from")
+	vkey := flag.String("vkey", "", "witness verifier key the token must be bound to")
+	flag.Parse()
+	if *policyPath == "" || (*tokenPath == "") == (*witness == "") {
+		log.Fatalln("Usage: verify-attestation -policy policy.json [-jwks file|url] [-vkey vkey] (-token file | -witness url)")
+	}
+
+	data, err := os.ReadFile(*policyPath)
+	if err != nil {
+		log.Fatalln("Failed to read policy:", err)
+	}
+	var policy attestation.Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		log.Fatalln("Failed to parse policy:", err)
+	}
+	jwks, err := read(*jwksSource)
+	if err != nil {
+		log.Fatalln("Failed to read JWKS:", err)
+	}
+	keys, err := attestation.ParseJWKS(jwks)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var token []byte
+	if *witness != "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			log.Fatalln("Failed to generate nonce:", err)
+		}
+		policy.Nonces = append(policy.Nonces, hex.EncodeToString(nonce))
+		token, err = read(strings.TrimSuffix(*witness, "/") + "/attestation?nonce=" + url.QueryEscape(hex.EncodeToString(nonce)))
+	} else {
+		token, err = read(*tokenPath)
+	}
+	if err != nil {
+		log.Fatalln("Failed to read token:", err)
+	}
+
+	report, err := check(string(token), keys, policy, *vkey, time.Now())
+	if err != nil {
+		fmt.Println("FAIL  token verification failed:", err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+	if !report.Passed() {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+// Verifies token with keys and evaluates its claims against policy. Unless vkey
+// is empty, the token must also be bound to that witness verifier key.
+func check(token string, keys attestation.KeySet, policy attestation.Policy, vkey string, now time.Time) (attestation.Report, error) {
+	if vkey != "" {
+		policy.Nonces = append(slices.Clip(policy.Nonces), attestation.VKeyNonce(vkey))
+	}
+	claims, err := attestation.Verify(strings.TrimSpace(token), keys, now)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Evaluate(claims), nil
+}
+
+// Reads a file, stdin for -, or the body of an http or https URL.
+func read(source string) ([]byte, error) {
+	if source == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status response (%s): %q", resp.Status, body)
+	}
+	return body, nil
+}
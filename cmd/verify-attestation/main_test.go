@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aditsachde/confidential-witness/attestation"
+)
+
+const testVKey = "example.com/witness+12345678+AQ=="
+
+// Returns a token signed with key, carrying nonces.
+func signToken(t *testing.T, key *rsa.PrivateKey, now time.Time, nonces ...string) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key", "typ": "JWT"})
+	payload, err := json.Marshal(map[string]any{
+		"iss":       attestation.Issuer,
+		"aud":       "confidential-witness",
+		"nbf":       now.Add(-time.Minute).Unix(),
+		"exp":       now.Add(time.Hour).Unix(),
+		"eat_nonce": nonces,
+		"submods": map[string]any{
+			"container": map[string]any{"image_digest": "sha256:aaaa"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestCheckVKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := attestation.KeySet{"key": &key.PublicKey}
+	now := time.Now()
+	policy := attestation.Policy{Audience: "confidential-witness", ImageDigest: "sha256:aaaa", Nonces: []string{"0123456789"}}
+
+	for _, tc := range []struct {
+		name   string
+		nonces []string
+		vkey   string
+		pass   bool
+	}{
+		{"bound to the pinned key", []string{"0123456789", attestation.VKeyNonce(testVKey)}, testVKey, true},
+		{"not pinned", []string{"0123456789"}, "", true},
+		{"bound to another key", []string{"0123456789", attestation.VKeyNonce("example.com/other+87654321+AQ==")}, testVKey, false},
+		{"pinned but not bound", []string{"0123456789"}, testVKey, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := check(signToken(t, key, now, tc.nonces...), keys, policy, tc.vkey, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Passed() != tc.pass {
+				t.Errorf("check() passed %v, want %v:\n%s", r.Passed(), tc.pass, r)
+			}
+		})
+	}
+	// The pin is not added to the policy of the caller.
+	if len(policy.Nonces) != 1 {
+		t.Errorf("check() changed the policy nonces to %v", policy.Nonces)
+	}
+}
@@ -0,0 +1,43 @@
+// Verifies an equivocation evidence bundle published by a witness.
+//
+// Usage: verify-equivocation [-log-key vkey] bundle.json
+//
+// The bundle carries the key of the log, so -log-key should be set to a key
+// obtained independently, or the bundle only proves a conflict under its own key.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aditsachde/confidential-witness/equivocation"
+)
+
+func main() {
+	logKey := flag.String("log-key", "", "expected note verifier key of the log")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalln("Usage: verify-equivocation [-log-key vkey] bundle.json")
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalln("Failed to read bundle:", err)
+	}
+	var b equivocation.Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		log.Fatalln("Failed to parse bundle:", err)
+	}
+
+	if *logKey != "" && b.LogKey != *logKey {
+		log.Fatalf("Bundle is for log key %s, not %s", b.LogKey, *logKey)
+	}
+	if err := b.Verify(); err != nil {
+		log.Fatalln("Invalid evidence:", err)
+	}
+	fmt.Printf("Valid evidence of %s by %s, as seen by %s\n", b.Kind, b.Origin, b.Witness)
+}
@@ -0,0 +1,138 @@
+// Package equivocation defines evidence that a log presented conflicting
+// checkpoints to a witness, in a form that anyone can verify with only the
+// public key of the log.
+package equivocation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	f_note "github.com/transparency-dev/formats/note"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"golang.org/x/mod/sumdb/note"
+)
+
+type Kind string
+
+const (
+	// Two checkpoints of the same size with different root hashes. No log
+	// can ever produce both, so this proves a split view on its own.
+	Fork Kind = "fork"
+	// A larger checkpoint whose consistency proof does not verify against
+	// the smaller one. This proves that the proof is invalid, and becomes a
+	// proven split view once the log cannot produce a valid one either.
+	InvalidProof Kind = "invalid_proof"
+)
+
+// Bundle is evidence of conflicting checkpoints, signed by the log.
+type Bundle struct {
+	Kind Kind `json:"kind"`
+	// The log, as its origin and note verifier key.
+	Origin string `json:"origin"`
+	LogKey string `json:"log_key"`
+	// The note verifier key of the witness that cosigned Stored.
+	Witness string `json:"witness"`
+	// The checkpoint the witness had stored, cosigned by it.
+	Stored string `json:"stored"`
+	// The checkpoint that conflicts with Stored.
+	Conflicting string `json:"conflicting"`
+	// The consistency proof submitted with Conflicting, if any.
+	Proof [][]byte `json:"proof,omitempty"`
+	// Where Conflicting came from, and when the conflict was detected.
+	Source   string    `json:"source"`
+	Detected time.Time `json:"detected"`
+}
+
+// ID returns a name for the bundle that only depends on the checkpoints,
+// so that the same conflict detected twice has the same ID.
+func (b *Bundle) ID() string {
+	h := sha256.New()
+	for _, s := range []string{b.Origin, b.Stored, b.Conflicting} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Classify returns the kind of conflict between the checkpoints in b,
+// after verifying that both are signed by the log and that Stored is
+// cosigned by the witness. It returns an error if b is not evidence of
+// any conflict, regardless of b.Kind.
+func (b *Bundle) Classify() (Kind, error) {
+	logV, err := f_note.NewVerifier(b.LogKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid log key: %w", err)
+	}
+	witnessV, err := f_note.NewVerifierForCosignatureV1(b.Witness)
+	if err != nil {
+		return "", fmt.Errorf("invalid witness key: %w", err)
+	}
+
+	stored, storedNote, err := parse(b.Stored, b.Origin, logV, witnessV)
+	if err != nil {
+		return "", fmt.Errorf("invalid stored checkpoint: %w", err)
+	}
+	if !hasSig(storedNote, witnessV) {
+		return "", errors.New("stored checkpoint is not cosigned by the witness")
+	}
+	conflicting, _, err := parse(b.Conflicting, b.Origin, logV)
+	if err != nil {
+		return "", fmt.Errorf("invalid conflicting checkpoint: %w", err)
+	}
+
+	if stored.Size == conflicting.Size {
+		if bytes.Equal(stored.Hash, conflicting.Hash) {
+			return "", errors.New("checkpoints have the same size and root hash")
+		}
+		return Fork, nil
+	}
+	smaller, larger := stored, conflicting
+	if smaller.Size > larger.Size {
+		smaller, larger = larger, smaller
+	}
+	if smaller.Size == 0 {
+		return "", errors.New("every checkpoint is consistent with an empty one")
+	}
+	if err := proof.VerifyConsistency(rfc6962.DefaultHasher, smaller.Size, larger.Size, b.Proof, smaller.Hash, larger.Hash); err == nil {
+		return "", errors.New("checkpoints are consistent")
+	}
+	return InvalidProof, nil
+}
+
+// Verify checks that b is evidence of a conflict of kind b.Kind.
+func (b *Bundle) Verify() error {
+	kind, err := b.Classify()
+	if err != nil {
+		return err
+	}
+	if kind != b.Kind {
+		return fmt.Errorf("bundle claims a conflict of kind %q, but is evidence of %q", b.Kind, kind)
+	}
+	return nil
+}
+
+/// Helper functions
+
+func parse(raw, origin string, logV note.Verifier, others ...note.Verifier) (*log.Checkpoint, *note.Note, error) {
+	cp, _, n, err := log.ParseCheckpoint([]byte(raw), origin, logV, others...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cp, n, nil
+}
+
+// Reports whether n carries a verified signature from v.
+func hasSig(n *note.Note, v note.Verifier) bool {
+	for _, s := range n.Sigs {
+		if s.Name == v.Name() && s.Hash == v.KeyHash() {
+			return true
+		}
+	}
+	return false
+}
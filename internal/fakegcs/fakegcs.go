@@ -0,0 +1,216 @@
+// Package fakegcs provides a local GCS JSON API server for tests. It
+// implements the bucket get, object get, download, list and multipart upload
+// calls used by the witness, including generation preconditions on uploads.
+package fakegcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/option"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+type object struct {
+	data       []byte
+	generation int64
+}
+
+type Server struct {
+	mu         sync.Mutex
+	buckets    map[string]map[string]object
+	generation int64
+
+	srv *httptest.Server
+}
+
+// New starts a fake GCS server with the given empty buckets.
+// Close must be called to stop it.
+func New(buckets ...string) *Server {
+	s := &Server{buckets: make(map[string]map[string]object)}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]object)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Service returns a GCS client connected to the server.
+func (s *Server) Service(ctx context.Context) (*gcs.Service, error) {
+	return gcs.NewService(ctx,
+		option.WithEndpoint(s.srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication(),
+		option.WithHTTPClient(s.srv.Client()),
+	)
+}
+
+// Put replaces an object, as if written by another client, and returns its generation.
+func (s *Server) Put(bucket, name string, data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.buckets[bucket][name] = object{data: data, generation: s.generation}
+	return s.generation
+}
+
+// Get returns the contents of an object, or false if it does not exist.
+func (s *Server) Get(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	return o.data, ok
+}
+
+// Delete removes an object, as if deleted by another client.
+func (s *Server) Delete(bucket, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], name)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Helper methods
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	upload := strings.HasPrefix(path, "/upload/storage/v1/b/")
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "/upload"), "/storage/v1/b/")
+	bucketName, rest, _ := strings.Cut(path, "/")
+	bucketName, _ = url.PathUnescape(bucketName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "bucket not found")
+		return
+	}
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		writeJSON(w, &gcs.Bucket{Name: bucketName})
+	case rest == "o" && r.Method == http.MethodGet:
+		s.list(w, r, bucketName, bucket)
+	case rest == "o" && upload && r.Method == http.MethodPost:
+		s.upload(w, r, bucketName, bucket)
+	case strings.HasPrefix(rest, "o/") && r.Method == http.MethodGet:
+		name, err := url.PathUnescape(strings.TrimPrefix(rest, "o/"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid object name")
+			return
+		}
+		s.get(w, r, bucketName, name, bucket)
+	default:
+		writeError(w, http.StatusNotImplemented, "not implemented")
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucketName string, bucket map[string]object) {
+	prefix := r.URL.Query().Get("prefix")
+	var names []string
+	for name := range bucket {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := &gcs.Objects{Items: []*gcs.Object{}}
+	for _, name := range names {
+		res.Items = append(res.Items, describe(bucketName, name, bucket[name]))
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucketName, name string, bucket map[string]object) {
+	o, ok := bucket[name]
+	if g := r.URL.Query().Get("generation"); ok && g != "" && g != strconv.FormatInt(o.generation, 10) {
+		ok = false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "object not found")
+		return
+	}
+	if r.URL.Query().Get("alt") == "media" {
+		w.Write(o.data)
+		return
+	}
+	writeJSON(w, describe(bucketName, name, o))
+}
+
+// Handles a multipart upload of the object metadata and its contents.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, bucketName string, bucket map[string]object) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		writeError(w, http.StatusBadRequest, "only multipart uploads are supported")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta gcs.Object
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	var data []byte
+	if err == nil {
+		if part, err = mr.NextPart(); err == nil {
+			data, err = io.ReadAll(part)
+		}
+	}
+	if err != nil || meta.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid upload")
+		return
+	}
+
+	if g := r.URL.Query().Get("ifGenerationMatch"); g != "" {
+		want, err := strconv.ParseInt(g, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ifGenerationMatch")
+			return
+		}
+		if bucket[meta.Name].generation != want {
+			writeError(w, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+	}
+	s.generation++
+	o := object{data: data, generation: s.generation}
+	bucket[meta.Name] = o
+	writeJSON(w, describe(bucketName, meta.Name, o))
+}
+
+/// Helper functions
+
+func describe(bucket, name string, o object) *gcs.Object {
+	return &gcs.Object{
+		Bucket:     bucket,
+		Name:       name,
+		Generation: o.generation,
+		Size:       uint64(len(o.data)),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, message)
+}
@@ -0,0 +1,245 @@
+// Package fakekms provides an in-process Cloud KMS gRPC server for tests.
+// It implements GetPublicKey and AsymmetricSign for EC_SIGN_ED25519 keys,
+// and can inject faults into its responses to exercise client error handling.
+package fakekms
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Faults describes the misbehaviour the server injects into its responses.
+// The zero value is a well behaved server.
+type Faults struct {
+	// Latency is added before every response.
+	Latency time.Duration
+	// Err, if set, is returned instead of a response.
+	Err error
+
+	// UnverifiedDataCRC makes AsymmetricSign report that the request CRC32C was not verified.
+	UnverifiedDataCRC bool
+	// CorruptSignatureCRC makes AsymmetricSign return the wrong CRC32C for the signature.
+	CorruptSignatureCRC bool
+	// CorruptSignature flips a bit in the signature before the CRC32C is computed,
+	// so that only verifying the signature catches it.
+	CorruptSignature bool
+	// CorruptPemCRC makes GetPublicKey return the wrong CRC32C for the PEM.
+	CorruptPemCRC bool
+	// InvalidPem makes GetPublicKey return a PEM that cannot be decoded.
+	InvalidPem bool
+	// WrongName makes responses carry a different key version name than was requested.
+	WrongName bool
+	// WrongAlgorithm makes GetPublicKey return an EC_SIGN_P256_SHA256 key.
+	WrongAlgorithm bool
+}
+
+type Server struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+
+	mu     sync.Mutex
+	keys   map[string]ed25519.PrivateKey
+	faults Faults
+	signs  int
+
+	lis  net.Listener
+	grpc *grpc.Server
+}
+
+// New starts a fake KMS server listening on a random localhost port.
+// Close must be called to stop it.
+func New() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		keys: make(map[string]ed25519.PrivateKey),
+		lis:  lis,
+		grpc: grpc.NewServer(),
+	}
+	kmspb.RegisterKeyManagementServiceServer(s.grpc, s)
+	go s.grpc.Serve(lis)
+
+	return s, nil
+}
+
+// AddKey generates a new Ed25519 key for the key version name, replacing any
+// existing key with that name, and returns its public key.
+func (s *Server) AddKey(name string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[name] = priv
+	return pub, nil
+}
+
+// SetFaults replaces the faults injected into subsequent responses.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// SignCount returns the number of successful AsymmetricSign calls served.
+func (s *Server) SignCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signs
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.lis.Addr().String()
+}
+
+// Client returns a KMS client connected to the server.
+func (s *Server) Client(ctx context.Context) (*kms.KeyManagementClient, error) {
+	return kms.NewKeyManagementClient(ctx,
+		option.WithEndpoint(s.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpc.Stop()
+}
+
+func (s *Server) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest) (*kmspb.PublicKey, error) {
+	key, f, err := s.lookup(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub any = key.Public()
+	algorithm := kmspb.CryptoKeyVersion_EC_SIGN_ED25519
+	if f.WrongAlgorithm {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to generate key: %v", err)
+		}
+		pub = ecKey.Public()
+		algorithm = kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal public key: %v", err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if f.InvalidPem {
+		pemKey = "not a pem"
+	}
+
+	pemCrc := crc32c([]byte(pemKey))
+	if f.CorruptPemCRC {
+		pemCrc++
+	}
+
+	return &kmspb.PublicKey{
+		Pem:             pemKey,
+		Algorithm:       algorithm,
+		PemCrc32C:       wrapperspb.Int64(int64(pemCrc)),
+		Name:            responseName(req.Name, f),
+		ProtectionLevel: kmspb.ProtectionLevel_SOFTWARE,
+	}, nil
+}
+
+func (s *Server) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest) (*kmspb.AsymmetricSignResponse, error) {
+	key, f, err := s.lookup(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Digest != nil {
+		return nil, status.Error(codes.InvalidArgument, "EC_SIGN_ED25519 keys sign data, not a digest")
+	}
+	if req.DataCrc32C != nil && req.DataCrc32C.Value != int64(crc32c(req.Data)) {
+		return nil, status.Error(codes.InvalidArgument, "data_crc32c does not match data")
+	}
+
+	sig := ed25519.Sign(key, req.Data)
+	if f.CorruptSignature {
+		sig[0] ^= 1
+	}
+	sigCrc := crc32c(sig)
+	if f.CorruptSignatureCRC {
+		sigCrc++
+	}
+
+	s.mu.Lock()
+	s.signs++
+	s.mu.Unlock()
+
+	return &kmspb.AsymmetricSignResponse{
+		Signature:          sig,
+		SignatureCrc32C:    wrapperspb.Int64(int64(sigCrc)),
+		VerifiedDataCrc32C: req.DataCrc32C != nil && !f.UnverifiedDataCRC,
+		Name:               responseName(req.Name, f),
+		ProtectionLevel:    kmspb.ProtectionLevel_SOFTWARE,
+	}, nil
+}
+
+// Helper methods
+
+// Returns the key for name and the current faults, after applying any injected latency or error.
+func (s *Server) lookup(ctx context.Context, name string) (ed25519.PrivateKey, Faults, error) {
+	s.mu.Lock()
+	key, ok := s.keys[name]
+	f := s.faults
+	s.mu.Unlock()
+
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-ctx.Done():
+			return nil, f, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if f.Err != nil {
+		return nil, f, f.Err
+	}
+	if !ok {
+		return nil, f, status.Errorf(codes.NotFound, "key version %q not found", name)
+	}
+	return key, f, nil
+}
+
+/// Helper functions
+
+func responseName(name string, f Faults) string {
+	if f.WrongName {
+		return name + "-wrong"
+	}
+	return name
+}
+
+// Calculate the CRC32C checksum of the data.
+func crc32c(data []byte) uint32 {
+	t := crc32.MakeTable(crc32.Castagnoli)
+	return crc32.Checksum(data, t)
+}
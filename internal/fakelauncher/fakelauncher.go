@@ -0,0 +1,185 @@
+// Package fakelauncher provides an in-process stand-in for the token endpoint
+// that the Confidential Space launcher serves on a unix socket. Tokens are
+// signed with a locally generated key, which is published as a JWKS.
+package fakelauncher
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Issuer of the tokens, the same as for real Confidential Space tokens.
+const Issuer = "https://confidentialcomputing.googleapis.com"
+
+// TokenRequest is the body of a request for a custom token.
+type TokenRequest struct {
+	Audience  string   `json:"audience"`
+	TokenType string   `json:"token_type"`
+	Nonces    []string `json:"nonces"`
+}
+
+type Server struct {
+	key *rsa.PrivateKey
+	kid string
+
+	mu       sync.Mutex
+	claims   map[string]any
+	requests []TokenRequest
+
+	socket string
+	lis    net.Listener
+	srv    *http.Server
+}
+
+// New starts a fake launcher listening on a unix socket in dir, with a fresh
+// signing key. Close must be called to stop it.
+func New(dir string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	socket := filepath.Join(dir, "teeserver.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		key:    key,
+		kid:    "fake",
+		claims: map[string]any{},
+		socket: socket,
+		lis:    lis,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/token", s.token)
+	s.srv = &http.Server{Handler: mux}
+	go s.srv.Serve(lis)
+	return s, nil
+}
+
+// SetClaims replaces the claims added to every token, such as submods.
+// The issuer, audience, nonces and validity are always set by the server.
+func (s *Server) SetClaims(claims map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.claims = claims
+}
+
+// Requests returns the token requests received so far.
+func (s *Server) Requests() []TokenRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TokenRequest(nil), s.requests...)
+}
+
+// Socket returns the path of the unix socket the server is listening on.
+func (s *Server) Socket() string {
+	return s.socket
+}
+
+// JWKS returns the JSON Web Key Set with the public key that signs tokens.
+func (s *Server) JWKS() []byte {
+	pub := s.key.PublicKey
+	jwks, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": s.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+	return jwks
+}
+
+// Sign returns a token with claims, signed by the key of the server.
+func (s *Server) Sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Helper methods
+
+// Issues a token with the requested audience and nonces, enforcing the same
+// limits as the launcher.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Audience == "" || req.TokenType != "OIDC" {
+		http.Error(w, "audience and token_type OIDC are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Nonces) > 6 {
+		http.Error(w, "at most 6 nonces are allowed", http.StatusBadRequest)
+		return
+	}
+	for _, n := range req.Nonces {
+		if len(n) < 10 || len(n) > 74 {
+			http.Error(w, "nonces must be between 10 and 74 bytes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	claims := make(map[string]any, len(s.claims)+6)
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	claims["iss"] = Issuer
+	claims["aud"] = req.Audience
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	// A single nonce is a string, and several are an array.
+	if len(req.Nonces) == 1 {
+		claims["eat_nonce"] = req.Nonces[0]
+	} else if len(req.Nonces) > 1 {
+		claims["eat_nonce"] = req.Nonces
+	}
+
+	token, err := s.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
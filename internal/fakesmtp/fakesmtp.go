@@ -0,0 +1,142 @@
+// Package fakesmtp provides an in-process SMTP server for tests. It accepts
+// every message, and PLAIN authentication with any credentials, and records
+// what it received instead of delivering it.
+package fakesmtp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Message is a message received by the server.
+type Message struct {
+	// Username is the PLAIN authentication identity, if the client authenticated.
+	Username string
+	From     string
+	To       []string
+	Data     string
+}
+
+type Server struct {
+	mu       sync.Mutex
+	messages []Message
+
+	lis net.Listener
+}
+
+// New starts a fake SMTP server listening on a random localhost port.
+// Close must be called to stop it.
+func New() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s := &Server{lis: lis}
+	go s.serve()
+	return s, nil
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.lis.Addr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.lis.Close()
+}
+
+// Helper methods
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// Handles a single connection, which may send several messages.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost fakesmtp")
+
+	var msg Message
+	var username string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			c.PrintfLine("250 localhost")
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			mech, resp, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mech, "PLAIN") {
+				c.PrintfLine("504 unsupported mechanism")
+				continue
+			}
+			// The identity, username and password are separated by NUL bytes.
+			decoded, err := base64.StdEncoding.DecodeString(resp)
+			parts := strings.Split(string(decoded), "\x00")
+			if err != nil || len(parts) != 3 {
+				c.PrintfLine("501 invalid credentials")
+				continue
+			}
+			username = parts[1]
+			c.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg = Message{Username: username, From: address(arg)}
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			msg.To = append(msg.To, address(arg))
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 ok")
+		case "RSET", "NOOP":
+			c.PrintfLine("250 ok")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+/// Helper functions
+
+// Returns the address in an argument such as FROM:<a@example.com>.
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
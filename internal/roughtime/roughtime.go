@@ -0,0 +1,319 @@
+// Package roughtime implements a client for the Roughtime protocol, as
+// originally specified by Google and served by the public Roughtime servers.
+// Responses are authenticated against the long-term public key of the server.
+package roughtime
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	NonceSize   = 64
+	requestSize = 1024
+	hashSize    = sha512.Size
+
+	certificateContext    = "RoughTime v1 delegation signature--\x00"
+	signedResponseContext = "RoughTime v1 response signature\x00"
+)
+
+var (
+	tagSig   = makeTag("SIG\x00")
+	tagNonce = makeTag("NONC")
+	tagPad   = makeTag("PAD\xff")
+	tagCert  = makeTag("CERT")
+	tagDele  = makeTag("DELE")
+	tagPubK  = makeTag("PUBK")
+	tagMinT  = makeTag("MINT")
+	tagMaxT  = makeTag("MAXT")
+	tagSrep  = makeTag("SREP")
+	tagRoot  = makeTag("ROOT")
+	tagMidp  = makeTag("MIDP")
+	tagRadi  = makeTag("RADI")
+	tagPath  = makeTag("PATH")
+	tagIndx  = makeTag("INDX")
+)
+
+// Result is a verified time reported by a server.
+type Result struct {
+	// Midpoint is the time reported by the server.
+	Midpoint time.Time
+	// Radius is the uncertainty the server claims for Midpoint.
+	Radius time.Duration
+	// Local is the local time halfway between sending the request and
+	// receiving the response, which corresponds to Midpoint.
+	Local time.Time
+	// RTT is the time between sending the request and receiving the response.
+	RTT time.Duration
+}
+
+// Offset returns how far the local clock was ahead of the server.
+func (r *Result) Offset() time.Duration {
+	return r.Local.Sub(r.Midpoint)
+}
+
+// Query asks the server at addr for the time over UDP, and verifies the
+// response against its long-term public key.
+func Query(ctx context.Context, addr string, publicKey ed25519.PublicKey) (*Result, error) {
+	var nonce [NonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	req, err := CreateRequest(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	received := time.Now()
+
+	midpoint, radius, err := VerifyResponse(buf[:n], publicKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	rtt := received.Sub(sent)
+	return &Result{
+		Midpoint: midpoint,
+		Radius:   radius,
+		Local:    sent.Add(rtt / 2),
+		RTT:      rtt,
+	}, nil
+}
+
+// CreateRequest returns a request for nonce, padded to the minimum request size.
+func CreateRequest(nonce [NonceSize]byte) ([]byte, error) {
+	msg := map[uint32][]byte{tagNonce: nonce[:]}
+	unpadded, err := encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	// Adding the padding tag grows the header by one offset and one tag.
+	msg[tagPad] = make([]byte, requestSize-len(unpadded)-8)
+	return encode(msg)
+}
+
+// VerifyResponse checks that resp is signed by a key delegated by publicKey,
+// and that it answers nonce. It returns the time and radius in the response.
+func VerifyResponse(resp []byte, publicKey ed25519.PublicKey, nonce [NonceSize]byte) (time.Time, time.Duration, error) {
+	reply, err := decode(resp)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	cert, err := decodeTag(reply, tagCert)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	dele, ok := cert[tagDele]
+	if !ok {
+		return time.Time{}, 0, errors.New("certificate is missing the delegation")
+	}
+	if !ed25519.Verify(publicKey, append([]byte(certificateContext), dele...), cert[tagSig]) {
+		return time.Time{}, 0, errors.New("invalid delegation signature")
+	}
+
+	delegation, err := decode(dele)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to decode delegation: %w", err)
+	}
+	delegatedKey := delegation[tagPubK]
+	if len(delegatedKey) != ed25519.PublicKeySize {
+		return time.Time{}, 0, errors.New("invalid delegated public key")
+	}
+	minT, err := uint64Tag(delegation, tagMinT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	maxT, err := uint64Tag(delegation, tagMaxT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	srep, ok := reply[tagSrep]
+	if !ok {
+		return time.Time{}, 0, errors.New("response is missing the signed response")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(delegatedKey), append([]byte(signedResponseContext), srep...), reply[tagSig]) {
+		return time.Time{}, 0, errors.New("invalid response signature")
+	}
+
+	signed, err := decode(srep)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("failed to decode signed response: %w", err)
+	}
+	midp, err := uint64Tag(signed, tagMidp)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	radi, err := uint32Tag(signed, tagRadi)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if midp < minT || midp > maxT {
+		return time.Time{}, 0, errors.New("midpoint is outside of the delegation validity")
+	}
+
+	// The nonce must be a leaf of the tree whose root the server signed.
+	index, err := uint32Tag(reply, tagIndx)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	path := reply[tagPath]
+	if len(path)%hashSize != 0 {
+		return time.Time{}, 0, errors.New("invalid path length")
+	}
+	hash := hashLeaf(nonce[:])
+	for ; len(path) > 0; path = path[hashSize:] {
+		if index&1 == 0 {
+			hash = hashNode(hash, path[:hashSize])
+		} else {
+			hash = hashNode(path[:hashSize], hash)
+		}
+		index >>= 1
+	}
+	if !bytes.Equal(hash, signed[tagRoot]) {
+		return time.Time{}, 0, errors.New("nonce is not included in the signed response")
+	}
+
+	return time.UnixMicro(int64(midp)), time.Duration(radi) * time.Microsecond, nil
+}
+
+/// Helper functions
+
+func makeTag(s string) uint32 {
+	return binary.LittleEndian.Uint32([]byte(s))
+}
+
+func hashLeaf(data []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Encodes a message as the number of tags, the offsets of all values but the
+// first, the tags in ascending order, and then the values.
+func encode(msg map[uint32][]byte) ([]byte, error) {
+	tags := make([]uint32, 0, len(msg))
+	for tag, value := range msg {
+		if len(value)%4 != 0 {
+			return nil, fmt.Errorf("length of value for tag %08x is not a multiple of 4", tag)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 0
+	for i, tag := range tags {
+		if i > 0 {
+			out = binary.LittleEndian.AppendUint32(out, uint32(offset))
+		}
+		offset += len(msg[tag])
+	}
+	for _, tag := range tags {
+		out = binary.LittleEndian.AppendUint32(out, tag)
+	}
+	for _, tag := range tags {
+		out = append(out, msg[tag]...)
+	}
+	return out, nil
+}
+
+func decode(data []byte) (map[uint32][]byte, error) {
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, errors.New("invalid message length")
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	if n == 0 {
+		return map[uint32][]byte{}, nil
+	}
+	// Each tag takes at least 8 bytes of header, which bounds n.
+	if n > len(data)/8 {
+		return nil, errors.New("too many tags")
+	}
+	header := 8 * n
+	values := data[header:]
+
+	msg := make(map[uint32][]byte, n)
+	var prevTag uint32
+	for i := 0; i < n; i++ {
+		tag := binary.LittleEndian.Uint32(data[4*n+4*i:])
+		if i > 0 && tag <= prevTag {
+			return nil, errors.New("tags are not in ascending order")
+		}
+		prevTag = tag
+
+		start := 0
+		if i > 0 {
+			start = int(binary.LittleEndian.Uint32(data[4*i:]))
+		}
+		end := len(values)
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(data[4*(i+1):]))
+		}
+		if start%4 != 0 || start > end || end > len(values) {
+			return nil, errors.New("invalid offset")
+		}
+		msg[tag] = values[start:end]
+	}
+	return msg, nil
+}
+
+func decodeTag(msg map[uint32][]byte, tag uint32) (map[uint32][]byte, error) {
+	value, ok := msg[tag]
+	if !ok {
+		return nil, fmt.Errorf("missing tag %08x", tag)
+	}
+	return decode(value)
+}
+
+func uint64Tag(msg map[uint32][]byte, tag uint32) (uint64, error) {
+	value := msg[tag]
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid or missing tag %08x", tag)
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+func uint32Tag(msg map[uint32][]byte, tag uint32) (uint32, error) {
+	value := msg[tag]
+	if len(value) != 4 {
+		return 0, fmt.Errorf("invalid or missing tag %08x", tag)
+	}
+	return binary.LittleEndian.Uint32(value), nil
+}
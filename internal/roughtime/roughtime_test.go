@@ -0,0 +1,142 @@
+package roughtime
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestQuery(t *testing.T) {
+	s := newTestServer(t)
+	s.SetOffset(-time.Hour)
+	s.SetRadius(3 * time.Second)
+
+	res, err := Query(context.Background(), s.Addr(), s.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := res.Offset(); off < time.Hour-time.Second || off > time.Hour+time.Second {
+		t.Errorf("Offset() = %s, want about 1h", off)
+	}
+	if res.Radius != 3*time.Second {
+		t.Errorf("Radius = %s, want 3s", res.Radius)
+	}
+
+	// The response must be signed under the key of the server.
+	other := newTestServer(t)
+	if _, err := Query(context.Background(), s.Addr(), other.PublicKey()); err == nil || !strings.Contains(err.Error(), "delegation signature") {
+		t.Errorf("Query() with the wrong key = %v", err)
+	}
+}
+
+// Returns a response from s to a request for nonce.
+func respond(t *testing.T, s *Server, nonce [NonceSize]byte) map[uint32][]byte {
+	t.Helper()
+	req, err := CreateRequest(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.respond(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// Re-signs the signed response of resp after modifying it with f.
+func resign(t *testing.T, s *Server, resp map[uint32][]byte, f func(srep map[uint32][]byte)) {
+	t.Helper()
+	srep, err := decode(resp[tagSrep])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f(srep)
+	if resp[tagSrep], err = encode(srep); err != nil {
+		t.Fatal(err)
+	}
+	resp[tagSig] = ed25519.Sign(s.delegated, append([]byte(signedResponseContext), resp[tagSrep]...))
+}
+
+func TestVerifyResponse(t *testing.T) {
+	s := newTestServer(t)
+	var nonce, sibling [NonceSize]byte
+	rand.Read(nonce[:])
+	rand.Read(sibling[:])
+
+	for _, tc := range []struct {
+		name   string
+		modify func(resp map[uint32][]byte)
+		want   string
+	}{
+		{"valid", func(resp map[uint32][]byte) {}, ""},
+		{"batched", func(resp map[uint32][]byte) {
+			// The nonce is the right leaf of a tree of two requests.
+			resign(t, s, resp, func(srep map[uint32][]byte) {
+				srep[tagRoot] = hashNode(hashLeaf(sibling[:]), hashLeaf(nonce[:]))
+			})
+			resp[tagPath] = hashLeaf(sibling[:])
+			resp[tagIndx] = binary.LittleEndian.AppendUint32(nil, 1)
+		}, ""},
+		{"wrong index", func(resp map[uint32][]byte) {
+			resign(t, s, resp, func(srep map[uint32][]byte) {
+				srep[tagRoot] = hashNode(hashLeaf(sibling[:]), hashLeaf(nonce[:]))
+			})
+			resp[tagPath] = hashLeaf(sibling[:])
+		}, "nonce is not included"},
+		{"other nonce", func(resp map[uint32][]byte) {
+			resign(t, s, resp, func(srep map[uint32][]byte) {
+				srep[tagRoot] = hashLeaf(sibling[:])
+			})
+		}, "nonce is not included"},
+		{"truncated path", func(resp map[uint32][]byte) {
+			resp[tagPath] = make([]byte, hashSize-4)
+		}, "invalid path length"},
+		{"tampered midpoint", func(resp map[uint32][]byte) {
+			srep, _ := decode(resp[tagSrep])
+			srep[tagMidp] = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixMicro()))
+			resp[tagSrep], _ = encode(srep)
+		}, "invalid response signature"},
+		{"outside delegation", func(resp map[uint32][]byte) {
+			resign(t, s, resp, func(srep map[uint32][]byte) {
+				srep[tagMidp] = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().Add(48*time.Hour).UnixMicro()))
+			})
+		}, "outside of the delegation validity"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := respond(t, s, nonce)
+			tc.modify(resp)
+			raw, err := encode(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = VerifyResponse(raw, s.PublicKey(), nonce)
+			if tc.want == "" {
+				if err != nil {
+					t.Errorf("VerifyResponse() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("VerifyResponse() = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package roughtime
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server is a local Roughtime server for tests, which answers every request
+// on its own. Its time can be skewed to exercise clients.
+type Server struct {
+	publicKey ed25519.PublicKey
+	cert      []byte
+	delegated ed25519.PrivateKey
+
+	mu     sync.Mutex
+	offset time.Duration
+	radius time.Duration
+
+	conn net.PacketConn
+}
+
+// NewServer starts a server listening on a random localhost UDP port, with a
+// fresh long-term key and a delegation valid for a day around now.
+// Close must be called to stop it.
+func NewServer() (*Server, error) {
+	publicKey, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate root key: %w", err)
+	}
+	delegatedPublic, delegated, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate delegated key: %w", err)
+	}
+
+	now := time.Now()
+	dele, err := encode(map[uint32][]byte{
+		tagPubK: delegatedPublic,
+		tagMinT: binary.LittleEndian.AppendUint64(nil, uint64(now.Add(-24*time.Hour).UnixMicro())),
+		tagMaxT: binary.LittleEndian.AppendUint64(nil, uint64(now.Add(24*time.Hour).UnixMicro())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := encode(map[uint32][]byte{
+		tagDele: dele,
+		tagSig:  ed25519.Sign(rootKey, append([]byte(certificateContext), dele...)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s := &Server{
+		publicKey: publicKey,
+		cert:      cert,
+		delegated: delegated,
+		radius:    time.Second,
+		conn:      conn,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// SetOffset makes the server report the time shifted by offset.
+func (s *Server) SetOffset(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+}
+
+// SetRadius makes the server claim radius as the uncertainty of its time.
+func (s *Server) SetRadius(radius time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.radius = radius
+}
+
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.publicKey
+}
+
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *Server) Close() {
+	s.conn.Close()
+}
+
+// Helper methods
+
+func (s *Server) serve() {
+	buf := make([]byte, 2*requestSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp, err := s.respond(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+// Answers a single request, as the only leaf of the tree.
+func (s *Server) respond(req []byte) ([]byte, error) {
+	if len(req) < requestSize {
+		return nil, fmt.Errorf("request too short")
+	}
+	msg, err := decode(req)
+	if err != nil {
+		return nil, err
+	}
+	nonce := msg[tagNonce]
+	if len(nonce) != NonceSize {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	s.mu.Lock()
+	now := time.Now().Add(s.offset)
+	radius := s.radius
+	s.mu.Unlock()
+
+	srep, err := encode(map[uint32][]byte{
+		tagRoot: hashLeaf(nonce),
+		tagMidp: binary.LittleEndian.AppendUint64(nil, uint64(now.UnixMicro())),
+		tagRadi: binary.LittleEndian.AppendUint32(nil, uint32(radius.Microseconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encode(map[uint32][]byte{
+		tagSig:  ed25519.Sign(s.delegated, append([]byte(signedResponseContext), srep...)),
+		tagPath: {},
+		tagSrep: srep,
+		tagCert: s.cert,
+		tagIndx: binary.LittleEndian.AppendUint32(nil, 0),
+	})
+}
@@ -40,6 +40,25 @@ locals {
   witness_name = "ConfidentialWitness-${var.project_id}"
   # The provider name cannot be set automatically because otherwise there is a circular dependency
   witness_audience = "//iam.googleapis.com/${google_iam_workload_identity_pool.trusted_workload.name}/providers/attestation-verifier"
+
+  # Variables the bootloader allows to be set besides the ones above, all of which
+  # change what the witness trusts. Each is pinned to its value in witness_env, or
+  # must be unset. Keep in sync with the Dockerfile and audit.OptionalEnv.
+  witness_optional_env = [
+    "WITNESS_STATE_DIR",
+    "WITNESS_STATE_BUCKET",
+    "WITNESS_COSIGNATURE_LOG_DIR",
+    "WITNESS_BOOTSTRAP_DISTRIBUTORS",
+    "WITNESS_BOOTSTRAP_WITNESSES",
+    "WITNESS_BOOTSTRAP_QUORUM",
+    "WITNESS_BOOTSTRAP_TIMEOUT",
+    "WITNESS_PEERS",
+    "WITNESS_ROUGHTIME_SERVERS",
+    "WITNESS_ROUGHTIME_THRESHOLD",
+    "WITNESS_ROUGHTIME_INTERVAL",
+    "WITNESS_ALERT_SINKS",
+    "WITNESS_ATTESTATION_AUDIENCE",
+  ]
 }
 
 resource "google_iam_workload_identity_pool_provider" "attestation_verifier" {
@@ -48,6 +67,8 @@ resource "google_iam_workload_identity_pool_provider" "attestation_verifier" {
   workload_identity_pool_id          = google_iam_workload_identity_pool.trusted_workload.workload_identity_pool_id
 
   oidc {
+    # The witness refuses these as the audience of the tokens it hands out,
+    # do not change without updating providerAudiences in attestation.go
     allowed_audiences = ["https://sts.googleapis.com"]
     issuer_uri        = "https://confidentialcomputing.googleapis.com/"
   }
@@ -65,8 +86,25 @@ resource "google_iam_workload_identity_pool_provider" "attestation_verifier" {
     assertion.submods.container.env.WITNESS_KEY=='${local.witness_key}' &&
     assertion.submods.container.env.WITNESS_NAME=='${local.witness_name}' &&
     assertion.submods.container.env.WITNESS_AUDIENCE=='${local.witness_audience}' &&
+    %{ if var.witness_vkey != "" ~}
+    assertion.submods.container.env.WITNESS_VKEY=='${var.witness_vkey}' &&
+    %{ endif ~}
+    %{ for name in local.witness_optional_env ~}
+    %{ if contains(keys(var.witness_env), name) ~}
+    assertion.submods.container.env.${name}=='${lookup(var.witness_env, name, "")}' &&
+    %{ else ~}
+    !('${name}' in assertion.submods.container.env) &&
+    %{ endif ~}
+    %{ endfor ~}
     '${google_service_account.witness_compute_engine.email}' in assertion.google_service_accounts
   EOF
+
+  lifecycle {
+    precondition {
+      condition     = alltrue([for name in keys(var.witness_env) : contains(local.witness_optional_env, name)])
+      error_message = "witness_env may only set ${join(", ", local.witness_optional_env)}."
+    }
+  }
 }
 
 # ----------------------------------------------------------
@@ -97,6 +135,38 @@ output "trusted_image_iam_member" {
 
 # ----------------------------------------------------------
 
+# Sealed checkpoint state, used when WITNESS_STATE_BUCKET is set
+resource "google_storage_bucket" "witness_state" {
+  name                        = "${var.project_id}-witness-state"
+  location                    = var.region
+  uniform_bucket_level_access = true
+  public_access_prevention    = "enforced"
+}
+
+data "google_iam_policy" "trusted_image_state" {
+  # objectUser does not include storage.buckets.get, which is checked on startup
+  binding {
+    role    = "roles/storage.legacyBucketReader"
+    members = [local.trusted_image_iam_member]
+  }
+
+  binding {
+    role    = "roles/storage.objectUser"
+    members = [local.trusted_image_iam_member]
+  }
+}
+
+resource "google_storage_bucket_iam_policy" "trusted_workload_state_binding" {
+  bucket      = google_storage_bucket.witness_state.name
+  policy_data = data.google_iam_policy.trusted_image_state.policy_data
+}
+
+output "state_bucket" {
+  value = google_storage_bucket.witness_state.name
+}
+
+# ----------------------------------------------------------
+
 resource "google_compute_network" "witness" {
   name = "witness-network"
 }
@@ -123,12 +193,16 @@ resource "google_compute_region_instance_template" "witness_template" {
   name         = "witness-template"
   machine_type = "n2d-highcpu-2"
 
-  metadata = {
+  metadata = merge({
     "tee-image-reference"      = "${var.bootloader}"
     "tee-env-WITNESS_KEY"      = local.witness_key
     "tee-env-WITNESS_NAME"     = local.witness_name
     "tee-env-WITNESS_AUDIENCE" = local.witness_audience
-  }
+    }, var.witness_vkey == "" ? {} : {
+    "tee-env-WITNESS_VKEY" = var.witness_vkey
+    }, {
+    for name, value in var.witness_env : "tee-env-${name}" => value
+  })
 
   disk {
     source_image = "projects/confidential-space-images/global/images/family/confidential-space"
@@ -184,9 +258,11 @@ resource "google_compute_health_check" "witness_running" {
   healthy_threshold   = 2
   unhealthy_threshold = 3 # 15 seconds
 
-  # the witness serves the public key on port 8080 and is always expected to return 200
+  # /healthz only reports that the process is alive, so that a KMS outage
+  # does not recycle every instance, and waiting on bootstrap, which can take
+  # longer than initial_delay_sec, does not either
   http_health_check {
-    request_path = "/"
+    request_path = "/healthz"
     port         = "8080"
   }
 }
@@ -12,3 +12,21 @@ variable "bootloader" {
   description = "Ref for bootloader image."
   type        = string
 }
+
+variable "witness_vkey" {
+  description = "Optional verifier key the witness is pinned to. Leave empty until the key has been created."
+  type        = string
+  default     = ""
+}
+
+variable "witness_env" {
+  description = "Optional environment of the witness, such as WITNESS_STATE_BUCKET or WITNESS_PEERS, each of which is pinned by the attribute condition. Variables that are not set here must be unset."
+  type        = map(string)
+  default     = {}
+
+  validation {
+    # Values are quoted in the attribute condition, and split on && when audited.
+    condition     = alltrue([for value in values(var.witness_env) : !can(regex("['\\\\]|&&", value))])
+    error_message = "witness_env values must not contain quotes, backslashes or &&."
+  }
+}
@@ -18,6 +18,9 @@ module "deployment" {
   region     = var.region
   bootloader = var.bootloader
 
+  witness_vkey = var.witness_vkey
+  witness_env  = var.witness_env
+
   depends_on = [module.services]
 }
 
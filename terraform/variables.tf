@@ -13,3 +13,15 @@ variable "bootloader" {
   type        = string
   default     = "ghcr.io/aditsachde/confidential-witness@sha256:b634433ac01a0f43c05bbeb257044b990fee51a3128a5a5310192a5bddc9bc2d"
 }
+
+variable "witness_vkey" {
+  description = "Optional verifier key the witness is pinned to. Leave empty until the key has been created."
+  type        = string
+  default     = ""
+}
+
+variable "witness_env" {
+  description = "Optional environment of the witness, such as WITNESS_STATE_BUCKET or WITNESS_PEERS, each of which is pinned by the attribute condition. Variables that are not set here must be unset."
+  type        = map(string)
+  default     = {}
+}